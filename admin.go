@@ -0,0 +1,169 @@
+package grproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errTunnelKilled = status.Error(codes.Aborted, "grproxy: tunnel killed")
+
+// Tunnels returns the open tunnels, oldest first.
+func (svc *ProxyServerService) Tunnels() []TunnelStatus {
+	return svc.tunnels.list("", "")
+}
+
+// addTunnel registers an open tunnel under the ID of the Hello, if possible.
+// kill is called when the tunnel is killed through the admin service.
+func (svc *ProxyServerService) addTunnel(ctx context.Context, info TunnelInfo, resumable bool, kill func()) *tunnel {
+	var id string
+	if hello, ok := HelloFromContext(ctx); ok {
+		id = hello.TunnelId
+	}
+	return svc.tunnels.add(id, info, resumable, kill)
+}
+
+// drain makes new tunnels to target fail, or accepts them again when undrain
+// is set.
+func (svc *ProxyServerService) drain(target string, undrain bool) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if undrain {
+		delete(svc.drained, target)
+	} else {
+		svc.drained[target] = true
+	}
+}
+
+// checkDrained fails when target is drained.
+func (svc *ProxyServerService) checkDrained(target string) error {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if svc.drained[target] {
+		return status.Errorf(codes.Unavailable, "grproxy: target %s is drained", target)
+	}
+	return nil
+}
+
+// serverConfig is the configuration of a server as dumped by the admin
+// service.
+type serverConfig struct {
+	RateLimits     *RateLimits         `json:",omitempty"`
+	Admission      *ConcurrencyLimits  `json:",omitempty"`
+	Compression    *compressionConfig  `json:",omitempty"`
+	Batching       *Batching           `json:",omitempty"`
+	Resumption     *Resumption         `json:",omitempty"`
+	Keepalive      *Keepalive          `json:",omitempty"`
+	ProxyProtocol  *ProxyProtocol      `json:",omitempty"`
+	Recording      *Recording          `json:",omitempty"`
+	Filters        []string            `json:",omitempty"`
+	Routes         map[string][]string `json:",omitempty"`
+	DrainedTargets []string            `json:",omitempty"`
+}
+
+type compressionConfig struct {
+	Encodings []string
+	MinSize   int
+	MaxRatio  float64
+}
+
+func (svc *ProxyServerService) config() serverConfig {
+	var c serverConfig
+	if svc.limiter != nil {
+		c.RateLimits = &svc.limiter.limits
+	}
+	if svc.admission != nil {
+		c.Admission = &svc.admission.limits
+	}
+	if svc.compression != nil {
+		c.Compression = &compressionConfig{MinSize: svc.compression.MinSize, MaxRatio: svc.compression.MaxRatio}
+		for _, e := range svc.compression.Encodings {
+			c.Compression.Encodings = append(c.Compression.Encodings, e.String())
+		}
+	}
+	c.Batching, c.Resumption, c.Keepalive = svc.batching, svc.resumption, svc.keepalive
+	c.ProxyProtocol = svc.proxyProtocol
+	if svc.recorder != nil {
+		c.Recording = &svc.recorder.config
+	}
+	for _, f := range svc.filters {
+		c.Filters = append(c.Filters, fmt.Sprintf("%T", f))
+	}
+	c.Routes = svc.registry.routeNames()
+
+	svc.mu.Lock()
+	for target := range svc.drained {
+		c.DrainedTargets = append(c.DrainedTargets, target)
+	}
+	svc.mu.Unlock()
+	sort.Strings(c.DrainedTargets)
+	return c
+}
+
+// NewAdminServer returns the grproxy.admin.v1 service of svc. Register it on
+// the grpc.Server of svc with RegisterAdminServiceServer, or use WithAdmin.
+// Anyone who can call it can kill tunnels, so restrict it, e.g. with an
+// interceptor.
+func NewAdminServer(svc *ProxyServerService) AdminServiceServer {
+	return &adminServer{svc: svc}
+}
+
+type adminServer struct {
+	svc *ProxyServerService
+}
+
+func (s *adminServer) ListTunnels(ctx context.Context, req *ListTunnelsRequest) (*ListTunnelsResponse, error) {
+	resp := &ListTunnelsResponse{}
+	for _, t := range s.svc.tunnels.list(req.Identity, req.Target) {
+		start, _ := ptypes.TimestampProto(t.Start)
+		resp.Tunnels = append(resp.Tunnels, &Tunnel{
+			Id:              t.ID,
+			Identity:        t.Identity,
+			Target:          t.Target,
+			Peer:            t.Peer,
+			Backend:         t.Backend,
+			StartTime:       start,
+			UpstreamBytes:   t.UpstreamBytes,
+			DownstreamBytes: t.DownstreamBytes,
+			Resumable:       t.Resumable,
+		})
+	}
+	return resp, nil
+}
+
+func (s *adminServer) KillTunnel(ctx context.Context, req *KillTunnelRequest) (*KillTunnelResponse, error) {
+	if !s.svc.tunnels.kill(req.Id) {
+		return nil, status.Errorf(codes.NotFound, "grproxy: unknown tunnel %s", req.Id)
+	}
+	return &KillTunnelResponse{}, nil
+}
+
+func (s *adminServer) DrainTarget(ctx context.Context, req *DrainTargetRequest) (*DrainTargetResponse, error) {
+	if req.Target == "" {
+		return nil, status.Error(codes.InvalidArgument, "grproxy: missing target")
+	}
+	s.svc.drain(req.Target, req.Undrain)
+
+	tunnels := s.svc.tunnels.list("", req.Target)
+	if req.Kill {
+		for _, t := range tunnels {
+			s.svc.tunnels.kill(t.ID)
+		}
+	}
+	return &DrainTargetResponse{Tunnels: int32(len(tunnels))}, nil
+}
+
+func (s *adminServer) GetConfig(ctx context.Context, req *GetConfigRequest) (*GetConfigResponse, error) {
+	b, err := json.Marshal(s.svc.config())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &GetConfigResponse{Json: string(b)}, nil
+}
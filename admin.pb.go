@@ -0,0 +1,688 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: admin.proto
+
+package grproxy
+
+import (
+	context "context"
+	fmt "fmt"
+	math "math"
+
+	proto "github.com/golang/protobuf/proto"
+	timestamp "github.com/golang/protobuf/ptypes/timestamp"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type Tunnel struct {
+	Id                   string               `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Identity             string               `protobuf:"bytes,2,opt,name=identity,proto3" json:"identity,omitempty"`
+	Target               string               `protobuf:"bytes,3,opt,name=target,proto3" json:"target,omitempty"`
+	Peer                 string               `protobuf:"bytes,4,opt,name=peer,proto3" json:"peer,omitempty"`
+	Backend              string               `protobuf:"bytes,5,opt,name=backend,proto3" json:"backend,omitempty"`
+	StartTime            *timestamp.Timestamp `protobuf:"bytes,6,opt,name=start_time,json=startTime,proto3" json:"start_time,omitempty"`
+	UpstreamBytes        uint64               `protobuf:"varint,7,opt,name=upstream_bytes,json=upstreamBytes,proto3" json:"upstream_bytes,omitempty"`
+	DownstreamBytes      uint64               `protobuf:"varint,8,opt,name=downstream_bytes,json=downstreamBytes,proto3" json:"downstream_bytes,omitempty"`
+	Resumable            bool                 `protobuf:"varint,9,opt,name=resumable,proto3" json:"resumable,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}             `json:"-"`
+	XXX_unrecognized     []byte               `json:"-"`
+	XXX_sizecache        int32                `json:"-"`
+}
+
+func (m *Tunnel) Reset()         { *m = Tunnel{} }
+func (m *Tunnel) String() string { return proto.CompactTextString(m) }
+func (*Tunnel) ProtoMessage()    {}
+func (*Tunnel) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{0}
+}
+
+func (m *Tunnel) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Tunnel.Unmarshal(m, b)
+}
+func (m *Tunnel) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Tunnel.Marshal(b, m, deterministic)
+}
+func (m *Tunnel) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Tunnel.Merge(m, src)
+}
+func (m *Tunnel) XXX_Size() int {
+	return xxx_messageInfo_Tunnel.Size(m)
+}
+func (m *Tunnel) XXX_DiscardUnknown() {
+	xxx_messageInfo_Tunnel.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Tunnel proto.InternalMessageInfo
+
+func (m *Tunnel) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Tunnel) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
+func (m *Tunnel) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+func (m *Tunnel) GetPeer() string {
+	if m != nil {
+		return m.Peer
+	}
+	return ""
+}
+
+func (m *Tunnel) GetBackend() string {
+	if m != nil {
+		return m.Backend
+	}
+	return ""
+}
+
+func (m *Tunnel) GetStartTime() *timestamp.Timestamp {
+	if m != nil {
+		return m.StartTime
+	}
+	return nil
+}
+
+func (m *Tunnel) GetUpstreamBytes() uint64 {
+	if m != nil {
+		return m.UpstreamBytes
+	}
+	return 0
+}
+
+func (m *Tunnel) GetDownstreamBytes() uint64 {
+	if m != nil {
+		return m.DownstreamBytes
+	}
+	return 0
+}
+
+func (m *Tunnel) GetResumable() bool {
+	if m != nil {
+		return m.Resumable
+	}
+	return false
+}
+
+type ListTunnelsRequest struct {
+	Identity             string   `protobuf:"bytes,1,opt,name=identity,proto3" json:"identity,omitempty"`
+	Target               string   `protobuf:"bytes,2,opt,name=target,proto3" json:"target,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListTunnelsRequest) Reset()         { *m = ListTunnelsRequest{} }
+func (m *ListTunnelsRequest) String() string { return proto.CompactTextString(m) }
+func (*ListTunnelsRequest) ProtoMessage()    {}
+func (*ListTunnelsRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{1}
+}
+
+func (m *ListTunnelsRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListTunnelsRequest.Unmarshal(m, b)
+}
+func (m *ListTunnelsRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListTunnelsRequest.Marshal(b, m, deterministic)
+}
+func (m *ListTunnelsRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListTunnelsRequest.Merge(m, src)
+}
+func (m *ListTunnelsRequest) XXX_Size() int {
+	return xxx_messageInfo_ListTunnelsRequest.Size(m)
+}
+func (m *ListTunnelsRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListTunnelsRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListTunnelsRequest proto.InternalMessageInfo
+
+func (m *ListTunnelsRequest) GetIdentity() string {
+	if m != nil {
+		return m.Identity
+	}
+	return ""
+}
+
+func (m *ListTunnelsRequest) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+type ListTunnelsResponse struct {
+	Tunnels              []*Tunnel `protobuf:"bytes,1,rep,name=tunnels,proto3" json:"tunnels,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *ListTunnelsResponse) Reset()         { *m = ListTunnelsResponse{} }
+func (m *ListTunnelsResponse) String() string { return proto.CompactTextString(m) }
+func (*ListTunnelsResponse) ProtoMessage()    {}
+func (*ListTunnelsResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{2}
+}
+
+func (m *ListTunnelsResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListTunnelsResponse.Unmarshal(m, b)
+}
+func (m *ListTunnelsResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListTunnelsResponse.Marshal(b, m, deterministic)
+}
+func (m *ListTunnelsResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListTunnelsResponse.Merge(m, src)
+}
+func (m *ListTunnelsResponse) XXX_Size() int {
+	return xxx_messageInfo_ListTunnelsResponse.Size(m)
+}
+func (m *ListTunnelsResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListTunnelsResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListTunnelsResponse proto.InternalMessageInfo
+
+func (m *ListTunnelsResponse) GetTunnels() []*Tunnel {
+	if m != nil {
+		return m.Tunnels
+	}
+	return nil
+}
+
+type KillTunnelRequest struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KillTunnelRequest) Reset()         { *m = KillTunnelRequest{} }
+func (m *KillTunnelRequest) String() string { return proto.CompactTextString(m) }
+func (*KillTunnelRequest) ProtoMessage()    {}
+func (*KillTunnelRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{3}
+}
+
+func (m *KillTunnelRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KillTunnelRequest.Unmarshal(m, b)
+}
+func (m *KillTunnelRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KillTunnelRequest.Marshal(b, m, deterministic)
+}
+func (m *KillTunnelRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KillTunnelRequest.Merge(m, src)
+}
+func (m *KillTunnelRequest) XXX_Size() int {
+	return xxx_messageInfo_KillTunnelRequest.Size(m)
+}
+func (m *KillTunnelRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_KillTunnelRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KillTunnelRequest proto.InternalMessageInfo
+
+func (m *KillTunnelRequest) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+type KillTunnelResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KillTunnelResponse) Reset()         { *m = KillTunnelResponse{} }
+func (m *KillTunnelResponse) String() string { return proto.CompactTextString(m) }
+func (*KillTunnelResponse) ProtoMessage()    {}
+func (*KillTunnelResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{4}
+}
+
+func (m *KillTunnelResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KillTunnelResponse.Unmarshal(m, b)
+}
+func (m *KillTunnelResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KillTunnelResponse.Marshal(b, m, deterministic)
+}
+func (m *KillTunnelResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KillTunnelResponse.Merge(m, src)
+}
+func (m *KillTunnelResponse) XXX_Size() int {
+	return xxx_messageInfo_KillTunnelResponse.Size(m)
+}
+func (m *KillTunnelResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_KillTunnelResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KillTunnelResponse proto.InternalMessageInfo
+
+type DrainTargetRequest struct {
+	Target               string   `protobuf:"bytes,1,opt,name=target,proto3" json:"target,omitempty"`
+	Kill                 bool     `protobuf:"varint,2,opt,name=kill,proto3" json:"kill,omitempty"`
+	Undrain              bool     `protobuf:"varint,3,opt,name=undrain,proto3" json:"undrain,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DrainTargetRequest) Reset()         { *m = DrainTargetRequest{} }
+func (m *DrainTargetRequest) String() string { return proto.CompactTextString(m) }
+func (*DrainTargetRequest) ProtoMessage()    {}
+func (*DrainTargetRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{5}
+}
+
+func (m *DrainTargetRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DrainTargetRequest.Unmarshal(m, b)
+}
+func (m *DrainTargetRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DrainTargetRequest.Marshal(b, m, deterministic)
+}
+func (m *DrainTargetRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DrainTargetRequest.Merge(m, src)
+}
+func (m *DrainTargetRequest) XXX_Size() int {
+	return xxx_messageInfo_DrainTargetRequest.Size(m)
+}
+func (m *DrainTargetRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DrainTargetRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DrainTargetRequest proto.InternalMessageInfo
+
+func (m *DrainTargetRequest) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+func (m *DrainTargetRequest) GetKill() bool {
+	if m != nil {
+		return m.Kill
+	}
+	return false
+}
+
+func (m *DrainTargetRequest) GetUndrain() bool {
+	if m != nil {
+		return m.Undrain
+	}
+	return false
+}
+
+type DrainTargetResponse struct {
+	Tunnels              int32    `protobuf:"varint,1,opt,name=tunnels,proto3" json:"tunnels,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DrainTargetResponse) Reset()         { *m = DrainTargetResponse{} }
+func (m *DrainTargetResponse) String() string { return proto.CompactTextString(m) }
+func (*DrainTargetResponse) ProtoMessage()    {}
+func (*DrainTargetResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{6}
+}
+
+func (m *DrainTargetResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DrainTargetResponse.Unmarshal(m, b)
+}
+func (m *DrainTargetResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DrainTargetResponse.Marshal(b, m, deterministic)
+}
+func (m *DrainTargetResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DrainTargetResponse.Merge(m, src)
+}
+func (m *DrainTargetResponse) XXX_Size() int {
+	return xxx_messageInfo_DrainTargetResponse.Size(m)
+}
+func (m *DrainTargetResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DrainTargetResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DrainTargetResponse proto.InternalMessageInfo
+
+func (m *DrainTargetResponse) GetTunnels() int32 {
+	if m != nil {
+		return m.Tunnels
+	}
+	return 0
+}
+
+type GetConfigRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetConfigRequest) Reset()         { *m = GetConfigRequest{} }
+func (m *GetConfigRequest) String() string { return proto.CompactTextString(m) }
+func (*GetConfigRequest) ProtoMessage()    {}
+func (*GetConfigRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{7}
+}
+
+func (m *GetConfigRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetConfigRequest.Unmarshal(m, b)
+}
+func (m *GetConfigRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetConfigRequest.Marshal(b, m, deterministic)
+}
+func (m *GetConfigRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetConfigRequest.Merge(m, src)
+}
+func (m *GetConfigRequest) XXX_Size() int {
+	return xxx_messageInfo_GetConfigRequest.Size(m)
+}
+func (m *GetConfigRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetConfigRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetConfigRequest proto.InternalMessageInfo
+
+type GetConfigResponse struct {
+	Json                 string   `protobuf:"bytes,1,opt,name=json,proto3" json:"json,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetConfigResponse) Reset()         { *m = GetConfigResponse{} }
+func (m *GetConfigResponse) String() string { return proto.CompactTextString(m) }
+func (*GetConfigResponse) ProtoMessage()    {}
+func (*GetConfigResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_73a7fc70dcc2027c, []int{8}
+}
+
+func (m *GetConfigResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetConfigResponse.Unmarshal(m, b)
+}
+func (m *GetConfigResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetConfigResponse.Marshal(b, m, deterministic)
+}
+func (m *GetConfigResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetConfigResponse.Merge(m, src)
+}
+func (m *GetConfigResponse) XXX_Size() int {
+	return xxx_messageInfo_GetConfigResponse.Size(m)
+}
+func (m *GetConfigResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetConfigResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetConfigResponse proto.InternalMessageInfo
+
+func (m *GetConfigResponse) GetJson() string {
+	if m != nil {
+		return m.Json
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*Tunnel)(nil), "grproxy.admin.v1.Tunnel")
+	proto.RegisterType((*ListTunnelsRequest)(nil), "grproxy.admin.v1.ListTunnelsRequest")
+	proto.RegisterType((*ListTunnelsResponse)(nil), "grproxy.admin.v1.ListTunnelsResponse")
+	proto.RegisterType((*KillTunnelRequest)(nil), "grproxy.admin.v1.KillTunnelRequest")
+	proto.RegisterType((*KillTunnelResponse)(nil), "grproxy.admin.v1.KillTunnelResponse")
+	proto.RegisterType((*DrainTargetRequest)(nil), "grproxy.admin.v1.DrainTargetRequest")
+	proto.RegisterType((*DrainTargetResponse)(nil), "grproxy.admin.v1.DrainTargetResponse")
+	proto.RegisterType((*GetConfigRequest)(nil), "grproxy.admin.v1.GetConfigRequest")
+	proto.RegisterType((*GetConfigResponse)(nil), "grproxy.admin.v1.GetConfigResponse")
+}
+
+func init() { proto.RegisterFile("admin.proto", fileDescriptor_73a7fc70dcc2027c) }
+
+var fileDescriptor_73a7fc70dcc2027c = []byte{
+	// 508 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x84, 0x53, 0x51, 0x6f, 0xd3, 0x3c,
+	0x14, 0xfd, 0x92, 0x75, 0x6d, 0x73, 0xfb, 0x31, 0xba, 0x3b, 0x84, 0xac, 0x08, 0x89, 0x2a, 0x5d,
+	0x45, 0x78, 0x49, 0x45, 0x79, 0xe2, 0x91, 0x81, 0x04, 0x08, 0x9e, 0x42, 0x85, 0xc4, 0x34, 0x69,
+	0x4a, 0x16, 0x2f, 0x32, 0x4b, 0x9c, 0x60, 0x3b, 0x83, 0xfe, 0x20, 0x7e, 0x26, 0x12, 0x8a, 0x93,
+	0x34, 0x69, 0x03, 0xdb, 0x9b, 0xef, 0xf1, 0xb9, 0xa7, 0xc7, 0xe7, 0x34, 0x30, 0x09, 0xa2, 0x94,
+	0x71, 0x2f, 0x17, 0x99, 0xca, 0x70, 0x1a, 0x8b, 0x5c, 0x64, 0x3f, 0x37, 0x5e, 0x05, 0xde, 0xbe,
+	0xb0, 0x9f, 0xc6, 0x59, 0x16, 0x27, 0x74, 0xa9, 0xef, 0xc3, 0xe2, 0x7a, 0xa9, 0x58, 0x4a, 0xa5,
+	0x0a, 0xd2, 0xbc, 0x5a, 0x71, 0x7e, 0x99, 0x30, 0x5c, 0x17, 0x9c, 0xd3, 0x04, 0x8f, 0xc0, 0x64,
+	0x11, 0x31, 0x66, 0x86, 0x6b, 0xf9, 0x26, 0x8b, 0xd0, 0x86, 0x31, 0x8b, 0x28, 0x57, 0x4c, 0x6d,
+	0x88, 0xa9, 0xd1, 0xed, 0x8c, 0x8f, 0x61, 0xa8, 0x02, 0x11, 0x53, 0x45, 0x0e, 0xf4, 0x4d, 0x3d,
+	0x21, 0xc2, 0x20, 0xa7, 0x54, 0x90, 0x81, 0x46, 0xf5, 0x19, 0x09, 0x8c, 0xc2, 0xe0, 0xea, 0x86,
+	0xf2, 0x88, 0x1c, 0x6a, 0xb8, 0x19, 0xf1, 0x15, 0x80, 0x54, 0x81, 0x50, 0x97, 0xa5, 0x2b, 0x32,
+	0x9c, 0x19, 0xee, 0x64, 0x65, 0x7b, 0x95, 0x65, 0xaf, 0xb1, 0xec, 0xad, 0x1b, 0xcb, 0xbe, 0xa5,
+	0xd9, 0xe5, 0x8c, 0x0b, 0x38, 0x2a, 0x72, 0xa9, 0x04, 0x0d, 0xd2, 0xcb, 0x70, 0xa3, 0xa8, 0x24,
+	0xa3, 0x99, 0xe1, 0x0e, 0xfc, 0x07, 0x0d, 0x7a, 0x56, 0x82, 0xf8, 0x1c, 0xa6, 0x51, 0xf6, 0x83,
+	0xef, 0x10, 0xc7, 0x9a, 0xf8, 0xb0, 0xc5, 0x2b, 0xea, 0x13, 0xb0, 0x04, 0x95, 0x45, 0x1a, 0x84,
+	0x09, 0x25, 0xd6, 0xcc, 0x70, 0xc7, 0x7e, 0x0b, 0x38, 0xef, 0x01, 0x3f, 0x31, 0xa9, 0xaa, 0xa8,
+	0xa4, 0x4f, 0xbf, 0x17, 0x54, 0xaa, 0x9d, 0x88, 0x8c, 0x7f, 0x46, 0x64, 0x76, 0x23, 0x72, 0x3e,
+	0xc0, 0xc9, 0x8e, 0x92, 0xcc, 0x33, 0x2e, 0x29, 0xae, 0x60, 0xa4, 0x2a, 0x88, 0x18, 0xb3, 0x03,
+	0x77, 0xb2, 0x22, 0xde, 0x7e, 0x9b, 0x5e, 0xb5, 0xe3, 0x37, 0x44, 0x67, 0x0e, 0xc7, 0x1f, 0x59,
+	0x92, 0xd4, 0x70, 0xed, 0x69, 0xaf, 0x46, 0xe7, 0x11, 0x60, 0x97, 0x54, 0xfd, 0x9c, 0x73, 0x0e,
+	0xf8, 0x56, 0x04, 0x8c, 0xaf, 0xb5, 0xa9, 0x66, 0xb7, 0xf5, 0x6c, 0xec, 0xd7, 0x7a, 0xc3, 0x92,
+	0x44, 0xbf, 0x64, 0xec, 0xeb, 0x73, 0x59, 0x6b, 0xc1, 0xa3, 0x52, 0x43, 0xff, 0x07, 0xc6, 0x7e,
+	0x33, 0x3a, 0x4b, 0x38, 0xd9, 0xd1, 0xae, 0x5f, 0x48, 0xba, 0x2f, 0x34, 0xdc, 0xc3, 0xf6, 0x1d,
+	0x08, 0xd3, 0x77, 0x54, 0xbd, 0xc9, 0xf8, 0x35, 0x8b, 0x6b, 0x2b, 0xce, 0x33, 0x38, 0xee, 0x60,
+	0xb5, 0x04, 0xc2, 0xe0, 0x9b, 0xcc, 0x78, 0xed, 0x4e, 0x9f, 0x57, 0xbf, 0x4d, 0xf8, 0xff, 0x75,
+	0x99, 0xd0, 0x67, 0x2a, 0x6e, 0xd9, 0x15, 0xc5, 0x0b, 0x98, 0x74, 0x02, 0xc6, 0xd3, 0x7e, 0x8e,
+	0xfd, 0x26, 0xed, 0xc5, 0x3d, 0xac, 0x3a, 0xb6, 0xff, 0xf0, 0x2b, 0x40, 0x1b, 0x27, 0xce, 0xfb,
+	0x6b, 0xbd, 0x46, 0xec, 0xd3, 0xbb, 0x49, 0x5b, 0xe9, 0x0b, 0x98, 0x74, 0x72, 0xfb, 0x9b, 0xf1,
+	0x7e, 0x65, 0xf6, 0xe2, 0x1e, 0xd6, 0x56, 0xfd, 0x0b, 0x58, 0xdb, 0x40, 0xd1, 0xe9, 0x6f, 0xed,
+	0x37, 0x60, 0xcf, 0xef, 0xe4, 0x34, 0xba, 0x67, 0xd6, 0xf9, 0xa8, 0xe6, 0x85, 0x43, 0xfd, 0xcd,
+	0xbe, 0xfc, 0x33, 0x00, 0x87, 0x4e, 0xee, 0xe4, 0x95, 0x04, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// AdminServiceClient is the client API for AdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type AdminServiceClient interface {
+	ListTunnels(ctx context.Context, in *ListTunnelsRequest, opts ...grpc.CallOption) (*ListTunnelsResponse, error)
+	KillTunnel(ctx context.Context, in *KillTunnelRequest, opts ...grpc.CallOption) (*KillTunnelResponse, error)
+	DrainTarget(ctx context.Context, in *DrainTargetRequest, opts ...grpc.CallOption) (*DrainTargetResponse, error)
+	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error)
+}
+
+type adminServiceClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewAdminServiceClient(cc *grpc.ClientConn) AdminServiceClient {
+	return &adminServiceClient{cc}
+}
+
+func (c *adminServiceClient) ListTunnels(ctx context.Context, in *ListTunnelsRequest, opts ...grpc.CallOption) (*ListTunnelsResponse, error) {
+	out := new(ListTunnelsResponse)
+	err := c.cc.Invoke(ctx, "/grproxy.admin.v1.AdminService/ListTunnels", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) KillTunnel(ctx context.Context, in *KillTunnelRequest, opts ...grpc.CallOption) (*KillTunnelResponse, error) {
+	out := new(KillTunnelResponse)
+	err := c.cc.Invoke(ctx, "/grproxy.admin.v1.AdminService/KillTunnel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) DrainTarget(ctx context.Context, in *DrainTargetRequest, opts ...grpc.CallOption) (*DrainTargetResponse, error) {
+	out := new(DrainTargetResponse)
+	err := c.cc.Invoke(ctx, "/grproxy.admin.v1.AdminService/DrainTarget", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*GetConfigResponse, error) {
+	out := new(GetConfigResponse)
+	err := c.cc.Invoke(ctx, "/grproxy.admin.v1.AdminService/GetConfig", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServiceServer is the server API for AdminService service.
+type AdminServiceServer interface {
+	ListTunnels(context.Context, *ListTunnelsRequest) (*ListTunnelsResponse, error)
+	KillTunnel(context.Context, *KillTunnelRequest) (*KillTunnelResponse, error)
+	DrainTarget(context.Context, *DrainTargetRequest) (*DrainTargetResponse, error)
+	GetConfig(context.Context, *GetConfigRequest) (*GetConfigResponse, error)
+}
+
+// UnimplementedAdminServiceServer can be embedded to have forward compatible implementations.
+type UnimplementedAdminServiceServer struct {
+}
+
+func (*UnimplementedAdminServiceServer) ListTunnels(ctx context.Context, req *ListTunnelsRequest) (*ListTunnelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListTunnels not implemented")
+}
+func (*UnimplementedAdminServiceServer) KillTunnel(ctx context.Context, req *KillTunnelRequest) (*KillTunnelResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method KillTunnel not implemented")
+}
+func (*UnimplementedAdminServiceServer) DrainTarget(ctx context.Context, req *DrainTargetRequest) (*DrainTargetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainTarget not implemented")
+}
+func (*UnimplementedAdminServiceServer) GetConfig(ctx context.Context, req *GetConfigRequest) (*GetConfigResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+
+func RegisterAdminServiceServer(s *grpc.Server, srv AdminServiceServer) {
+	s.RegisterService(&_AdminService_serviceDesc, srv)
+}
+
+func _AdminService_ListTunnels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListTunnelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListTunnels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grproxy.admin.v1.AdminService/ListTunnels",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListTunnels(ctx, req.(*ListTunnelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_KillTunnel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(KillTunnelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).KillTunnel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grproxy.admin.v1.AdminService/KillTunnel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).KillTunnel(ctx, req.(*KillTunnelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_DrainTarget_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DrainTargetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).DrainTarget(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grproxy.admin.v1.AdminService/DrainTarget",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).DrainTarget(ctx, req.(*DrainTargetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/grproxy.admin.v1.AdminService/GetConfig",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _AdminService_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "grproxy.admin.v1.AdminService",
+	HandlerType: (*AdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListTunnels",
+			Handler:    _AdminService_ListTunnels_Handler,
+		},
+		{
+			MethodName: "KillTunnel",
+			Handler:    _AdminService_KillTunnel_Handler,
+		},
+		{
+			MethodName: "DrainTarget",
+			Handler:    _AdminService_DrainTarget_Handler,
+		},
+		{
+			MethodName: "GetConfig",
+			Handler:    _AdminService_GetConfig_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "admin.proto",
+}
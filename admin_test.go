@@ -0,0 +1,163 @@
+package grproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startAdminServer serves svc with the admin service.
+func startAdminServer(t *testing.T, svc *ProxyServerService) (ProxyServiceClient, AdminServiceClient, func()) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcsrv := grpc.NewServer()
+	go NewProxyServer(grpcsrv, svc, WithAdmin()).Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxyServiceClient(conn), NewAdminServiceClient(conn), func() {
+		conn.Close()
+		grpcsrv.Stop()
+	}
+}
+
+func Test_AdminServer(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		opts       []ServerServiceOption
+		clientOpts []ClientServiceOption
+		resumable  bool
+	}{
+		"tunnel": {},
+		"session": {
+			opts:       []ServerServiceOption{WithResumption(Resumption{})},
+			clientOpts: []ClientServiceOption{WithClientResumption(Resumption{})},
+			resumable:  true,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			echo := startEchoServer(t)
+			defer echo.Close()
+
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				return net.Dial("tcp", echo.Addr().String())
+			}, append(tc.opts, WithIdentity(func(context.Context) string { return "alice" }), WithBatching(Batching{}))...)
+			proxycli, admincli, stop := startAdminServer(t, svc)
+			defer stop()
+
+			client := &upperFilter{}
+			cli := NewProxyClientService(nil, append(tc.clientOpts, WithHello(&Hello{Target: "echo"}), WithClientFilters(client))...)
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				errc <- cli.Bind(context.TODO(), proxycli, local)
+			}()
+
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			remote.Write([]byte("ping"))
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(remote, b); err != nil || string(b) != "PING" {
+				t.Fatalf("unexpected result: %s %v", b, err)
+			}
+
+			ctx := context.TODO()
+			resp, err := admincli.ListTunnels(ctx, &ListTunnelsRequest{Target: "echo"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Tunnels) != 1 {
+				t.Fatalf("unexpected tunnels: %v", resp.Tunnels)
+			}
+			tun := resp.Tunnels[0]
+			client.mu.Lock()
+			id := client.infos[0].ID
+			client.mu.Unlock()
+			if tun.Id != id || tun.Identity != "alice" || tun.Target != "echo" || tun.Peer == "" || tun.Backend != echo.Addr().String() ||
+				tun.StartTime == nil || tun.UpstreamBytes != 4 || tun.DownstreamBytes != 4 || tun.Resumable != tc.resumable {
+				t.Errorf("unexpected tunnel: %v", tun)
+			}
+			if resp, err := admincli.ListTunnels(ctx, &ListTunnelsRequest{Identity: "bob"}); err != nil || len(resp.Tunnels) != 0 {
+				t.Errorf("unexpected tunnels: %v %v", resp, err)
+			}
+
+			drained, err := admincli.DrainTarget(ctx, &DrainTargetRequest{Target: "echo"})
+			if err != nil || drained.Tunnels != 1 {
+				t.Fatalf("unexpected drain: %v %v", drained, err)
+			}
+			if err := cli.Bind(ctx, proxycli, &mockConn{}); status.Code(err) != codes.Unavailable {
+				t.Errorf("unexpected error: %v", err)
+			}
+			config, err := admincli.GetConfig(ctx, &GetConfigRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal([]byte(config.Json), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got["DrainedTargets"], []interface{}{"echo"}) || got["Batching"] == nil {
+				t.Errorf("unexpected config: %s", config.Json)
+			}
+
+			if _, err := admincli.KillTunnel(ctx, &KillTunnelRequest{Id: id}); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errc; err == nil {
+				t.Error("unexpected success of a killed tunnel")
+			}
+			if _, err := admincli.KillTunnel(ctx, &KillTunnelRequest{Id: id}); status.Code(err) != codes.NotFound {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if resp, err := admincli.ListTunnels(ctx, &ListTunnelsRequest{}); err != nil || len(resp.Tunnels) != 0 {
+				t.Errorf("unexpected tunnels: %v %v", resp, err)
+			}
+		})
+	}
+}
+
+func Test_ProxyServerService_addTunnel(t *testing.T) {
+	t.Parallel()
+
+	svc := NewProxyServerService(nil)
+	taken := svc.addTunnel(context.TODO(), TunnelInfo{}, false, nil)
+
+	tests := map[string]struct {
+		id     string
+		wantID bool
+	}{
+		"client id": {id: "abc", wantID: true},
+		"no id":     {id: ""},
+		"taken":     {id: taken.info.ID},
+		"too long":  {id: string(make([]byte, maxTunnelIDLength+1))},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			ctx := withHello(context.TODO(), &Hello{TunnelId: tc.id})
+			tun := svc.addTunnel(ctx, TunnelInfo{}, false, nil)
+			defer svc.tunnels.remove(tun)
+			if id := tun.info.ID; id == "" || (id == tc.id) != tc.wantID {
+				t.Errorf("unexpected id: %q", id)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTooManyTunnels is returned when a tunnel is not admitted.
+var ErrTooManyTunnels = errors.New("grproxy: too many tunnels")
+
+// ConcurrencyLimits caps the number of concurrent tunnels. Zero means unlimited.
+type ConcurrencyLimits struct {
+	// Total caps all tunnels handled by a listener or service.
+	Total int
+	// Identity caps the tunnels of each client identity.
+	Identity int
+	// Target caps the tunnels to each target: the target of the Hello, or
+	// else the backend address.
+	Target int
+
+	// QueueTimeout is how long a tunnel waits for a free slot.
+	// Zero rejects immediately.
+	QueueTimeout time.Duration
+}
+
+// ConcurrencyCounts is a snapshot of the live tunnel counts.
+type ConcurrencyCounts struct {
+	Total      int
+	Identities map[string]int
+	Targets    map[string]int
+}
+
+// AdmissionController decides whether a new tunnel may start.
+type AdmissionController struct {
+	limits ConcurrencyLimits
+
+	mu         sync.Mutex
+	total      int
+	identities map[string]int
+	targets    map[string]int
+	released   chan struct{}
+}
+
+func NewAdmissionController(limits ConcurrencyLimits) *AdmissionController {
+	return &AdmissionController{
+		limits:     limits,
+		identities: make(map[string]int),
+		targets:    make(map[string]int),
+		released:   make(chan struct{}),
+	}
+}
+
+// Acquire takes a slot for a tunnel of identity, counted against Total and
+// Identity. The returned function releases the slot.
+func (a *AdmissionController) Acquire(ctx context.Context, identity string) (func(), error) {
+	return a.acquire(ctx, func() bool {
+		if exceeds(a.total, a.limits.Total) || exceeds(a.identities[identity], a.limits.Identity) {
+			return false
+		}
+		a.total++
+		a.identities[identity]++
+		return true
+	}, func() {
+		a.total--
+		if a.identities[identity]--; a.identities[identity] == 0 {
+			delete(a.identities, identity)
+		}
+	})
+}
+
+// AcquireTarget takes a slot for a tunnel to target, counted against Target.
+// The returned function releases the slot.
+func (a *AdmissionController) AcquireTarget(ctx context.Context, target string) (func(), error) {
+	return a.acquire(ctx, func() bool {
+		if exceeds(a.targets[target], a.limits.Target) {
+			return false
+		}
+		a.targets[target]++
+		return true
+	}, func() {
+		if a.targets[target]--; a.targets[target] == 0 {
+			delete(a.targets, target)
+		}
+	})
+}
+
+// Counts returns the live tunnel counts.
+func (a *AdmissionController) Counts() ConcurrencyCounts {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	counts := ConcurrencyCounts{
+		Total:      a.total,
+		Identities: make(map[string]int, len(a.identities)),
+		Targets:    make(map[string]int, len(a.targets)),
+	}
+	for k, v := range a.identities {
+		counts.Identities[k] = v
+	}
+	for k, v := range a.targets {
+		counts.Targets[k] = v
+	}
+	return counts
+}
+
+func (a *AdmissionController) acquire(ctx context.Context, take func() bool, give func()) (func(), error) {
+	var timeout <-chan time.Time
+	if a.limits.QueueTimeout > 0 {
+		t := time.NewTimer(a.limits.QueueTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	for {
+		a.mu.Lock()
+		if take() {
+			a.mu.Unlock()
+			var once sync.Once
+			return func() { once.Do(func() { a.release(give) }) }, nil
+		}
+		released := a.released
+		a.mu.Unlock()
+
+		if timeout == nil {
+			return nil, ErrTooManyTunnels
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timeout:
+			return nil, ErrTooManyTunnels
+		case <-released:
+		}
+	}
+}
+
+func (a *AdmissionController) release(give func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	give()
+	close(a.released)
+	a.released = make(chan struct{})
+}
+
+func exceeds(n, limit int) bool {
+	return limit > 0 && n >= limit
+}
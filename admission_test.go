@@ -0,0 +1,128 @@
+package grproxy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_AdmissionController(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		limits  ConcurrencyLimits
+		held    []string
+		ctx     context.Context
+		release bool
+		wantErr error
+	}{
+		"unlimited": {
+			held: []string{"a", "a", "b"},
+			ctx:  context.TODO(),
+		},
+		"total reject": {
+			limits:  ConcurrencyLimits{Total: 2},
+			held:    []string{"a", "b"},
+			ctx:     context.TODO(),
+			wantErr: ErrTooManyTunnels,
+		},
+		"identity reject": {
+			limits:  ConcurrencyLimits{Identity: 1},
+			held:    []string{"a"},
+			ctx:     context.TODO(),
+			wantErr: ErrTooManyTunnels,
+		},
+		"other identity": {
+			limits: ConcurrencyLimits{Identity: 1},
+			held:   []string{"b"},
+			ctx:    context.TODO(),
+		},
+		"queue timeout": {
+			limits:  ConcurrencyLimits{Total: 1, QueueTimeout: 10 * time.Millisecond},
+			held:    []string{"b"},
+			ctx:     context.TODO(),
+			wantErr: ErrTooManyTunnels,
+		},
+		"queue released": {
+			limits:  ConcurrencyLimits{Total: 1, QueueTimeout: time.Second},
+			held:    []string{"b"},
+			ctx:     context.TODO(),
+			release: true,
+		},
+		"context cancel": {
+			limits: ConcurrencyLimits{Total: 1, QueueTimeout: time.Second},
+			held:   []string{"b"},
+			ctx: func() context.Context {
+				ctx, cancel := context.WithCancel(context.TODO())
+				cancel()
+				return ctx
+			}(),
+			wantErr: context.Canceled,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			a := NewAdmissionController(tc.limits)
+			var releases []func()
+			for _, identity := range tc.held {
+				release, err := a.Acquire(context.TODO(), identity)
+				if err != nil {
+					t.Fatal(err)
+				}
+				releases = append(releases, release)
+			}
+			if tc.release {
+				time.AfterFunc(10*time.Millisecond, releases[0])
+			}
+
+			release, err := a.Acquire(tc.ctx, "a")
+			if err != tc.wantErr {
+				t.Fatal(err)
+			} else if err != nil {
+				return
+			}
+			release()
+			release()
+			for _, release := range releases {
+				release()
+			}
+			if counts := a.Counts(); counts.Total != 0 || len(counts.Identities) != 0 {
+				t.Errorf("unexpected counts: %+v", counts)
+			}
+		})
+	}
+}
+
+func Test_AdmissionController_Counts(t *testing.T) {
+	t.Parallel()
+
+	a := NewAdmissionController(ConcurrencyLimits{Target: 1})
+	for _, identity := range []string{"a", "a", "b"} {
+		if _, err := a.Acquire(context.TODO(), identity); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release, err := a.AcquireTarget(context.TODO(), "db:3306")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.AcquireTarget(context.TODO(), "db:3306"); err != ErrTooManyTunnels {
+		t.Fatal(err)
+	}
+
+	want := ConcurrencyCounts{
+		Total:      3,
+		Identities: map[string]int{"a": 2, "b": 1},
+		Targets:    map[string]int{"db:3306": 1},
+	}
+	if got := a.Counts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected counts got:%+v want:%+v", got, want)
+	}
+
+	release()
+	if got := a.Counts().Targets; len(got) != 0 {
+		t.Errorf("unexpected targets: %v", got)
+	}
+}
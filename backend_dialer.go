@@ -0,0 +1,240 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalanceStrategy decides in which order backends are tried.
+type BalanceStrategy int
+
+const (
+	// Failover tries backends in the configured order.
+	Failover BalanceStrategy = iota
+	// RoundRobin starts each dial at the next backend.
+	RoundRobin
+	// Random tries backends in random order.
+	Random
+	// LeastConnections prefers the backend with the fewest open connections.
+	LeastConnections
+)
+
+type BackendDialerOption func(*BackendDialer)
+
+// WithBackendStrategy sets the balance strategy. The default is Failover.
+func WithBackendStrategy(s BalanceStrategy) BackendDialerOption {
+	return func(d *BackendDialer) {
+		d.strategy = s
+	}
+}
+
+// WithBackendRetry retries a failed round over all backends up to attempts
+// times, sleeping with exponential backoff between rounds. Retries never
+// exceed the deadline of the dial context.
+func WithBackendRetry(attempts int, backoff, maxBackoff time.Duration) BackendDialerOption {
+	return func(d *BackendDialer) {
+		d.attempts = attempts
+		d.backoff = backoff
+		d.maxBackoff = maxBackoff
+	}
+}
+
+// WithBackendEjection ejects a backend for duration after failures
+// consecutive dial errors.
+func WithBackendEjection(failures int, duration time.Duration) BackendDialerOption {
+	return func(d *BackendDialer) {
+		d.ejectFailures = failures
+		d.ejectDuration = duration
+	}
+}
+
+// WithBackendHealth skips backends that the health checker considers
+// unhealthy, unless no backend is healthy.
+func WithBackendHealth(h *HealthChecker) BackendDialerOption {
+	return func(d *BackendDialer) {
+		d.health = h
+	}
+}
+
+// WithBackendDialTimeout bounds each attempt to dial a backend, so that a
+// backend that does not answer leaves time to try the others. The default is
+// 5 seconds; zero leaves attempts bounded only by the dial context.
+func WithBackendDialTimeout(timeout time.Duration) BackendDialerOption {
+	return func(d *BackendDialer) {
+		d.dialTimeout = timeout
+	}
+}
+
+// WithNetDialer sets the dialer used to connect to backends.
+func WithNetDialer(nd *net.Dialer) BackendDialerOption {
+	return func(d *BackendDialer) {
+		d.dialer = nd
+	}
+}
+
+// BackendDialer dials one of several backend addresses. Its DialContext can be
+// passed to NewProxyServerService.
+type BackendDialer struct {
+	backends []*backend
+	dialer   *net.Dialer
+	netDial  func(ctx context.Context, network, address string) (net.Conn, error) // overrides dialer in tests
+	strategy BalanceStrategy
+	health   *HealthChecker
+
+	attempts    int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	dialTimeout time.Duration
+
+	ejectFailures int
+	ejectDuration time.Duration
+
+	mu   sync.Mutex
+	next int
+	rand *rand.Rand
+}
+
+type backend struct {
+	addr   string
+	active int64
+
+	// guarded by BackendDialer.mu
+	failures     int
+	ejectedUntil time.Time
+}
+
+func NewBackendDialer(addrs []string, opts ...BackendDialerOption) *BackendDialer {
+	d := &BackendDialer{
+		dialer:        &net.Dialer{},
+		attempts:      3,
+		backoff:       100 * time.Millisecond,
+		maxBackoff:    time.Second,
+		dialTimeout:   5 * time.Second,
+		ejectFailures: 3,
+		ejectDuration: 10 * time.Second,
+		rand:          rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, addr := range addrs {
+		d.backends = append(d.backends, &backend{addr: addr})
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+func (d *BackendDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	if len(d.backends) == 0 {
+		return nil, errors.New("grproxy: no backends")
+	}
+
+	backoff := d.backoff
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		for _, b := range d.candidates() {
+			conn, err := d.dial(ctx, b.addr)
+			d.report(b, err)
+			if err == nil {
+				atomic.AddInt64(&b.active, 1)
+				return &backendConn{Conn: conn, backend: b}, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, lastErr
+			}
+		}
+
+		if attempt+1 >= d.attempts {
+			return nil, lastErr
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return nil, lastErr
+		}
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, lastErr
+		}
+		if backoff *= 2; backoff > d.maxBackoff {
+			backoff = d.maxBackoff
+		}
+	}
+}
+
+// dial makes one attempt to connect to addr.
+func (d *BackendDialer) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if d.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.dialTimeout)
+		defer cancel()
+	}
+	if d.netDial != nil {
+		return d.netDial(ctx, "tcp", addr)
+	}
+	return d.dialer.DialContext(ctx, "tcp", addr)
+}
+
+// candidates returns the healthy backends in the order they should be tried.
+// If no backend is usable, all of them are returned.
+func (d *BackendDialer) candidates() []*backend {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	backends := make([]*backend, 0, len(d.backends))
+	for _, b := range d.backends {
+		if now.After(b.ejectedUntil) && (d.health == nil || d.health.Healthy(b.addr)) {
+			backends = append(backends, b)
+		}
+	}
+	if len(backends) == 0 {
+		backends = append(backends, d.backends...)
+	}
+
+	switch d.strategy {
+	case RoundRobin:
+		i := d.next % len(backends)
+		d.next++
+		backends = append(backends[i:], backends[:i]...)
+	case Random:
+		d.rand.Shuffle(len(backends), func(i, j int) {
+			backends[i], backends[j] = backends[j], backends[i]
+		})
+	case LeastConnections:
+		sort.SliceStable(backends, func(i, j int) bool {
+			return atomic.LoadInt64(&backends[i].active) < atomic.LoadInt64(&backends[j].active)
+		})
+	}
+	return backends
+}
+
+func (d *BackendDialer) report(b *backend, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err == nil {
+		b.failures = 0
+		return
+	}
+	if b.failures++; d.ejectFailures > 0 && b.failures >= d.ejectFailures {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(d.ejectDuration)
+	}
+}
+
+type backendConn struct {
+	net.Conn
+	backend *backend
+	once    sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.backend.active, -1)
+	})
+	return c.Conn.Close()
+}
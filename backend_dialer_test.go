@@ -0,0 +1,213 @@
+package grproxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func startListener(t *testing.T, addr string) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	return lis
+}
+
+// stoppedAddr returns an address nobody listens on.
+func stoppedAddr(t *testing.T) string {
+	t.Helper()
+
+	lis := startListener(t, "127.0.0.1:0")
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+func Test_BackendDialer_strategy(t *testing.T) {
+	t.Parallel()
+
+	a := startListener(t, "127.0.0.1:0")
+	defer a.Close()
+	b := startListener(t, "127.0.0.1:0")
+	defer b.Close()
+	down := stoppedAddr(t)
+
+	tests := map[string]struct {
+		addrs    []string
+		strategy BalanceStrategy
+		hold     int
+		want     []string
+	}{
+		"failover": {
+			addrs:    []string{down, a.Addr().String(), b.Addr().String()},
+			strategy: Failover,
+			want:     []string{a.Addr().String(), a.Addr().String(), a.Addr().String()},
+		},
+		"round robin": {
+			addrs:    []string{a.Addr().String(), b.Addr().String()},
+			strategy: RoundRobin,
+			want:     []string{a.Addr().String(), b.Addr().String(), a.Addr().String()},
+		},
+		"least connections": {
+			addrs:    []string{a.Addr().String(), b.Addr().String()},
+			strategy: LeastConnections,
+			hold:     1,
+			want:     []string{a.Addr().String(), b.Addr().String(), b.Addr().String()},
+		},
+		"random": {
+			addrs:    []string{a.Addr().String(), a.Addr().String()},
+			strategy: Random,
+			want:     []string{a.Addr().String(), a.Addr().String()},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			d := NewBackendDialer(tc.addrs, WithBackendStrategy(tc.strategy))
+			for i, want := range tc.want {
+				conn, err := d.DialContext(context.TODO())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := conn.RemoteAddr().String(); got != want {
+					t.Errorf("unexpected backend %d got:%s want:%s", i, got, want)
+				}
+				if i < tc.hold {
+					defer conn.Close()
+				} else {
+					conn.Close()
+				}
+			}
+		})
+	}
+}
+
+func Test_BackendDialer_retry(t *testing.T) {
+	t.Parallel()
+
+	addr := stoppedAddr(t)
+	d := NewBackendDialer([]string{addr}, WithBackendRetry(5, 50*time.Millisecond, 50*time.Millisecond))
+
+	started := make(chan net.Listener)
+	time.AfterFunc(75*time.Millisecond, func() {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			close(started)
+			return
+		}
+		started <- lis
+	})
+
+	conn, err := d.DialContext(context.TODO())
+	lis := <-started
+	if lis == nil {
+		t.Skip("address was reused")
+	}
+	defer lis.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func Test_BackendDialer_deadline(t *testing.T) {
+	t.Parallel()
+
+	d := NewBackendDialer(
+		[]string{stoppedAddr(t)},
+		WithBackendRetry(100, time.Second, time.Second),
+	)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := d.DialContext(ctx); err == nil {
+		t.Fatal("expected error")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("dial took too long: %v", elapsed)
+	}
+}
+
+func Test_BackendDialer_dialTimeout(t *testing.T) {
+	t.Parallel()
+
+	lis := startListener(t, "127.0.0.1:0")
+	defer lis.Close()
+	blackhole := stoppedAddr(t)
+
+	d := NewBackendDialer(
+		[]string{blackhole, lis.Addr().String()},
+		WithBackendDialTimeout(100*time.Millisecond),
+	)
+	// Dials to the blackhole hang like unanswered SYNs until they time out.
+	d.netDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == blackhole {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		var nd net.Dialer
+		return nd.DialContext(ctx, network, address)
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	conn, err := d.DialContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if conn.RemoteAddr().String() != lis.Addr().String() {
+		t.Errorf("unexpected backend: %v", conn.RemoteAddr())
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("dial took too long: %v", elapsed)
+	}
+}
+
+func Test_BackendDialer_ejection(t *testing.T) {
+	t.Parallel()
+
+	lis := startListener(t, "127.0.0.1:0")
+	down := stoppedAddr(t)
+	d := NewBackendDialer(
+		[]string{down, lis.Addr().String()},
+		WithBackendEjection(2, time.Minute),
+	)
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.DialContext(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if got := d.candidates(); len(got) != 1 || got[0].addr != lis.Addr().String() {
+		t.Errorf("unexpected candidates: %v", got)
+	}
+
+	// Once every backend is ejected they are all tried again.
+	lis.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := d.DialContext(context.TODO()); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if got := d.candidates(); len(got) != 2 {
+		t.Errorf("unexpected candidates: %v", got)
+	}
+}
@@ -0,0 +1,155 @@
+package grproxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Batching configures coalescing of consecutive writes into one frame.
+// Buffered data is sent once MaxSize bytes are buffered, once Delay has passed
+// since the first buffered write, or as soon as the source has nothing more to
+// read.
+type Batching struct {
+	// MaxSize defaults to 32 KiB.
+	MaxSize int
+	// Delay defaults to 500µs.
+	Delay time.Duration
+}
+
+var errBatchClosed = errors.New("grproxy: batch sender closed")
+
+type batchSender struct {
+	send    func(*ReadWrite) error
+	maxSize int
+	delay   time.Duration
+
+	mu      sync.Mutex
+	buf     []byte
+	timer   *time.Timer
+	drained bool
+	err     error
+}
+
+func newBatchSender(send func(*ReadWrite) error, b Batching) *batchSender {
+	bs := &batchSender{
+		send:    send,
+		maxSize: 32 << 10,
+		delay:   500 * time.Microsecond,
+	}
+	if b.MaxSize > 0 {
+		bs.maxSize = b.MaxSize
+	}
+	if b.Delay > 0 {
+		bs.delay = b.Delay
+	}
+	return bs
+}
+
+// reader wraps the source of the writes. A short read means the source is
+// drained, so the next write is flushed immediately.
+func (bs *batchSender) reader(r io.Reader) io.Reader {
+	return reader(func(b []byte) (int, error) {
+		n, err := r.Read(b)
+
+		bs.mu.Lock()
+		bs.drained = n < len(b)
+		bs.mu.Unlock()
+
+		return n, err
+	})
+}
+
+func (bs *batchSender) Write(b []byte) (int, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.err != nil {
+		return 0, bs.err
+	}
+
+	n := len(b)
+	for len(b) > 0 {
+		m := bs.maxSize - len(bs.buf)
+		if m > len(b) {
+			m = len(b)
+		}
+		bs.buf = append(bs.buf, b[:m]...)
+		b = b[m:]
+
+		if len(bs.buf) >= bs.maxSize {
+			if err := bs.flushLocked(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	switch {
+	case len(bs.buf) == 0:
+	case bs.drained:
+		if err := bs.flushLocked(); err != nil {
+			return 0, err
+		}
+	case bs.timer == nil:
+		bs.timer = time.AfterFunc(bs.delay, bs.flushTimer)
+	}
+	return n, nil
+}
+
+func (bs *batchSender) flushTimer() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.timer = nil
+	if bs.err == nil {
+		bs.flushLocked()
+	}
+}
+
+func (bs *batchSender) flushLocked() error {
+	if bs.timer != nil {
+		bs.timer.Stop()
+		bs.timer = nil
+	}
+	if len(bs.buf) == 0 {
+		return nil
+	}
+
+	// gRPC serializes the message before Send returns, so the buffer can be
+	// reused afterwards.
+	buf := bs.buf
+	bs.buf = buf[:0]
+	if err := bs.send(&ReadWrite{Buf: buf, Len: int32(len(buf))}); err != nil {
+		bs.err = err
+		return err
+	}
+	return nil
+}
+
+// Flush sends the buffered data.
+func (bs *batchSender) Flush() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.err != nil {
+		return bs.err
+	}
+	return bs.flushLocked()
+}
+
+// Close stops the flush timer and drops the buffered data, so that nothing is
+// sent once the stream ended.
+func (bs *batchSender) Close() {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if bs.timer != nil {
+		bs.timer.Stop()
+		bs.timer = nil
+	}
+	bs.buf = nil
+	if bs.err == nil {
+		bs.err = errBatchClosed
+	}
+}
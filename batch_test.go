@@ -0,0 +1,227 @@
+package grproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_batchSender(t *testing.T) {
+	t.Parallel()
+
+	type write struct {
+		b       []byte
+		drained bool
+	}
+	tests := map[string]struct {
+		batching Batching
+		writes   []write
+		wait     time.Duration
+		want     []string
+	}{
+		"coalesce": {
+			batching: Batching{MaxSize: 8, Delay: time.Hour},
+			writes:   []write{{b: []byte("abc")}, {b: []byte("def")}, {b: []byte("gh")}},
+			want:     []string{"abcdefgh"},
+		},
+		"split": {
+			batching: Batching{MaxSize: 4, Delay: time.Hour},
+			writes:   []write{{b: []byte("abcdefghij")}},
+			want:     []string{"abcd", "efgh"},
+		},
+		"drained": {
+			batching: Batching{MaxSize: 1024, Delay: time.Hour},
+			writes:   []write{{b: []byte("abc")}, {b: []byte("de"), drained: true}},
+			want:     []string{"abcde"},
+		},
+		"delay": {
+			batching: Batching{MaxSize: 1024, Delay: time.Millisecond},
+			writes:   []write{{b: []byte("abc")}},
+			wait:     50 * time.Millisecond,
+			want:     []string{"abc"},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			sent := make(chan string, 10)
+			bs := newBatchSender(func(rw *ReadWrite) error {
+				sent <- string(rw.Buf)
+				return nil
+			}, tc.batching)
+
+			for _, w := range tc.writes {
+				bs.drained = w.drained
+				n, err := bs.Write(w.b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n != len(w.b) {
+					t.Errorf("unexpected written: %d", n)
+				}
+			}
+			time.Sleep(tc.wait)
+
+			var got []string
+			for len(sent) > 0 {
+				got = append(got, <-sent)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected frames got:%q want:%q", got, tc.want)
+			}
+		})
+	}
+}
+
+func Test_batchSender_reader(t *testing.T) {
+	t.Parallel()
+
+	var frames []string
+	bs := newBatchSender(func(rw *ReadWrite) error {
+		frames = append(frames, string(rw.Buf))
+		return nil
+	}, Batching{MaxSize: 1024, Delay: time.Hour})
+
+	// The last read is short, so everything is flushed without waiting.
+	r := bytes.NewReader(bytes.Repeat([]byte("a"), 10))
+	if _, err := io.CopyBuffer(bs, bs.reader(r), make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"aaaaaaaaaa"}; !reflect.DeepEqual(frames, want) {
+		t.Errorf("unexpected frames: %q", frames)
+	}
+}
+
+func Test_batchSender_error(t *testing.T) {
+	t.Parallel()
+
+	bs := newBatchSender(func(rw *ReadWrite) error {
+		return errors.New("error")
+	}, Batching{MaxSize: 2, Delay: time.Hour})
+
+	if _, err := bs.Write([]byte("abc")); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := bs.Write([]byte("d")); err == nil {
+		t.Fatal("expected sticky error")
+	}
+	if err := bs.Flush(); err == nil {
+		t.Fatal("expected sticky error")
+	}
+}
+
+func Test_batchSender_Close(t *testing.T) {
+	t.Parallel()
+
+	sent := make(chan []byte, 1)
+	bs := newBatchSender(func(rw *ReadWrite) error {
+		sent <- rw.Buf
+		return nil
+	}, Batching{Delay: 10 * time.Millisecond})
+
+	if _, err := bs.Write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	bs.Close()
+	select {
+	case b := <-sent:
+		t.Errorf("unexpected send after close: %q", b)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := bs.Write([]byte("d")); err != errBatchClosed {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// chattyReader returns size bytes per read, like a protocol that writes many
+// small messages.
+type chattyReader struct {
+	size   int
+	remain int
+}
+
+func (r *chattyReader) Read(b []byte) (int, error) {
+	if r.remain == 0 {
+		return 0, io.EOF
+	}
+	n := r.size
+	if n > r.remain {
+		n = r.remain
+	}
+	r.remain -= n
+	// Report full reads so batching isn't defeated by the drain heuristic.
+	for i := range b[:n] {
+		b[i] = 'a'
+	}
+	return n, nil
+}
+
+func benchmarkSender(b *testing.B, batching *Batching, size int) {
+	const total = 1 << 20
+
+	var frames int
+	send := func(rw *ReadWrite) error {
+		frames++
+		return nil
+	}
+
+	b.SetBytes(total)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := &chattyReader{size: size, remain: total}
+		if batching == nil {
+			io.CopyBuffer(newSender(send), r, make([]byte, size))
+			continue
+		}
+		bs := newBatchSender(send, *batching)
+		io.CopyBuffer(bs, bs.reader(r), make([]byte, size))
+		bs.Flush()
+	}
+	b.ReportMetric(float64(frames)/float64(b.N), "frames/op")
+}
+
+// BenchmarkSender shows how many frames are needed to move 1 MiB written in
+// 64 byte chunks with and without batching.
+func BenchmarkSender(b *testing.B) {
+	b.Run("unbatched", func(b *testing.B) {
+		benchmarkSender(b, nil, 64)
+	})
+	b.Run("batched-4k", func(b *testing.B) {
+		benchmarkSender(b, &Batching{MaxSize: 4 << 10, Delay: time.Millisecond}, 64)
+	})
+	b.Run("batched-32k", func(b *testing.B) {
+		benchmarkSender(b, &Batching{MaxSize: 32 << 10, Delay: time.Millisecond}, 64)
+	})
+}
+
+// BenchmarkSenderLatency measures the time from a single write that is not
+// followed by more data until the frame is sent, which is bounded by Delay.
+func BenchmarkSenderLatency(b *testing.B) {
+	for name, batching := range map[string]*Batching{
+		"unbatched":   nil,
+		"delay-100us": {Delay: 100 * time.Microsecond},
+		"delay-1ms":   {Delay: time.Millisecond},
+	} {
+		b.Run(name, func(b *testing.B) {
+			sent := make(chan struct{}, 1)
+			send := func(rw *ReadWrite) error {
+				sent <- struct{}{}
+				return nil
+			}
+			var w io.Writer = newSender(send)
+			if batching != nil {
+				w = newBatchSender(send, *batching)
+			}
+
+			msg := []byte("ping")
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w.Write(msg)
+				<-sent
+			}
+		})
+	}
+}
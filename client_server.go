@@ -3,17 +3,81 @@ package grproxy
 import (
 	"context"
 	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
 )
 
+type ClientServerOption func(*ProxyClientServer)
+
+// WithClientAdmission caps the number of concurrent tunnels. Rejected
+// connections are reset. The client identity is the remote host.
+func WithClientAdmission(a *AdmissionController) ClientServerOption {
+	return func(srv *ProxyClientServer) {
+		srv.admission = a
+	}
+}
+
+// WithServiceClient opens every tunnel with cli, such as a ServerPool, instead
+// of dialing a new connection through the ProxyClientService.
+func WithServiceClient(cli ProxyServiceClient) ClientServerOption {
+	return func(srv *ProxyClientServer) {
+		srv.client = cli
+	}
+}
+
+// WithDialOptions adds opts to the connections Serve dials through the
+// ProxyClientService, such as DefaultDialOptions for servers that accept their
+// keepalive pings.
+func WithDialOptions(opts ...grpc.DialOption) ClientServerOption {
+	return func(srv *ProxyClientServer) {
+		srv.dialOpts = opts
+	}
+}
+
+// WithClientDebugListener serves h, such as the handler of the debug package,
+// on lis while the server is serving.
+func WithClientDebugListener(lis net.Listener, h http.Handler) ClientServerOption {
+	return func(srv *ProxyClientServer) {
+		srv.debugLis, srv.debugHandler = lis, h
+	}
+}
+
+// WithClientProxyProtocol reads a PROXY protocol v1 or v2 header on the
+// connections accepted from the trusted networks, such as those of a load
+// balancer, and takes their addresses from it. Admission, tunnel infos and the
+// Hello then see the real client. Trusted connections without a valid header
+// are reset; others are served as they are.
+func WithClientProxyProtocol(trusted ...*net.IPNet) ClientServerOption {
+	return func(srv *ProxyClientServer) {
+		srv.trustedProxies = trusted
+	}
+}
+
 type ProxyClientServer struct {
-	service ProxyClientService
+	service        ProxyClientService
+	admission      *AdmissionController
+	client         ProxyServiceClient
+	trustedProxies []*net.IPNet
+	dialOpts       []grpc.DialOption
+
+	debugLis     net.Listener
+	debugHandler http.Handler
 }
 
-func NewProxyClientServer(service ProxyClientService) *ProxyClientServer {
-	return &ProxyClientServer{service: service}
+func NewProxyClientServer(service ProxyClientService, opts ...ClientServerOption) *ProxyClientServer {
+	srv := &ProxyClientServer{service: service}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	return srv
 }
 
 func (srv *ProxyClientServer) Serve(lis net.Listener) error {
+	if srv.debugLis != nil {
+		defer serveDebug(srv.debugLis, srv.debugHandler)()
+	}
+
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
@@ -21,18 +85,57 @@ func (srv *ProxyClientServer) Serve(lis net.Listener) error {
 		}
 
 		go func() {
+			ctx := context.Background()
+			if trustedProxy(conn.RemoteAddr(), srv.trustedProxies) {
+				pc, err := readProxyHeader(conn)
+				if err != nil {
+					reset(conn)
+					return
+				}
+				conn = pc
+			}
+			if srv.admission != nil {
+				release, err := srv.admission.Acquire(ctx, remoteHost(conn))
+				if err != nil {
+					reset(conn)
+					return
+				}
+				defer release()
+			}
 			defer conn.Close()
 
-			ctx := context.Background()
-			grpcconn, err := srv.service.Dial(ctx)
-			if err != nil {
-				return
+			proxycli := srv.client
+			if proxycli == nil {
+				grpcconn, err := srv.service.Dial(ctx, srv.dialOpts...)
+				if err != nil {
+					return
+				}
+				defer grpcconn.Close()
+				proxycli = NewProxyServiceClient(grpcconn)
 			}
-			defer grpcconn.Close()
 
-			if err := srv.service.Bind(ctx, NewProxyServiceClient(grpcconn), conn); err != nil {
+			if err := srv.service.Bind(ctx, proxycli, conn); err != nil {
 				return
 			}
 		}()
 	}
 }
+
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// reset closes conn with a TCP RST instead of a FIN where possible.
+func reset(conn net.Conn) {
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	if tcpconn, ok := conn.(*net.TCPConn); ok {
+		tcpconn.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -2,11 +2,16 @@ package grproxy
 
 import (
 	"context"
+	"io"
 	"net"
 	"sync"
+	"time"
 
+	"github.com/golang/protobuf/proto"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type ProxyClientService interface {
@@ -14,37 +19,290 @@ type ProxyClientService interface {
 	Bind(ctx context.Context, proxycli ProxyServiceClient, conn net.Conn) error
 }
 
+type ClientServiceOption func(*proxyClientService)
+
+// WithHello opens every tunnel with a handshake carrying hello. The server
+// must support protocol version 1 or later.
+func WithHello(hello *Hello) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.hello = hello
+	}
+}
+
+// WithClientCompression asks the server for payload compression. It requires
+// WithHello.
+func WithClientCompression(c Compression) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.compression = &c
+	}
+}
+
+// WithClientBatching coalesces small local reads into larger frames.
+func WithClientBatching(b Batching) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.batching = &b
+	}
+}
+
+// WithClientCodec encodes frames with the allocation-reducing grproxy codec.
+// The server must link a version of this package that registers it.
+func WithClientCodec() ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.callOpts = append(svc.callOpts, grpc.CallContentSubtype(CodecName))
+	}
+}
+
+// WithClientKeepalive pings the server when a tunnel is idle and closes the
+// tunnel when the server stops answering. It requires WithHello.
+func WithClientKeepalive(k Keepalive) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.keepalive = &k
+	}
+}
+
+// WithClientResumption asks the server for resumable tunnels. When the stream
+// of a tunnel fails, the local connection stays open while the tunnel is
+// reattached on a new stream. It requires WithHello, and the session must
+// reach the same server again. Batching does not apply to resumable tunnels.
+func WithClientResumption(r Resumption) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.resumption = &r
+	}
+}
+
+// WithClientFilters applies the filters to every tunnel.
+func WithClientFilters(filters ...StreamFilter) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.filters = append(svc.filters, filters...)
+	}
+}
+
+// WithClientFilterRegistry applies the filters enabled in r for the route of
+// each tunnel, the target of the Hello, after those of WithClientFilters.
+func WithClientFilterRegistry(r *FilterRegistry) ClientServiceOption {
+	return func(svc *proxyClientService) {
+		svc.registry = r
+	}
+}
+
 type proxyClientService struct {
-	dialer func(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+	dialer      func(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+	hello       *Hello
+	compression *Compression
+	batching    *Batching
+	resumption  *Resumption
+	keepalive   *Keepalive
+	callOpts    []grpc.CallOption
+	filters     []StreamFilter
+	registry    *FilterRegistry
+	tunnels     *tunnelTable
 }
 
-func NewProxyClientService(dialer func(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error)) ProxyClientService {
-	return &proxyClientService{
-		dialer: dialer,
+func NewProxyClientService(dialer func(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error), opts ...ClientServiceOption) ProxyClientService {
+	svc := &proxyClientService{
+		dialer:  dialer,
+		tunnels: newTunnelTable("client"),
+	}
+	for _, opt := range opts {
+		opt(svc)
 	}
+	return svc
 }
 
 func (svc *proxyClientService) Dial(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
 	return svc.dialer(ctx, opts...)
 }
 
+// Tunnels returns the tunnels being bound, oldest first.
+func (svc *proxyClientService) Tunnels() []TunnelStatus {
+	return svc.tunnels.list("", "")
+}
+
 func (svc *proxyClientService) Bind(ctx context.Context, proxycli ProxyServiceClient, conn net.Conn) error {
-	grpccli, err := proxycli.Connect(ctx)
+	info := TunnelInfo{Client: conn.RemoteAddr()}
+	if svc.hello != nil {
+		info.Target = svc.hello.Target
+	}
+	ctx, kill := context.WithCancel(ctx)
+	defer kill()
+	t := svc.tunnels.add("", info, false, kill)
+	defer svc.tunnels.remove(t)
+	info = t.info
+	fc, err := openFilters(ctx, info, routeFilters(svc.filters, svc.registry, info.Target))
 	if err != nil {
 		return err
 	}
 
+	err = svc.bind(ctx, proxycli, conn, t, fc)
+	fc.close(err)
+	return err
+}
+
+func (svc *proxyClientService) bind(ctx context.Context, proxycli ProxyServiceClient, conn net.Conn, t *tunnel, fc *filterChain) error {
+	if svc.hello != nil {
+		ctx = handshakeContext(ctx)
+	}
+	// Canceling tears down the stream of a tunnel that ended without the
+	// server, e.g. when it missed its heartbeat.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	grpccli, err := proxycli.Connect(ctx, svc.callOpts...)
+	if err != nil {
+		return err
+	}
+	wrap := func(dir Direction, w io.Writer) io.Writer {
+		return fc.writer(dir, t.counter(w, dir))
+	}
+	var (
+		version uint32
+		sendrw  = grpccli.Send
+		recv    = grpccli.Recv
+		hb      *heartbeat
+	)
+	if svc.hello != nil {
+		hello := proto.Clone(svc.hello).(*Hello)
+		hello.TunnelId = t.info.ID
+		hello.SourceAddr, hello.DestinationAddr = remoteAddr(conn), localAddr(conn)
+		hello.Capabilities = append(hello.Capabilities, keepaliveCapability)
+		hello.Capabilities = append(hello.Capabilities, svc.compression.capabilities()...)
+		hello.Capabilities = append(hello.Capabilities, svc.resumption.capabilities()...)
+		accept, err := handshake(grpccli, hello)
+		if err != nil {
+			grpccli.CloseSend()
+			return err
+		}
+		version = accept.Version
+		if hasCapability(accept.Capabilities, keepaliveCapability) {
+			hb, sendrw = newHeartbeat(svc.keepalive, sendrw)
+			recv = hb.recv(recv)
+		}
+		encoding := negotiatedEncoding(accept.Capabilities)
+		if encoding != Encoding_IDENTITY && svc.compression != nil {
+			comp := newCompressor(svc.compression, encoding)
+			sendrw = comp.sender(sendrw)
+			if svc.compression.Stats != nil {
+				defer func() { svc.compression.Stats(comp.Stats()) }()
+			}
+		}
+		if accept.SessionId != "" && svc.resumption != nil {
+			sess := newSession(accept.SessionId, conn, svc.resumption.bufferSize())
+			sess.encoding = encoding
+			sess.client = true
+			svc.tunnels.setResumable(t)
+			sess.w = wrap(Downstream, conn)
+			go sess.pump(fc.reader(Upstream, conn), wrap(Upstream, sess))
+			return svc.bindSession(ctx, proxycli, sess, grpccli, sendrw, recv, hb)
+		}
+	}
+
 	var once sync.Once
+	ctx, stop := hb.start(ctx)
 	eg, ctx := errgroup.WithContext(ctx)
-	close := func() { grpccli.CloseSend() }
+	close := func() { hb.locked(grpccli.CloseSend) }
 	eg.Go(func() error {
 		defer once.Do(close)
-		return proxy(ctx, conn, newReceiver(grpccli.Recv), make([]byte, 4096))
+		r := fc.reader(Downstream, receiverFor(version, newDecompressor(recv)))
+		err := proxy(ctx, conn, wrap(Downstream, conn), r, make([]byte, 4096))
+		if err == nil {
+			closeWrite(conn)
+		}
+		return err
 	})
 	eg.Go(func() error {
 		defer once.Do(close)
-		return proxy(ctx, newSender(grpccli.Send), conn, make([]byte, 4096))
+		if svc.batching == nil {
+			return proxy(ctx, conn, wrap(Upstream, newSender(sendrw)), fc.reader(Upstream, conn), make([]byte, 4096))
+		}
+
+		bs := newBatchSender(sendrw, *svc.batching)
+		defer bs.Close()
+		err := proxy(ctx, conn, wrap(Upstream, bs), fc.reader(Upstream, bs.reader(conn)), make([]byte, 4096))
+		if ctx.Err() == nil {
+			if ferr := bs.Flush(); err == nil {
+				err = ferr
+			}
+		}
+		return err
 	})
 
-	return eg.Wait()
+	return stop(eg.Wait())
+}
+
+// clientStream is implemented by the client streams of Connect and Reattach.
+type clientStream interface {
+	Send(*ReadWrite) error
+	Recv() (*ReadWrite, error)
+	CloseSend() error
+}
+
+// bindSession carries sess over stream, and over new streams when it fails.
+func (svc *proxyClientService) bindSession(ctx context.Context, proxycli ProxyServiceClient, sess *session, stream clientStream, send func(*ReadWrite) error, recv func() (*ReadWrite, error), hb *heartbeat) error {
+	defer sess.close()
+
+	var (
+		gen          int
+		peerAck      uint64
+		cancelStream = func() {}
+	)
+	defer func() { cancelStream() }()
+	for {
+		runCtx, stop := hb.start(ctx)
+		err := stop(sess.run(runCtx, gen, peerAck, send, newDecompressor(recv)))
+		if err == ErrKeepaliveTimeout {
+			err = &streamError{err: err}
+		}
+		if !isStreamError(err) || ctx.Err() != nil {
+			// The server ends the session when it sees the end of the stream.
+			hb.locked(stream.CloseSend)
+			return err
+		}
+
+		streamCtx, cancel := context.WithCancel(ctx)
+		reattached, g, ack, err := svc.reattach(streamCtx, proxycli, sess)
+		if err != nil {
+			cancel()
+			return err
+		}
+		cancelStream()
+		cancelStream = cancel
+		gen, peerAck, stream = g, ack, reattached
+		hb, send = newHeartbeat(svc.keepalive, reattached.Send)
+		recv = hb.recv(reattached.Recv)
+		if sess.encoding != Encoding_IDENTITY && svc.compression != nil {
+			send = newCompressor(svc.compression, sess.encoding).sender(send)
+		}
+	}
+}
+
+// reattach opens a new stream for sess, retrying until the resumption
+// timeout. It returns the generation of the stream and the offset of the next
+// byte the server expects.
+func (svc *proxyClientService) reattach(ctx context.Context, proxycli ProxyServiceClient, sess *session) (ProxyService_ReattachClient, int, uint64, error) {
+	deadline := time.Now().Add(svc.resumption.timeout())
+	backoff := 100 * time.Millisecond
+	for {
+		gen, ack, ok := sess.attach()
+		if !ok {
+			return nil, 0, 0, errSessionEnded
+		}
+
+		stream, err := proxycli.Reattach(ctx, svc.callOpts...)
+		if err == nil {
+			var peerAck uint64
+			if peerAck, err = resume(stream, sess.id, ack); err == nil {
+				return stream, gen, peerAck, nil
+			}
+			stream.CloseSend()
+		}
+		if status.Code(err) == codes.NotFound || time.Now().Add(backoff).After(deadline) {
+			return nil, 0, 0, err
+		}
+
+		if err := sleep(ctx, backoff); err != nil {
+			return nil, 0, 0, err
+		}
+		if backoff *= 2; backoff > 2*time.Second {
+			backoff = 2 * time.Second
+		}
+	}
 }
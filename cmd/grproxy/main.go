@@ -0,0 +1,141 @@
+// Command grproxy manages grproxy servers.
+//
+// Usage:
+//
+//	grproxy admin [-addr host:port] [-tls] list [-identity identity] [-target target]
+//	grproxy admin [-addr host:port] [-tls] kill id
+//	grproxy admin [-addr host:port] [-tls] drain [-kill] [-undrain] target
+//	grproxy admin [-addr host:port] [-tls] config
+//
+// The server must serve the admin service, see grproxy.WithAdmin.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/yanolab/grproxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var errUsage = errors.New("usage: grproxy admin [-addr host:port] [-tls] list|kill|drain|config [args]")
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "admin" {
+		fmt.Fprintln(os.Stderr, errUsage)
+		os.Exit(2)
+	}
+	if err := admin(os.Args[2:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if err == errUsage {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+func admin(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	addr := fs.String("addr", "localhost:3000", "address of the grproxy server")
+	useTLS := fs.Bool("tls", false, "connect with TLS")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout of the call")
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if fs.NArg() == 0 {
+		return errUsage
+	}
+
+	opt := grpc.WithInsecure()
+	if *useTLS {
+		opt = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, *addr, opt)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	cli := grproxy.NewAdminServiceClient(conn)
+
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "list":
+		return list(ctx, cli, args, out)
+	case "kill":
+		if len(args) != 1 {
+			return errUsage
+		}
+		_, err := cli.KillTunnel(ctx, &grproxy.KillTunnelRequest{Id: args[0]})
+		return err
+	case "drain":
+		return drain(ctx, cli, args, out)
+	case "config":
+		resp, err := cli.GetConfig(ctx, &grproxy.GetConfigRequest{})
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, []byte(resp.Json), "", "  "); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err = buf.WriteTo(out)
+		return err
+	default:
+		return errUsage
+	}
+}
+
+func list(ctx context.Context, cli grproxy.AdminServiceClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	identity := fs.String("identity", "", "list only the tunnels of the identity")
+	target := fs.String("target", "", "list only the tunnels to the target")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+
+	resp, err := cli.ListTunnels(ctx, &grproxy.ListTunnelsRequest{Identity: *identity, Target: *target})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tIDENTITY\tTARGET\tPEER\tBACKEND\tSTARTED\tUP\tDOWN\tRESUMABLE")
+	for _, t := range resp.Tunnels {
+		started := "-"
+		if start, err := ptypes.Timestamp(t.StartTime); err == nil {
+			started = start.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%v\n",
+			t.Id, t.Identity, t.Target, t.Peer, t.Backend, started, t.UpstreamBytes, t.DownstreamBytes, t.Resumable)
+	}
+	return w.Flush()
+}
+
+func drain(ctx context.Context, cli grproxy.AdminServiceClient, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("drain", flag.ContinueOnError)
+	kill := fs.Bool("kill", false, "also kill the open tunnels to the target")
+	undrain := fs.Bool("undrain", false, "accept new tunnels to the target again")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errUsage
+	}
+
+	resp, err := cli.DrainTarget(ctx, &grproxy.DrainTargetRequest{Target: fs.Arg(0), Kill: *kill, Undrain: *undrain})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%d open tunnels\n", resp.Tunnels)
+	return err
+}
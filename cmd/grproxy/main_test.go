@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yanolab/grproxy"
+	"google.golang.org/grpc"
+)
+
+// startAdminServer serves the admin service with one open tunnel to the
+// target "echo".
+func startAdminServer(t *testing.T) (string, func()) {
+	t.Helper()
+
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := grproxy.NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	grpcsrv := grpc.NewServer()
+	go grproxy.NewProxyServer(grpcsrv, svc, grproxy.WithAdmin()).Serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		defer local.Close()
+		cli := grproxy.NewProxyClientService(nil, grproxy.WithHello(&grproxy.Hello{Target: "echo"}))
+		cli.Bind(context.TODO(), grproxy.NewProxyServiceClient(conn), local)
+	}()
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	go remote.Write([]byte("ping"))
+	if _, err := io.ReadFull(remote, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	return lis.Addr().String(), func() {
+		remote.Close()
+		conn.Close()
+		grpcsrv.Stop()
+		echo.Close()
+	}
+}
+
+func Test_admin(t *testing.T) {
+	addr, stop := startAdminServer(t)
+	defer stop()
+
+	stopped, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.Close()
+
+	tests := map[string]struct {
+		args     []string
+		want     []string
+		unwanted string
+		usage    bool
+		wantErr  bool
+	}{
+		"list": {
+			args: []string{"-addr", addr, "list"},
+			want: []string{"ID", "TARGET", "echo"},
+		},
+		"list other target": {
+			args:     []string{"-addr", addr, "list", "-target", "db"},
+			want:     []string{"ID", "TARGET"},
+			unwanted: "echo",
+		},
+		"drain": {
+			args: []string{"-addr", addr, "drain", "-undrain", "echo"},
+			want: []string{"1 open tunnels"},
+		},
+		"no command": {
+			args:    []string{"-addr", addr},
+			usage:   true,
+			wantErr: true,
+		},
+		"unknown command": {
+			args:    []string{"-addr", addr, "stop"},
+			usage:   true,
+			wantErr: true,
+		},
+		"list with args": {
+			args:    []string{"-addr", addr, "list", "echo"},
+			usage:   true,
+			wantErr: true,
+		},
+		"drain without target": {
+			args:    []string{"-addr", addr, "drain"},
+			usage:   true,
+			wantErr: true,
+		},
+		"unreachable": {
+			args:    []string{"-addr", stopped.Addr().String(), "-timeout", "1s", "list"},
+			wantErr: true,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := admin(tc.args, &buf)
+			if (err != nil) != tc.wantErr || (err == errUsage) != tc.usage {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("unexpected output: %q", buf.String())
+				}
+			}
+			if tc.unwanted != "" && strings.Contains(buf.String(), tc.unwanted) {
+				t.Errorf("unexpected output: %q", buf.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package grproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/encoding"
+)
+
+// CodecName is the content-subtype of the grproxy codec. Clients opt in with
+// grpc.CallContentSubtype(CodecName); servers pick it up automatically.
+const CodecName = "grproxy"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// codec encodes data frames by hand and falls back to protobuf for everything
+// else. Decoded frames alias the received message instead of copying it,
+// which is safe because gRPC allocates a new buffer for every message.
+type codec struct{}
+
+func (codec) Name() string {
+	return CodecName
+}
+
+const (
+	tagBuf      = 1<<3 | 2 // field 1, length delimited
+	tagLen      = 2<<3 | 0 // field 2, varint
+	tagEncoding = 7<<3 | 0 // field 7, varint
+	tagSeq      = 8<<3 | 0 // field 8, varint
+	tagAck      = 9<<3 | 0 // field 9, varint
+)
+
+var errMalformedFrame = errors.New("grproxy: malformed frame")
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	rw, ok := v.(*ReadWrite)
+	if !ok || rw.Control != nil || len(rw.XXX_unrecognized) > 0 {
+		return marshalProto(v)
+	}
+
+	n := 1 + binary.MaxVarintLen64 + len(rw.Buf) + 4*(1+binary.MaxVarintLen64)
+	b := make([]byte, 0, n)
+	if len(rw.Buf) > 0 {
+		b = append(b, tagBuf)
+		b = appendUvarint(b, uint64(len(rw.Buf)))
+		b = append(b, rw.Buf...)
+	}
+	if rw.Len != 0 {
+		b = append(b, tagLen)
+		b = appendUvarint(b, uint64(int64(rw.Len)))
+	}
+	if rw.Encoding != Encoding_IDENTITY {
+		b = append(b, tagEncoding)
+		b = appendUvarint(b, uint64(rw.Encoding))
+	}
+	if rw.Seq != 0 {
+		b = append(b, tagSeq)
+		b = appendUvarint(b, rw.Seq)
+	}
+	if rw.Ack != 0 {
+		b = append(b, tagAck)
+		b = appendUvarint(b, rw.Ack)
+	}
+	return b, nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	rw, ok := v.(*ReadWrite)
+	if !ok {
+		return unmarshalProto(data, v)
+	}
+
+	rw.Reset()
+	for b := data; len(b) > 0; {
+		tag := b[0]
+		b = b[1:]
+		switch tag {
+		case tagBuf:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errMalformedFrame
+			}
+			b = b[n:]
+			rw.Buf = b[:l:l]
+			b = b[l:]
+		case tagLen, tagEncoding, tagSeq, tagAck:
+			x, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errMalformedFrame
+			}
+			b = b[n:]
+			switch tag {
+			case tagLen:
+				rw.Len = int32(x)
+			case tagEncoding:
+				rw.Encoding = Encoding(x)
+			case tagSeq:
+				rw.Seq = x
+			case tagAck:
+				rw.Ack = x
+			}
+		default:
+			// Control frames and unknown fields.
+			rw.Reset()
+			return proto.Unmarshal(data, rw)
+		}
+	}
+	return nil
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func marshalProto(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("grproxy: failed to marshal, message is %T, want proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func unmarshalProto(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("grproxy: failed to unmarshal, message is %T, want proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,170 @@
+package grproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func Test_codec(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		rw *ReadWrite
+	}{
+		"data": {
+			rw: &ReadWrite{Buf: []byte("abcde"), Len: 5},
+		},
+		"empty": {
+			rw: &ReadWrite{},
+		},
+		"large": {
+			rw: &ReadWrite{Buf: bytes.Repeat([]byte("a"), 100000), Len: 100000},
+		},
+		"negative len": {
+			rw: &ReadWrite{Buf: []byte("a"), Len: -1},
+		},
+		"encoding": {
+			rw: &ReadWrite{Buf: []byte("abcde"), Encoding: Encoding_ZSTD},
+		},
+		"resumable": {
+			rw: &ReadWrite{Buf: []byte("abcde"), Len: 5, Seq: 1 << 40, Ack: 300},
+		},
+		"control": {
+			rw: &ReadWrite{Control: &ReadWrite_Hello{Hello: &Hello{Version: 2, Target: "db"}}},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			b, err := codec{}.Marshal(tc.rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The codec and protobuf understand each other's encoding.
+			var got ReadWrite
+			if err := proto.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(&got, tc.rw) {
+				t.Errorf("unexpected proto result: %v", &got)
+			}
+
+			b, err = proto.Marshal(tc.rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = ReadWrite{Buf: []byte("stale")}
+			if err := (codec{}).Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !proto.Equal(&got, tc.rw) {
+				t.Errorf("unexpected codec result: %v", &got)
+			}
+		})
+	}
+}
+
+func Test_codec_alias(t *testing.T) {
+	t.Parallel()
+
+	data, err := codec{}.Marshal(&ReadWrite{Buf: []byte("abcde"), Len: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rw ReadWrite
+	if err := (codec{}).Unmarshal(data, &rw); err != nil {
+		t.Fatal(err)
+	}
+	if &rw.Buf[0] != &data[2] {
+		t.Error("payload was copied")
+	}
+	if cap(rw.Buf) != len(rw.Buf) {
+		t.Errorf("payload may be appended into the message: %d", cap(rw.Buf))
+	}
+}
+
+func Test_codec_malformed(t *testing.T) {
+	t.Parallel()
+
+	for tn, data := range map[string][]byte{
+		"short buf":   {tagBuf, 10, 'a'},
+		"bad varint":  {tagLen, 0x80},
+		"missing len": {tagBuf},
+	} {
+		t.Run(tn, func(t *testing.T) {
+			var rw ReadWrite
+			if err := (codec{}).Unmarshal(data, &rw); err == nil {
+				t.Errorf("expected error: %v", &rw)
+			}
+		})
+	}
+}
+
+func Test_clientCodec(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	conn, errc := bindPipe(NewProxyClientService(nil, WithHello(&Hello{}), WithClientCodec()), proxycli)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	want := bytes.Repeat([]byte("abcde"), 1000)
+	go conn.Write(want)
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("unexpected result")
+	}
+	conn.Close()
+	<-errc
+}
+
+func BenchmarkCodec(b *testing.B) {
+	rw := &ReadWrite{Buf: bytes.Repeat([]byte("a"), 4096), Len: 4096}
+	data, err := proto.Marshal(rw)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("marshal/proto", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			proto.Marshal(rw)
+		}
+	})
+	b.Run("marshal/grproxy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			codec{}.Marshal(rw)
+		}
+	})
+	b.Run("unmarshal/proto", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			proto.Unmarshal(data, new(ReadWrite))
+		}
+	})
+	b.Run("unmarshal/grproxy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			codec{}.Unmarshal(data, new(ReadWrite))
+		}
+	})
+}
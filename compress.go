@@ -0,0 +1,278 @@
+package grproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecodedFrame bounds the size of a decompressed frame.
+const maxDecodedFrame = 16 << 20
+
+// Compression configures payload compression of the tunnel data frames. It is
+// negotiated per tunnel in the handshake and is independent of the gRPC
+// message compressor.
+type Compression struct {
+	// Encodings lists the supported encodings in order of preference.
+	Encodings []Encoding
+	// MinSize is the smallest frame worth compressing. Defaults to 256 bytes.
+	MinSize int
+	// MaxRatio is the compressed to raw size ratio above which compression is
+	// paused, for example for TLS traffic. Defaults to 0.9.
+	MaxRatio float64
+	// Stats is called with the statistics of each tunnel direction this side
+	// sent once the tunnel ends.
+	Stats func(CompressionStats)
+}
+
+// CompressionStats are the statistics of one tunnel direction.
+type CompressionStats struct {
+	Encoding Encoding
+	// RawBytes is the payload size before compression.
+	RawBytes int64
+	// WireBytes is the payload size that was sent.
+	WireBytes int64
+	// Frames is the number of data frames and CompressedFrames the number of
+	// them that were sent compressed.
+	Frames           int64
+	CompressedFrames int64
+}
+
+// Ratio returns WireBytes / RawBytes.
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.WireBytes) / float64(s.RawBytes)
+}
+
+const compressCapabilityPrefix = "compress/"
+
+func compressCapability(e Encoding) string {
+	return compressCapabilityPrefix + strings.ToLower(e.String())
+}
+
+func (c *Compression) capabilities() []string {
+	if c == nil {
+		return nil
+	}
+	caps := make([]string, 0, len(c.Encodings))
+	for _, e := range c.Encodings {
+		caps = append(caps, compressCapability(e))
+	}
+	return caps
+}
+
+// negotiatedEncoding returns the encoding among the negotiated capabilities.
+func negotiatedEncoding(caps []string) Encoding {
+	for _, c := range caps {
+		if !strings.HasPrefix(c, compressCapabilityPrefix) {
+			continue
+		}
+		name := strings.ToUpper(strings.TrimPrefix(c, compressCapabilityPrefix))
+		if e, ok := Encoding_value[name]; ok {
+			return Encoding(e)
+		}
+	}
+	return Encoding_IDENTITY
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedFrame))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func encode(e Encoding, b []byte) ([]byte, error) {
+	switch e {
+	case Encoding_GZIP:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Encoding_SNAPPY:
+		return snappy.Encode(nil, b), nil
+	case Encoding_ZSTD:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("grproxy: unsupported encoding %v", e)
+}
+
+func decode(e Encoding, b []byte) ([]byte, error) {
+	switch e {
+	case Encoding_IDENTITY:
+		return b, nil
+	case Encoding_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedFrame+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(decoded) > maxDecodedFrame {
+			return nil, fmt.Errorf("grproxy: decoded frame exceeds %d bytes", maxDecodedFrame)
+		}
+		return decoded, nil
+	case Encoding_SNAPPY:
+		n, err := snappy.DecodedLen(b)
+		if err != nil {
+			return nil, err
+		}
+		if n > maxDecodedFrame {
+			return nil, fmt.Errorf("grproxy: decoded frame exceeds %d bytes", maxDecodedFrame)
+		}
+		return snappy.Decode(nil, b)
+	case Encoding_ZSTD:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return dec.DecodeAll(b, nil)
+	}
+	return nil, fmt.Errorf("grproxy: unsupported encoding %v", e)
+}
+
+// newDecompressor decodes the data frames returned by recv.
+func newDecompressor(recv func() (*ReadWrite, error)) func() (*ReadWrite, error) {
+	return func() (*ReadWrite, error) {
+		rw, err := recv()
+		if err != nil || rw.Encoding == Encoding_IDENTITY {
+			return rw, err
+		}
+
+		b, err := decode(rw.Encoding, rw.Buf)
+		if err != nil {
+			return nil, err
+		}
+		return &ReadWrite{Buf: b, Len: int32(len(b)), Seq: rw.Seq, Ack: rw.Ack}, nil
+	}
+}
+
+// Compressed frames are sampled for sampleFrames frames. When the average
+// ratio is too poor, compression is paused for pauseFrames frames.
+const (
+	sampleFrames = 16
+	pauseFrames  = 256
+)
+
+type compressor struct {
+	encoding Encoding
+	minSize  int
+	maxRatio float64
+
+	paused  int
+	samples int
+	raw     int64
+	wire    int64
+
+	stats CompressionStats
+}
+
+func newCompressor(c *Compression, e Encoding) *compressor {
+	comp := &compressor{
+		encoding: e,
+		minSize:  256,
+		maxRatio: 0.9,
+		stats:    CompressionStats{Encoding: e},
+	}
+	if c.MinSize > 0 {
+		comp.minSize = c.MinSize
+	}
+	if c.MaxRatio > 0 {
+		comp.maxRatio = c.MaxRatio
+	}
+	return comp
+}
+
+// sender compresses the data frames passed to send. It must not be used
+// concurrently.
+func (c *compressor) sender(send func(*ReadWrite) error) func(*ReadWrite) error {
+	return func(rw *ReadWrite) error {
+		if rw.Control != nil {
+			return send(rw)
+		}
+
+		n := int64(len(rw.Buf))
+		atomic.AddInt64(&c.stats.Frames, 1)
+		atomic.AddInt64(&c.stats.RawBytes, n)
+		if b, ok := c.compress(rw.Buf); ok {
+			atomic.AddInt64(&c.stats.CompressedFrames, 1)
+			atomic.AddInt64(&c.stats.WireBytes, int64(len(b)))
+			return send(&ReadWrite{Buf: b, Len: int32(len(b)), Encoding: c.encoding, Seq: rw.Seq, Ack: rw.Ack})
+		}
+		atomic.AddInt64(&c.stats.WireBytes, n)
+		return send(rw)
+	}
+}
+
+func (c *compressor) compress(b []byte) ([]byte, bool) {
+	if len(b) < c.minSize {
+		return nil, false
+	}
+	if c.paused > 0 {
+		c.paused--
+		return nil, false
+	}
+
+	encoded, err := encode(c.encoding, b)
+	if err != nil {
+		return nil, false
+	}
+
+	c.samples++
+	c.raw += int64(len(b))
+	c.wire += int64(len(encoded))
+	if c.samples >= sampleFrames {
+		if float64(c.wire)/float64(c.raw) > c.maxRatio {
+			c.paused = pauseFrames
+		}
+		c.samples, c.raw, c.wire = 0, 0, 0
+	}
+
+	if float64(len(encoded)) > float64(len(b))*c.maxRatio {
+		return nil, false
+	}
+	return encoded, true
+}
+
+// Stats returns the statistics collected so far.
+func (c *compressor) Stats() CompressionStats {
+	return CompressionStats{
+		Encoding:         c.stats.Encoding,
+		RawBytes:         atomic.LoadInt64(&c.stats.RawBytes),
+		WireBytes:        atomic.LoadInt64(&c.stats.WireBytes),
+		Frames:           atomic.LoadInt64(&c.stats.Frames),
+		CompressedFrames: atomic.LoadInt64(&c.stats.CompressedFrames),
+	}
+}
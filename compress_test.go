@@ -0,0 +1,207 @@
+package grproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_encode(t *testing.T) {
+	t.Parallel()
+
+	b := bytes.Repeat([]byte("SELECT * FROM users;"), 100)
+	for _, e := range []Encoding{Encoding_GZIP, Encoding_SNAPPY, Encoding_ZSTD} {
+		t.Run(e.String(), func(t *testing.T) {
+			encoded, err := encode(e, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(encoded) >= len(b) {
+				t.Errorf("not compressed: %d", len(encoded))
+			}
+			got, err := decode(e, encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, b) {
+				t.Errorf("unexpected result: %s", got)
+			}
+			if _, err := decode(e, []byte("garbage")); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func Test_negotiateCapabilities(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		requested []string
+		supported []string
+		want      []string
+		encoding  Encoding
+	}{
+		"client preference": {
+			requested: []string{"compress/zstd", "compress/gzip"},
+			supported: []string{"compress/gzip", "compress/zstd"},
+			want:      []string{"compress/zstd"},
+			encoding:  Encoding_ZSTD,
+		},
+		"common": {
+			requested: []string{"compress/zstd", "compress/snappy"},
+			supported: []string{"compress/snappy"},
+			want:      []string{"compress/snappy"},
+			encoding:  Encoding_SNAPPY,
+		},
+		"none": {
+			requested: []string{"compress/zstd"},
+			encoding:  Encoding_IDENTITY,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			got := negotiateCapabilities(tc.requested, tc.supported)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected capabilities: %v", got)
+			}
+			if e := negotiatedEncoding(got); e != tc.encoding {
+				t.Errorf("unexpected encoding: %v", e)
+			}
+		})
+	}
+}
+
+func Test_compressor(t *testing.T) {
+	t.Parallel()
+
+	random := make([]byte, 1024)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		frames         [][]byte
+		wantCompressed int64
+	}{
+		"compressible": {
+			frames:         [][]byte{bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 1024)},
+			wantCompressed: 2,
+		},
+		"small": {
+			frames: [][]byte{[]byte("abc")},
+		},
+		"incompressible": {
+			frames: [][]byte{random, random},
+		},
+		"paused": {
+			// After sampling incompressible frames, compressible ones are sent
+			// raw as well until the pause ends.
+			frames: func() [][]byte {
+				var frames [][]byte
+				for i := 0; i < sampleFrames; i++ {
+					frames = append(frames, random)
+				}
+				return append(frames, bytes.Repeat([]byte("a"), 1024))
+			}(),
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			c := newCompressor(&Compression{}, Encoding_SNAPPY)
+			recv := make(chan *ReadWrite, len(tc.frames))
+			send := c.sender(func(rw *ReadWrite) error {
+				recv <- rw
+				return nil
+			})
+			for _, b := range tc.frames {
+				if err := send(&ReadWrite{Buf: b, Len: int32(len(b))}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(recv)
+
+			r := newDecompressor(func() (*ReadWrite, error) {
+				rw, ok := <-recv
+				if !ok {
+					return nil, io.EOF
+				}
+				return rw, nil
+			})
+			for i, b := range tc.frames {
+				rw, err := r()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(rw.Buf, b) {
+					t.Errorf("unexpected frame %d", i)
+				}
+			}
+
+			stats := c.Stats()
+			if stats.Frames != int64(len(tc.frames)) || stats.CompressedFrames != tc.wantCompressed {
+				t.Errorf("unexpected stats: %+v", stats)
+			}
+		})
+	}
+}
+
+func Test_compression(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	serverStats := make(chan CompressionStats, 1)
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}, WithCompression(Compression{
+		Encodings: []Encoding{Encoding_GZIP, Encoding_ZSTD},
+		Stats:     func(s CompressionStats) { serverStats <- s },
+	}))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	clientStats := make(chan CompressionStats, 1)
+	client := NewProxyClientService(nil, WithHello(&Hello{}), WithClientCompression(Compression{
+		Encodings: []Encoding{Encoding_ZSTD, Encoding_SNAPPY},
+		Stats:     func(s CompressionStats) { clientStats <- s },
+	}))
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- client.Bind(context.TODO(), proxycli, local)
+	}()
+
+	want := bytes.Repeat([]byte("SELECT * FROM users;"), 100)
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remote.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(remote, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected result: %s", got)
+	}
+	remote.(*net.TCPConn).CloseWrite()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stats := range []CompressionStats{<-clientStats, <-serverStats} {
+		if stats.Encoding != Encoding_ZSTD || stats.RawBytes != int64(len(want)) || stats.Ratio() >= 0.5 {
+			t.Errorf("unexpected stats: %+v", stats)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package debug serves the debug listener of a grproxy client or server for
+// on-call engineers. Nothing is registered on http.DefaultServeMux.
+package debug
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/yanolab/grproxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// ReadinessCheck fails while a proxy cannot open tunnels.
+type ReadinessCheck func(ctx context.Context) error
+
+// ConnReadiness is ready while conn is connected. A connection that is still
+// connecting is waited for until ctx is done.
+func ConnReadiness(conn *grpc.ClientConn) ReadinessCheck {
+	return func(ctx context.Context) error {
+		for {
+			state := conn.GetState()
+			switch state {
+			case connectivity.Ready:
+				return nil
+			case connectivity.TransientFailure, connectivity.Shutdown:
+				return fmt.Errorf("grproxy: connection is %s", state)
+			}
+			if !conn.WaitForStateChange(ctx, state) {
+				return fmt.Errorf("grproxy: connection is %s", state)
+			}
+		}
+	}
+}
+
+type Option func(*handler)
+
+// WithTunnels lists the tunnels of l on /tunnels. The ProxyClientService of
+// grproxy.NewProxyClientService is a grproxy.TunnelLister too.
+func WithTunnels(l grproxy.TunnelLister) Option {
+	return func(h *handler) {
+		h.tunnels = l
+	}
+}
+
+// WithReadiness makes /readyz fail while check fails.
+func WithReadiness(check ReadinessCheck) Option {
+	return func(h *handler) {
+		h.ready = check
+	}
+}
+
+type handler struct {
+	tunnels grproxy.TunnelLister
+	ready   ReadinessCheck
+}
+
+// NewHandler returns the handler of a debug listener. It serves:
+//
+//	/debug/pprof/  the runtime profiles of net/http/pprof
+//	/debug/vars    expvar, with grproxy.TunnelCounters under "grproxy"
+//	/healthz       200 while the process is running
+//	/readyz        200 while the readiness check passes, 503 otherwise
+//	/tunnels       the open tunnels as JSON, or as an HTML table for browsers
+func NewHandler(opts ...Option) http.Handler {
+	h := &handler{}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", serveVars)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", h.serveReady)
+	mux.HandleFunc("/tunnels", h.serveTunnels)
+	return mux
+}
+
+// serveVars serves the published expvars like expvar.Handler, and the tunnel
+// counters in a map that is not published.
+func serveVars(w http.ResponseWriter, r *http.Request) {
+	counters := new(expvar.Map).Init()
+	for key, n := range grproxy.TunnelCounters() {
+		counters.Add(key, n)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	fmt.Fprintf(w, "{\n")
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "grproxy" {
+			return
+		}
+		fmt.Fprintf(w, "%q: %s,\n", kv.Key, kv.Value)
+	})
+	fmt.Fprintf(w, "%q: %s\n}\n", "grproxy", counters)
+}
+
+func (h *handler) serveReady(w http.ResponseWriter, r *http.Request) {
+	if h.ready != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		if err := h.ready(ctx); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+var tunnelsTemplate = template.Must(template.New("tunnels").Parse(`<!DOCTYPE html>
+<html>
+<head><title>grproxy tunnels</title></head>
+<body>
+<p>{{len .}} open tunnels</p>
+<table border="1">
+<tr><th>ID</th><th>Identity</th><th>Target</th><th>Peer</th><th>Backend</th><th>Started</th><th>Upstream bytes</th><th>Downstream bytes</th><th>Resumable</th></tr>
+{{range .}}<tr><td>{{.ID}}</td><td>{{.Identity}}</td><td>{{.Target}}</td><td>{{.Peer}}</td><td>{{.Backend}}</td><td>{{.Start.Format "2006-01-02 15:04:05"}}</td><td>{{.UpstreamBytes}}</td><td>{{.DownstreamBytes}}</td><td>{{.Resumable}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (h *handler) serveTunnels(w http.ResponseWriter, r *http.Request) {
+	tunnels := []grproxy.TunnelStatus{}
+	if h.tunnels != nil {
+		tunnels = h.tunnels.Tunnels()
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/html") || r.URL.Query().Get("format") == "html" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		tunnelsTemplate.Execute(w, tunnels)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tunnels)
+}
@@ -0,0 +1,147 @@
+package debug
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yanolab/grproxy"
+	"google.golang.org/grpc"
+)
+
+// stoppedAddr returns an address nobody listens on.
+func stoppedAddr(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
+
+type tunnelList []grproxy.TunnelStatus
+
+func (l tunnelList) Tunnels() []grproxy.TunnelStatus {
+	return l
+}
+
+func Test_NewHandler(t *testing.T) {
+	t.Parallel()
+
+	tunnels := tunnelList{{ID: "abc", Target: "db", Start: time.Now(), UpstreamBytes: 3}}
+	tests := map[string]struct {
+		opts       []Option
+		path       string
+		accept     string
+		wantStatus int
+		want       string
+	}{
+		"healthz": {
+			path:       "/healthz",
+			wantStatus: http.StatusOK,
+			want:       "ok",
+		},
+		"ready": {
+			opts:       []Option{WithReadiness(func(context.Context) error { return nil })},
+			path:       "/readyz",
+			wantStatus: http.StatusOK,
+			want:       "ok",
+		},
+		"not ready": {
+			opts:       []Option{WithReadiness(func(context.Context) error { return errors.New("no servers") })},
+			path:       "/readyz",
+			wantStatus: http.StatusServiceUnavailable,
+			want:       "no servers",
+		},
+		"vars": {
+			path:       "/debug/vars",
+			wantStatus: http.StatusOK,
+			want:       `"grproxy"`,
+		},
+		"vars counters": {
+			path:       "/debug/vars",
+			wantStatus: http.StatusOK,
+			want:       `"memstats"`,
+		},
+		"pprof": {
+			path:       "/debug/pprof/",
+			wantStatus: http.StatusOK,
+			want:       "goroutine",
+		},
+		"tunnels": {
+			opts:       []Option{WithTunnels(tunnels)},
+			path:       "/tunnels",
+			wantStatus: http.StatusOK,
+			want:       `"id":"abc"`,
+		},
+		"no tunnels": {
+			path:       "/tunnels",
+			wantStatus: http.StatusOK,
+			want:       "[]",
+		},
+		"tunnels html": {
+			opts:       []Option{WithTunnels(tunnels)},
+			path:       "/tunnels",
+			accept:     "text/html",
+			wantStatus: http.StatusOK,
+			want:       "<td>abc</td><td></td><td>db</td>",
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tc.path, nil)
+			r.Header.Set("Accept", tc.accept)
+			w := httptest.NewRecorder()
+			NewHandler(tc.opts...).ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus || !strings.Contains(w.Body.String(), tc.want) {
+				t.Errorf("unexpected response: %d %s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func Test_ConnReadiness(t *testing.T) {
+	t.Parallel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcsrv := grpc.NewServer()
+	go grpcsrv.Serve(lis)
+	defer grpcsrv.Stop()
+
+	tests := map[string]struct {
+		addr    string
+		wantErr bool
+	}{
+		"ready": {addr: lis.Addr().String()},
+		"down":  {addr: stoppedAddr(t), wantErr: true},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			conn, err := grpc.Dial(tc.addr, grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+			defer cancel()
+			if err := ConnReadiness(conn)(ctx); (err != nil) != tc.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -41,11 +41,11 @@ func main() {
 	log.Print("listen", lis.Addr())
 
 	dialer := func(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
-		return grpc.Dial(
-			":3000",
+		opts = append(opts,
 			grpc.WithInsecure(),
 			grpc.WithStreamInterceptor(logInterceptor),
 		)
+		return grpc.Dial(":3000", opts...)
 	}
 
 	srv := grproxy.NewProxyClientServer(
@@ -4,8 +4,10 @@ import (
 	"context"
 	"log"
 	"net"
+	"os"
 
 	"github.com/yanolab/grproxy"
+	"github.com/yanolab/grproxy/mysql"
 	"google.golang.org/grpc"
 )
 
@@ -29,8 +31,8 @@ func main() {
 	}
 
 	srv := grproxy.NewProxyServer(
-		grpc.NewServer(grpc.StreamInterceptor(logInterceptor)),
-		grproxy.NewProxyServerService(dialer),
+		grpc.NewServer(append(grproxy.DefaultServerOptions(), grpc.StreamInterceptor(logInterceptor))...),
+		grproxy.NewProxyServerService(dialer, grproxy.WithInspector(mysql.New(mysql.WithLogger(log.New(os.Stderr, "", log.LstdFlags))))),
 	)
 	log.Println(srv.Serve(lis))
 }
@@ -0,0 +1,267 @@
+package grproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Direction is the direction of the bytes of a tunnel.
+type Direction int
+
+const (
+	// Upstream is from the client to the backend.
+	Upstream Direction = iota
+	// Downstream is from the backend to the client.
+	Downstream
+)
+
+func (d Direction) String() string {
+	if d == Downstream {
+		return "downstream"
+	}
+	return "upstream"
+}
+
+// StreamFilter processes the bytes of tunnels between the conn and the gRPC
+// stream, on the client in Bind and on the server in Connect. Each side
+// applies its filters in order: for every direction, the first filter sees the
+// bytes before the next one.
+//
+// The bytes a resumable tunnel receives from the stream have no reader; only
+// writers see them.
+type StreamFilter interface {
+	// OnOpen is called when a tunnel starts, before any bytes flow. The
+	// returned context is passed to the other methods for the tunnel, so it
+	// can hold the state of the filter for the tunnel. An error ends the
+	// tunnel.
+	OnOpen(ctx context.Context, info TunnelInfo) (context.Context, error)
+	// WrapReader wraps the source of the bytes of the direction dir.
+	WrapReader(ctx context.Context, dir Direction, r io.Reader) io.Reader
+	// WrapWriter wraps the destination of the bytes of the direction dir.
+	WrapWriter(ctx context.Context, dir Direction, w io.Writer) io.Writer
+	// OnClose is called when the tunnel ended, with the error it ended with.
+	// The error of resumable tunnels is always nil.
+	OnClose(ctx context.Context, err error)
+}
+
+// NopFilter implements StreamFilter without doing anything. Filters embed it
+// to implement only some of the methods.
+type NopFilter struct{}
+
+func (NopFilter) OnOpen(ctx context.Context, info TunnelInfo) (context.Context, error) {
+	return ctx, nil
+}
+
+func (NopFilter) WrapReader(ctx context.Context, dir Direction, r io.Reader) io.Reader {
+	return r
+}
+
+func (NopFilter) WrapWriter(ctx context.Context, dir Direction, w io.Writer) io.Writer {
+	return w
+}
+
+func (NopFilter) OnClose(ctx context.Context, err error) {}
+
+// FilterFactory creates a filter from its settings, e.g. from a config file.
+type FilterFactory func(settings map[string]string) (StreamFilter, error)
+
+// AllRoutes enables a filter for every tunnel.
+const AllRoutes = "*"
+
+// FilterRegistry knows filters by name and which are enabled per route. The
+// route of a tunnel is its target as sent in the Hello.
+type FilterRegistry struct {
+	mu        sync.RWMutex
+	factories map[string]FilterFactory
+	routes    map[string][]namedFilter
+}
+
+type namedFilter struct {
+	name   string
+	filter StreamFilter
+}
+
+func NewFilterRegistry() *FilterRegistry {
+	return &FilterRegistry{
+		factories: make(map[string]FilterFactory),
+		routes:    make(map[string][]namedFilter),
+	}
+}
+
+// DefaultFilterRegistry is the registry of RegisterFilter. Packages providing
+// filters register them in it when imported.
+var DefaultFilterRegistry = NewFilterRegistry()
+
+// RegisterFilter registers a filter factory in DefaultFilterRegistry.
+func RegisterFilter(name string, f FilterFactory) {
+	DefaultFilterRegistry.Register(name, f)
+}
+
+// Register makes a filter available by name. It panics when f is nil or the
+// name is taken.
+func (r *FilterRegistry) Register(name string, f FilterFactory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f == nil {
+		panic("grproxy: nil filter factory for " + name)
+	}
+	if _, ok := r.factories[name]; ok {
+		panic("grproxy: filter registered twice: " + name)
+	}
+	r.factories[name] = f
+}
+
+// Names returns the registered filter names, sorted.
+func (r *FilterRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enable creates the named filter with settings and appends it to the filters
+// of route. Tunnels that are already open are not affected.
+func (r *FilterRegistry) Enable(route, name string, settings map[string]string) error {
+	r.mu.RLock()
+	factory, ok := r.factories[name]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("grproxy: unknown filter %q", name)
+	}
+
+	f, err := factory(settings)
+	if err != nil {
+		return fmt.Errorf("grproxy: filter %q: %v", name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes[route] = append(r.routes[route], namedFilter{name: name, filter: f})
+	return nil
+}
+
+// Disable removes the named filter from route. It reports whether the filter
+// was enabled.
+func (r *FilterRegistry) Disable(route, name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	filters := r.routes[route]
+	for i, f := range filters {
+		if f.name == name {
+			r.routes[route] = append(filters[:i:i], filters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Filters returns the filters of a tunnel to target: those of AllRoutes, then
+// those of the target.
+func (r *FilterRegistry) Filters(target string) []StreamFilter {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var filters []StreamFilter
+	for _, route := range []string{AllRoutes, target} {
+		for _, f := range r.routes[route] {
+			filters = append(filters, f.filter)
+		}
+		if target == AllRoutes {
+			break
+		}
+	}
+	return filters
+}
+
+// routeNames returns the names of the enabled filters per route.
+func (r *FilterRegistry) routeNames() map[string][]string {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	routes := make(map[string][]string)
+	for route, filters := range r.routes {
+		for _, f := range filters {
+			routes[route] = append(routes[route], f.name)
+		}
+	}
+	return routes
+}
+
+// routeFilters returns filters followed by the filters of r for target.
+func routeFilters(filters []StreamFilter, r *FilterRegistry, target string) []StreamFilter {
+	if route := r.Filters(target); len(route) > 0 {
+		filters = append(filters[:len(filters):len(filters)], route...)
+	}
+	return filters
+}
+
+// filterChain is the filters of one tunnel.
+type filterChain struct {
+	filters []StreamFilter
+	ctxs    []context.Context
+}
+
+// openFilters calls OnOpen of the filters. It returns nil without filters.
+// When a filter fails, the filters opened before are closed.
+func openFilters(ctx context.Context, info TunnelInfo, filters []StreamFilter) (*filterChain, error) {
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	c := &filterChain{}
+	for _, f := range filters {
+		fctx, err := f.OnOpen(ctx, info)
+		if err != nil {
+			c.close(err)
+			return nil, err
+		}
+		c.filters = append(c.filters, f)
+		c.ctxs = append(c.ctxs, fctx)
+	}
+	return c, nil
+}
+
+func (c *filterChain) reader(dir Direction, r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	for i, f := range c.filters {
+		r = f.WrapReader(c.ctxs[i], dir, r)
+	}
+	return r
+}
+
+func (c *filterChain) writer(dir Direction, w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	for i := len(c.filters) - 1; i >= 0; i-- {
+		w = c.filters[i].WrapWriter(c.ctxs[i], dir, w)
+	}
+	return w
+}
+
+func (c *filterChain) close(err error) {
+	if c == nil {
+		return
+	}
+	for i := len(c.filters) - 1; i >= 0; i-- {
+		c.filters[i].OnClose(c.ctxs[i], err)
+	}
+}
@@ -0,0 +1,316 @@
+package grproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceFilter logs its calls to trace, prefixed with its name.
+type traceFilter struct {
+	name    string
+	openErr error
+
+	mu    sync.Mutex
+	trace *[]string
+}
+
+func (f *traceFilter) log(s string) {
+	f.mu.Lock()
+	*f.trace = append(*f.trace, f.name+":"+s)
+	f.mu.Unlock()
+}
+
+func (f *traceFilter) OnOpen(ctx context.Context, info TunnelInfo) (context.Context, error) {
+	f.log("open")
+	return ctx, f.openErr
+}
+
+func (f *traceFilter) WrapReader(ctx context.Context, dir Direction, r io.Reader) io.Reader {
+	return reader(func(b []byte) (int, error) {
+		n, err := r.Read(b)
+		f.log("read " + dir.String())
+		return n, err
+	})
+}
+
+func (f *traceFilter) WrapWriter(ctx context.Context, dir Direction, w io.Writer) io.Writer {
+	return writer(func(b []byte) (int, error) {
+		f.log("write " + dir.String())
+		return w.Write(b)
+	})
+}
+
+func (f *traceFilter) OnClose(ctx context.Context, err error) {
+	f.log("close")
+}
+
+func Test_filterChain(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		openErr error
+		want    []string
+	}{
+		"success": {
+			want: []string{
+				"a:open", "b:open",
+				"a:read upstream", "b:read upstream",
+				"a:write upstream", "b:write upstream",
+				"b:close", "a:close",
+			},
+		},
+		"open error": {
+			openErr: errors.New("error"),
+			want:    []string{"a:open", "b:open", "a:close"},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			var trace []string
+			filters := []StreamFilter{
+				&traceFilter{name: "a", trace: &trace},
+				&traceFilter{name: "b", trace: &trace, openErr: tc.openErr},
+			}
+			fc, err := openFilters(context.TODO(), TunnelInfo{}, filters)
+			if err != tc.openErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil {
+				var buf bytes.Buffer
+				r := fc.reader(Upstream, strings.NewReader("ping"))
+				if _, err := io.CopyN(fc.writer(Upstream, &buf), r, 4); err != nil || buf.String() != "ping" {
+					t.Fatalf("unexpected result: %s %v", buf.String(), err)
+				}
+				fc.close(nil)
+			}
+			if !reflect.DeepEqual(trace, tc.want) {
+				t.Errorf("unexpected trace: %v", trace)
+			}
+		})
+	}
+}
+
+func Test_FilterRegistry(t *testing.T) {
+	t.Parallel()
+
+	r := NewFilterRegistry()
+	for _, name := range []string{"b", "a"} {
+		name := name
+		r.Register(name, func(settings map[string]string) (StreamFilter, error) {
+			if settings["fail"] != "" {
+				return nil, errors.New(settings["fail"])
+			}
+			return &traceFilter{name: name + settings["suffix"]}, nil
+		})
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"a", "b"}) {
+		t.Errorf("unexpected names: %v", names)
+	}
+
+	if err := r.Enable("db", "c", nil); err == nil {
+		t.Error("unexpected success of an unknown filter")
+	}
+	if err := r.Enable("db", "a", map[string]string{"fail": "bad"}); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, e := range []struct{ route, name, suffix string }{
+		{"db", "a", "1"},
+		{AllRoutes, "b", "2"},
+		{"db", "b", "3"},
+		{"web", "a", "4"},
+	} {
+		if err := r.Enable(e.route, e.name, map[string]string{"suffix": e.suffix}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !r.Disable("web", "a") || r.Disable("web", "a") {
+		t.Error("unexpected result of Disable")
+	}
+
+	tests := map[string]struct {
+		target string
+		want   []string
+	}{
+		"route":     {target: "db", want: []string{"b2", "a1", "b3"}},
+		"disabled":  {target: "web", want: []string{"b2"}},
+		"no route":  {target: "other", want: []string{"b2"}},
+		"all":       {target: AllRoutes, want: []string{"b2"}},
+		"no target": {target: "", want: []string{"b2"}},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			var got []string
+			for _, f := range r.Filters(tc.target) {
+				got = append(got, f.(*traceFilter).name)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected filters: %v", got)
+			}
+		})
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("unexpected success of a duplicate filter")
+			}
+		}()
+		r.Register("a", func(map[string]string) (StreamFilter, error) { return nil, nil })
+	}()
+}
+
+// upperFilter uppercases the bytes written upstream and counts the bytes of
+// each direction.
+type upperFilter struct {
+	NopFilter
+
+	mu     sync.Mutex
+	infos  []TunnelInfo
+	counts [2]int
+	closed int
+}
+
+func (f *upperFilter) OnOpen(ctx context.Context, info TunnelInfo) (context.Context, error) {
+	f.mu.Lock()
+	f.infos = append(f.infos, info)
+	f.mu.Unlock()
+	return ctx, nil
+}
+
+func (f *upperFilter) WrapWriter(ctx context.Context, dir Direction, w io.Writer) io.Writer {
+	return writer(func(b []byte) (int, error) {
+		f.mu.Lock()
+		f.counts[dir] += len(b)
+		f.mu.Unlock()
+		if dir == Upstream {
+			return w.Write(bytes.ToUpper(b))
+		}
+		return w.Write(b)
+	})
+}
+
+func (f *upperFilter) OnClose(ctx context.Context, err error) {
+	f.mu.Lock()
+	f.closed++
+	f.mu.Unlock()
+}
+
+func (f *upperFilter) closes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+func Test_ProxyService_filters(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		opts       []ServerServiceOption
+		clientOpts []ClientServiceOption
+	}{
+		"tunnel": {},
+		"session": {
+			opts:       []ServerServiceOption{WithResumption(Resumption{})},
+			clientOpts: []ClientServiceOption{WithClientResumption(Resumption{})},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			echo := startEchoServer(t)
+			defer echo.Close()
+
+			var trace []string
+			tf := &traceFilter{name: "server", trace: &trace}
+			registry := NewFilterRegistry()
+			registry.Register("trace", func(map[string]string) (StreamFilter, error) {
+				return tf, nil
+			})
+			if err := registry.Enable("echo", "trace", nil); err != nil {
+				t.Fatal(err)
+			}
+			server := &upperFilter{}
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				return net.Dial("tcp", echo.Addr().String())
+			}, append(tc.opts, WithIdentity(func(context.Context) string { return "alice" }), WithFilters(server), WithFilterRegistry(registry))...)
+			proxycli, stop := startGRPCServer(t, svc)
+			defer stop()
+
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			client := &upperFilter{}
+			errc := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				opts := append(tc.clientOpts, WithHello(&Hello{Target: "echo"}), WithClientFilters(client))
+				errc <- NewProxyClientService(nil, opts...).Bind(context.TODO(), proxycli, local)
+			}()
+
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			remote.Write([]byte("ping"))
+			remote.(*net.TCPConn).CloseWrite()
+			if got, err := ioutil.ReadAll(remote); err != nil || string(got) != "PING" {
+				t.Fatalf("unexpected result: %s %v", got, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+			// The server may close a session after Bind returned.
+			for deadline := time.Now().Add(5 * time.Second); server.closes() == 0 && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			for _, f := range []*upperFilter{client, server} {
+				f.mu.Lock()
+				if len(f.infos) != 1 || f.infos[0].Target != "echo" || f.infos[0].Client == nil || f.counts != [2]int{4, 4} || f.closed != 1 {
+					t.Errorf("unexpected filter state: %+v %v %d", f.infos, f.counts, f.closed)
+				}
+				f.mu.Unlock()
+			}
+			if info := server.infos[0]; info.Identity != "alice" || info.Backend == nil {
+				t.Errorf("unexpected tunnel info: %+v", info)
+			}
+			tf.mu.Lock()
+			defer tf.mu.Unlock()
+			if len(trace) == 0 || trace[0] != "server:open" || trace[len(trace)-1] != "server:close" {
+				t.Errorf("unexpected trace: %v", trace)
+			}
+		})
+	}
+}
+
+func Test_ProxyService_filterOpenError(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	var trace []string
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}, WithFilters(&traceFilter{name: "server", trace: &trace, openErr: errors.New("denied")}))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	defer local.Close()
+	err := NewProxyClientService(nil, WithHello(&Hello{Target: "echo"})).Bind(context.TODO(), proxycli, local)
+	if err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(trace, []string{"server:open"}) {
+		t.Errorf("unexpected trace: %v", trace)
+	}
+}
@@ -4,6 +4,9 @@ go 1.12
 
 require (
 	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.1
+	github.com/gorilla/websocket v1.4.1
+	github.com/klauspost/compress v1.9.8
 	golang.org/x/lint v0.0.0-20190313153728-d0100b6bd8b3 // indirect
 	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
 	golang.org/x/tools v0.0.0-20190524140312-2c0ae7006135 // indirect
@@ -0,0 +1,131 @@
+package grproxy
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ProtocolVersion is the newest protocol version spoken by this package.
+// Version 0 is the original protocol without a handshake, version 1 adds the
+// handshake and version 2 takes frame lengths from the payload and adds close
+// frames.
+const ProtocolVersion = 2
+
+// handshakeKey is the request metadata key announcing that the first frame of
+// the stream is a Hello. Without it the server dials immediately, because
+// legacy clients may wait for the backend to speak first.
+const handshakeKey = "grproxy-handshake"
+
+type helloKey struct{}
+
+func withHello(ctx context.Context, hello *Hello) context.Context {
+	return context.WithValue(ctx, helloKey{}, hello)
+}
+
+// HelloFromContext returns the Hello a client sent on Connect. Dialers passed
+// to NewProxyServerService can use it to pick the backend.
+func HelloFromContext(ctx context.Context) (*Hello, bool) {
+	hello, ok := ctx.Value(helloKey{}).(*Hello)
+	return hello, ok
+}
+
+// TargetFromContext returns the target requested in the Hello, if any.
+func TargetFromContext(ctx context.Context) (string, bool) {
+	hello, ok := HelloFromContext(ctx)
+	if !ok || hello.Target == "" {
+		return "", false
+	}
+	return hello.Target, true
+}
+
+// recvHello reads the Hello of a client that announced the handshake. It
+// returns nil for legacy clients.
+func recvHello(srv ProxyService_ConnectServer) (*Hello, error) {
+	md, _ := metadata.FromIncomingContext(srv.Context())
+	if len(md.Get(handshakeKey)) == 0 {
+		return nil, nil
+	}
+
+	rw, err := srv.Recv()
+	if err != nil {
+		return nil, err
+	}
+	hello := rw.GetHello()
+	if hello == nil {
+		return nil, status.Error(codes.InvalidArgument, "grproxy: expected hello")
+	}
+	return hello, nil
+}
+
+func sendAccept(srv ProxyService_ConnectServer, accept *Accept) error {
+	return srv.Send(&ReadWrite{Control: &ReadWrite_Accept{Accept: accept}})
+}
+
+func sendReject(srv ProxyService_ConnectServer, err error) error {
+	st, _ := status.FromError(err)
+	return srv.Send(&ReadWrite{Control: &ReadWrite_Reject{Reject: &Reject{
+		Code:    uint32(st.Code()),
+		Message: st.Message(),
+	}}})
+}
+
+func handshakeContext(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, handshakeKey, strconv.Itoa(ProtocolVersion))
+}
+
+// handshake sends hello and waits for the answer of the server.
+func handshake(cli ProxyService_ConnectClient, hello *Hello) (*Accept, error) {
+	h := proto.Clone(hello).(*Hello)
+	h.Version = ProtocolVersion
+	if err := cli.Send(&ReadWrite{Control: &ReadWrite_Hello{Hello: h}}); err != nil {
+		return nil, err
+	}
+
+	rw, err := cli.Recv()
+	if err != nil {
+		return nil, err
+	}
+	switch control := rw.Control.(type) {
+	case *ReadWrite_Accept:
+		return control.Accept, nil
+	case *ReadWrite_Reject:
+		return nil, status.Error(codes.Code(control.Reject.Code), control.Reject.Message)
+	default:
+		return nil, status.Error(codes.Internal, "grproxy: expected accept or reject")
+	}
+}
+
+func negotiateVersion(version uint32) uint32 {
+	if version == 0 || version > ProtocolVersion {
+		return ProtocolVersion
+	}
+	return version
+}
+
+// negotiateCapabilities returns the capabilities both sides support, in the
+// order the client listed them. Only the first compression is kept.
+func negotiateCapabilities(requested, supported []string) []string {
+	var (
+		caps     []string
+		compress bool
+	)
+	for _, c := range requested {
+		if strings.HasPrefix(c, compressCapabilityPrefix) && compress {
+			continue
+		}
+		for _, s := range supported {
+			if c == s {
+				caps = append(caps, c)
+				compress = compress || strings.HasPrefix(c, compressCapabilityPrefix)
+				break
+			}
+		}
+	}
+	return caps
+}
@@ -0,0 +1,268 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis
+}
+
+// startProxyServer serves svc on a new listener and returns its address.
+func startProxyServer(t *testing.T, svc ProxyServiceServer, opts ...grpc.ServerOption) (string, func()) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcsrv := grpc.NewServer(opts...)
+	RegisterProxyServiceServer(grpcsrv, svc)
+	go grpcsrv.Serve(lis)
+	return lis.Addr().String(), grpcsrv.Stop
+}
+
+// userIdentity identifies clients by their x-user metadata.
+func userIdentity(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return strings.Join(md.Get("x-user"), ",")
+}
+
+// denyAnonymous rejects the streams without x-user metadata.
+func denyAnonymous(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if userIdentity(ss.Context()) == "" {
+		return status.Error(codes.PermissionDenied, "no user")
+	}
+	return handler(srv, ss)
+}
+
+func startGRPCServer(t *testing.T, svc ProxyServiceServer) (ProxyServiceClient, func()) {
+	t.Helper()
+
+	addr, stop := startProxyServer(t, svc)
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewProxyServiceClient(conn), func() {
+		conn.Close()
+		stop()
+	}
+}
+
+// bindPipe binds one end of a pipe through svc and returns the other end.
+func bindPipe(svc ProxyClientService, proxycli ProxyServiceClient) (net.Conn, <-chan error) {
+	local, remote := net.Pipe()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- svc.Bind(context.TODO(), proxycli, local)
+	}()
+	return remote, errc
+}
+
+func Test_handshake(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	tests := map[string]struct {
+		opts     []ServerServiceOption
+		hello    *Hello
+		dialErr  error
+		wantCode codes.Code
+	}{
+		"hello": {
+			hello: &Hello{Target: "echo", Client: &ClientInfo{Name: "test"}},
+		},
+		"legacy": {},
+		"dial error": {
+			hello:    &Hello{Target: "unknown"},
+			dialErr:  errors.New("no such target"),
+			wantCode: codes.Unavailable,
+		},
+		"admission": {
+			opts: []ServerServiceOption{
+				WithAdmission(NewAdmissionController(ConcurrencyLimits{Identity: 1})),
+				WithIdentity(func(context.Context) string { return "alice" }),
+			},
+			hello:    &Hello{Target: "echo"},
+			wantCode: codes.ResourceExhausted,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			var gotTarget string
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				gotTarget, _ = TargetFromContext(ctx)
+				if tc.dialErr != nil {
+					return nil, tc.dialErr
+				}
+				return net.Dial("tcp", echo.Addr().String())
+			}, tc.opts...)
+			proxycli, stop := startGRPCServer(t, svc)
+			defer stop()
+
+			var opts []ClientServiceOption
+			if tc.hello != nil {
+				opts = append(opts, WithHello(tc.hello))
+			}
+			client := NewProxyClientService(nil, opts...)
+
+			if tc.wantCode == codes.ResourceExhausted {
+				conn, _ := bindPipe(client, proxycli)
+				defer conn.Close()
+				if _, err := conn.Write([]byte("a")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			conn, errc := bindPipe(client, proxycli)
+			defer conn.Close()
+			if tc.wantCode != codes.OK {
+				err := <-errc
+				if status.Code(err) != tc.wantCode {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tc.dialErr != nil && status.Convert(err).Message() != tc.dialErr.Error() {
+					t.Errorf("unexpected message: %v", err)
+				}
+				return
+			}
+
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write([]byte("abcde")); err != nil {
+				t.Fatal(err)
+			}
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != "abcde" {
+				t.Errorf("unexpected result: %s", b)
+			}
+			if tc.hello != nil && gotTarget != tc.hello.Target {
+				t.Errorf("unexpected target: %s", gotTarget)
+			}
+		})
+	}
+}
+
+func Test_handshake_accept(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(handshakeContext(context.TODO()))
+	defer cancel()
+	stream, err := proxycli.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept, err := handshake(stream, &Hello{Version: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept.Version != ProtocolVersion {
+		t.Errorf("unexpected version: %d", accept.Version)
+	}
+	if accept.RemoteAddr != echo.Addr().String() {
+		t.Errorf("unexpected remote addr: %s", accept.RemoteAddr)
+	}
+}
+
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	remote, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return local, remote
+}
+
+func Test_closeFrame(t *testing.T) {
+	t.Parallel()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		backend, server := net.Pipe()
+		go func() {
+			backend.Write([]byte("bye"))
+			backend.Close()
+		}()
+		return server, nil
+	})
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- NewProxyClientService(nil, WithHello(&Hello{})).Bind(context.TODO(), proxycli, local)
+	}()
+
+	// The client sees the backend's EOF while its own direction is still open.
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Errorf("unexpected result: %s", got)
+	}
+
+	remote.(*net.TCPConn).CloseWrite()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,166 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Probe checks whether target is healthy.
+type Probe func(ctx context.Context, target string) error
+
+// TCPProbe considers a target healthy when a TCP connection can be opened.
+func TCPProbe(ctx context.Context, target string) error {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+type HealthCheckerOption func(*HealthChecker)
+
+// WithProbe replaces TCPProbe.
+func WithProbe(probe Probe) HealthCheckerOption {
+	return func(h *HealthChecker) {
+		h.probe = probe
+	}
+}
+
+// WithHealthInterval sets how often targets are probed and how long a single
+// probe may take.
+func WithHealthInterval(interval, timeout time.Duration) HealthCheckerOption {
+	return func(h *HealthChecker) {
+		h.interval = interval
+		h.timeout = timeout
+	}
+}
+
+// HealthChecker periodically probes targets and publishes the results through
+// the grpc.health.v1 service. Each target is reported as a service name and
+// the empty service name is SERVING while any target is healthy.
+type HealthChecker struct {
+	targets  []string
+	probe    Probe
+	interval time.Duration
+	timeout  time.Duration
+	server   *health.Server
+
+	mu      sync.RWMutex
+	healthy map[string]bool
+}
+
+func NewHealthChecker(targets []string, opts ...HealthCheckerOption) *HealthChecker {
+	h := &HealthChecker{
+		targets:  targets,
+		probe:    TCPProbe,
+		interval: 10 * time.Second,
+		timeout:  time.Second,
+		server:   health.NewServer(),
+		healthy:  make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	for _, target := range targets {
+		h.server.SetServingStatus(target, healthpb.HealthCheckResponse_UNKNOWN)
+	}
+	h.server.SetServingStatus("", healthpb.HealthCheckResponse_UNKNOWN)
+	return h
+}
+
+// HealthServer returns the grpc.health.v1 implementation backed by the checker.
+func (h *HealthChecker) HealthServer() healthpb.HealthServer {
+	return h.server
+}
+
+// Healthy reports whether the last probe of target succeeded.
+func (h *HealthChecker) Healthy(target string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.healthy[target]
+}
+
+// Ready fails until the last probe of some target succeeded.
+func (h *HealthChecker) Ready(ctx context.Context) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, healthy := range h.healthy {
+		if healthy {
+			return nil
+		}
+	}
+	return errors.New("grproxy: no healthy targets")
+}
+
+// Run probes all targets every interval until ctx is done, and then reports
+// them as NOT_SERVING until it runs again.
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		h.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			h.stop()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HealthChecker) check(ctx context.Context) {
+	var wg sync.WaitGroup
+	results := make([]bool, len(h.targets))
+	for i, target := range h.targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			results[i] = h.probe(ctx, target) == nil
+		}(i, target)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	any := false
+	for i, target := range h.targets {
+		h.healthy[target] = results[i]
+		h.server.SetServingStatus(target, servingStatus(results[i]))
+		any = any || results[i]
+	}
+	h.server.SetServingStatus("", servingStatus(any))
+}
+
+// stop reports the targets as NOT_SERVING. Unlike Shutdown of the health
+// server, it lets a later check publish their status again.
+func (h *HealthChecker) stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, target := range h.targets {
+		h.server.SetServingStatus(target, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	h.server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+func servingStatus(healthy bool) healthpb.HealthCheckResponse_ServingStatus {
+	if healthy {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
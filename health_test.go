@@ -0,0 +1,129 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func Test_HealthChecker(t *testing.T) {
+	t.Parallel()
+
+	lis := startListener(t, "127.0.0.1:0")
+	defer lis.Close()
+	up, down := lis.Addr().String(), stoppedAddr(t)
+
+	tests := map[string]struct {
+		targets []string
+		opts    []HealthCheckerOption
+		want    map[string]healthpb.HealthCheckResponse_ServingStatus
+	}{
+		"tcp": {
+			targets: []string{up, down},
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":   healthpb.HealthCheckResponse_SERVING,
+				up:   healthpb.HealthCheckResponse_SERVING,
+				down: healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+		},
+		"all down": {
+			targets: []string{down},
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":   healthpb.HealthCheckResponse_NOT_SERVING,
+				down: healthpb.HealthCheckResponse_NOT_SERVING,
+			},
+		},
+		"custom probe": {
+			targets: []string{"a", "b"},
+			opts: []HealthCheckerOption{
+				WithProbe(func(ctx context.Context, target string) error {
+					if target == "a" {
+						return errors.New("error")
+					}
+					return nil
+				}),
+			},
+			want: map[string]healthpb.HealthCheckResponse_ServingStatus{
+				"":  healthpb.HealthCheckResponse_SERVING,
+				"a": healthpb.HealthCheckResponse_NOT_SERVING,
+				"b": healthpb.HealthCheckResponse_SERVING,
+			},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			h := NewHealthChecker(tc.targets, tc.opts...)
+			h.check(context.TODO())
+			if err := h.Ready(context.TODO()); (err == nil) != (tc.want[""] == healthpb.HealthCheckResponse_SERVING) {
+				t.Errorf("unexpected readiness: %v", err)
+			}
+
+			for service, want := range tc.want {
+				res, err := h.HealthServer().Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res.Status != want {
+					t.Errorf("unexpected status of %q got:%v want:%v", service, res.Status, want)
+				}
+				if service != "" && h.Healthy(service) != (want == healthpb.HealthCheckResponse_SERVING) {
+					t.Errorf("unexpected health of %q", service)
+				}
+			}
+		})
+	}
+}
+
+func Test_HealthChecker_Run(t *testing.T) {
+	t.Parallel()
+
+	probes := make(chan string, 10)
+	h := NewHealthChecker(
+		[]string{"a"},
+		WithProbe(func(ctx context.Context, target string) error {
+			probes <- target
+			return nil
+		}),
+		WithHealthInterval(10*time.Millisecond, time.Second),
+	)
+
+	// A checker runs again after its context is done.
+	for run := 0; run < 2; run++ {
+		ctx, cancel := context.WithCancel(context.TODO())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			h.Run(ctx)
+		}()
+		// The second probe starts once the first results are published.
+		for i := 0; i < 2; i++ {
+			<-probes
+		}
+		if got := healthStatus(t, h, "a"); got != healthpb.HealthCheckResponse_SERVING {
+			t.Errorf("unexpected status of run %d: %v", run, got)
+		}
+		cancel()
+		<-done
+
+		if got := healthStatus(t, h, "a"); got != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("unexpected status after run %d: %v", run, got)
+		}
+		for len(probes) > 0 {
+			<-probes
+		}
+	}
+}
+
+func healthStatus(t *testing.T, h *HealthChecker, service string) healthpb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+
+	res, err := h.HealthServer().Check(context.TODO(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Status
+}
@@ -0,0 +1,317 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Multi-hop chains reach networks behind several grproxy servers, e.g.
+// laptop → bastion → inner → database. The client lists the servers after the
+// first in the hops of its Hello:
+//
+//	grproxy.WithHello(&grproxy.Hello{Target: "db", Hops: []string{"inner:3000"}})
+//
+// The bastion dials with a HopDialer, which forwards the tunnel to the first
+// hop with the remaining ones and appends the identity of its client to via.
+// The last server sees no hops and dials the target as usual. Rejections and
+// close reasons of later hops reach the client unchanged.
+
+type HopDialerOption func(*HopDialer)
+
+// WithHopBackend dials the backend of tunnels whose chain ends at this
+// server. Without it such tunnels are rejected.
+func WithHopBackend(dialer func(ctx context.Context) (net.Conn, error)) HopDialerOption {
+	return func(d *HopDialer) {
+		d.backend = dialer
+	}
+}
+
+// WithHopCallOptions sets the call options of the streams to the next hops.
+func WithHopCallOptions(opts ...grpc.CallOption) HopDialerOption {
+	return func(d *HopDialer) {
+		d.callOpts = opts
+	}
+}
+
+// HopDialer forwards tunnels to the next grproxy server of the chain in their
+// Hello. Its DialContext can be passed to NewProxyServerService. Forwarded
+// tunnels are not resumable past this server, and the compression and
+// keepalive capabilities apply to each hop separately.
+type HopDialer struct {
+	dial     func(ctx context.Context, addr string) (*grpc.ClientConn, error)
+	backend  func(ctx context.Context) (net.Conn, error)
+	callOpts []grpc.CallOption
+
+	mu     sync.Mutex
+	conns  map[string]*grpc.ClientConn
+	closed bool
+}
+
+// NewHopDialer returns a dialer connecting to hops with dial, which is called
+// when a hop address is first used. dial decides which hops are reachable: it
+// should fail, e.g. with codes.PermissionDenied, for addresses that are not
+// allowed, since clients choose the hops.
+func NewHopDialer(dial func(ctx context.Context, addr string) (*grpc.ClientConn, error), opts ...HopDialerOption) *HopDialer {
+	d := &HopDialer{
+		dial:  dial,
+		conns: make(map[string]*grpc.ClientConn),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// DialContext opens the tunnel on the first hop of the Hello in ctx, or dials
+// the backend when there is none. The handshake with the hop completes before
+// it returns, so a rejection by any later server is returned as is.
+func (d *HopDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	hello, ok := HelloFromContext(ctx)
+	if !ok || len(hello.Hops) == 0 {
+		if d.backend == nil {
+			return nil, status.Error(codes.InvalidArgument, "grproxy: no hop to forward to")
+		}
+		return d.backend(ctx)
+	}
+
+	addr := hello.Hops[0]
+	conn, err := d.conn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	next := proto.Clone(hello).(*Hello)
+	next.Capabilities = nil
+	next.Hops = hello.Hops[1:]
+	identity, _ := IdentityFromContext(ctx)
+	next.Via = append(next.Via, identity)
+
+	ctx, cancel := context.WithCancel(handshakeContext(ctx))
+	stream, err := NewProxyServiceClient(conn).Connect(ctx, d.callOpts...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	accept, err := handshake(stream, next)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newHopConn(stream, cancel, accept, addr), nil
+}
+
+// conn returns the connection to the hop at addr, dialing it outside the lock
+// the first time.
+func (d *HopDialer) conn(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	d.mu.Lock()
+	conn, ok := d.conns[addr]
+	d.mu.Unlock()
+	if ok {
+		return conn, nil
+	}
+
+	conn, err := d.dial(ctx, addr)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case d.closed:
+		conn.Close()
+		return nil, status.Error(codes.Unavailable, "grproxy: hop dialer closed")
+	case d.conns[addr] != nil:
+		// Another tunnel dialed it first.
+		conn.Close()
+		return d.conns[addr], nil
+	}
+	d.conns[addr] = conn
+	return conn, nil
+}
+
+// Close closes the connections to the hops.
+func (d *HopDialer) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	var err error
+	for addr, conn := range d.conns {
+		if cerr := conn.Close(); err == nil {
+			err = cerr
+		}
+		delete(d.conns, addr)
+	}
+	return err
+}
+
+// HopIdentity returns an IdentityFunc for servers behind other hops. While f
+// identifies the client as a hop that trusted accepts, the identity that hop
+// put in via is taken instead, so tunnels are attributed to the originating
+// client rather than to the server forwarding them.
+func HopIdentity(f IdentityFunc, trusted func(identity string) bool) IdentityFunc {
+	return func(ctx context.Context) string {
+		identity := f(ctx)
+		hello, ok := HelloFromContext(ctx)
+		if !ok {
+			return identity
+		}
+		for i := len(hello.Via) - 1; i >= 0 && trusted(identity); i-- {
+			identity = hello.Via[i]
+		}
+		return identity
+	}
+}
+
+// hopAddr is the address of a hop or of the backend it dialed.
+type hopAddr string
+
+func (a hopAddr) Network() string { return "grproxy" }
+func (a hopAddr) String() string  { return string(a) }
+
+var errHopDeadline = errors.New("grproxy: hop deadline exceeded")
+
+// hopConn is a tunnel through the next hop as a net.Conn. Since a gRPC stream
+// cannot time out a single call, an expired read or write deadline ends the
+// stream in both directions, and the conn cannot be used afterwards.
+type hopConn struct {
+	stream ProxyService_ConnectClient
+	cancel context.CancelFunc
+	r      io.Reader
+	w      io.Writer
+	closeW func() error
+
+	local, remote net.Addr
+
+	mu         sync.Mutex
+	readTimer  *time.Timer
+	writeTimer *time.Timer
+	expired    bool
+	once       sync.Once
+}
+
+func newHopConn(stream ProxyService_ConnectClient, cancel context.CancelFunc, accept *Accept, addr string) *hopConn {
+	c := &hopConn{
+		stream: stream,
+		cancel: cancel,
+		r:      receiverFor(accept.Version, stream.Recv),
+		w:      newSender(stream.Send),
+		local:  hopAddr(addr),
+		remote: hopAddr(accept.RemoteAddr),
+	}
+	c.closeW = stream.CloseSend
+	if accept.Version >= 2 {
+		c.closeW = func() error {
+			if err := sendClose(stream.Send, nil); err != nil {
+				return err
+			}
+			return stream.CloseSend()
+		}
+	}
+	return c
+}
+
+func (c *hopConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	return n, c.err(err)
+}
+
+func (c *hopConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	return n, c.err(err)
+}
+
+func (c *hopConn) err(err error) error {
+	if err == nil || err == io.EOF {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.expired {
+		return errHopDeadline
+	}
+	return err
+}
+
+// CloseWrite tells the next hop that no more data follows.
+func (c *hopConn) CloseWrite() error {
+	return c.closeW()
+}
+
+func (c *hopConn) Close() error {
+	c.once.Do(func() {
+		c.SetDeadline(time.Time{})
+		c.cancel()
+	})
+	return nil
+}
+
+func (c *hopConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// RemoteAddr returns the address of the backend, as reported by the last hop.
+func (c *hopConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *hopConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.readTimer, t)
+	c.setDeadline(&c.writeTimer, t)
+	return nil
+}
+
+// SetReadDeadline ends the stream when t expires, see hopConn.
+func (c *hopConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.readTimer, t)
+	return nil
+}
+
+// SetWriteDeadline ends the stream when t expires, see hopConn.
+func (c *hopConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setDeadline(&c.writeTimer, t)
+	return nil
+}
+
+// setDeadline replaces the timer at timer with one expiring at t. It must be
+// called with mu held.
+func (c *hopConn) setDeadline(timer **time.Timer, t time.Time) {
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if t.IsZero() {
+		return
+	}
+	d := time.Until(t)
+	if d <= 0 {
+		c.expired = true
+		c.cancel()
+		return
+	}
+	*timer = time.AfterFunc(d, func() {
+		c.mu.Lock()
+		c.expired = true
+		c.mu.Unlock()
+		c.cancel()
+	})
+}
@@ -0,0 +1,233 @@
+package grproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// hopDial dials the hops in allowed, authenticating as name.
+func hopDial(name string, allowed ...string) func(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	return func(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+		for _, a := range allowed {
+			if a == addr {
+				return grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithStreamInterceptor(
+					func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+						return streamer(metadata.AppendToOutgoingContext(ctx, "x-user", name), desc, cc, method, opts...)
+					}))
+			}
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "hop %s not allowed", addr)
+	}
+}
+
+func Test_HopDialer(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	trusted := func(identity string) bool { return identity == "bastion" || identity == "middle" }
+	var (
+		mu  sync.Mutex
+		via []string
+	)
+	inner := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		hello, _ := HelloFromContext(ctx)
+		mu.Lock()
+		via = hello.Via
+		mu.Unlock()
+		if hello.Target != "echo" {
+			return nil, status.Errorf(codes.NotFound, "unknown target %s", hello.Target)
+		}
+		return net.Dial("tcp", echo.Addr().String())
+	}, WithIdentity(HopIdentity(userIdentity, trusted)))
+	innerAddr, stopInner := startProxyServer(t, inner)
+	defer stopInner()
+
+	plainAddr, stopPlain := startProxyServer(t, NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}))
+	defer stopPlain()
+
+	middleDialer := NewHopDialer(hopDial("middle", innerAddr, plainAddr))
+	defer middleDialer.Close()
+	middle := NewProxyServerService(middleDialer.DialContext, WithIdentity(HopIdentity(userIdentity, trusted)))
+	middleAddr, stopMiddle := startProxyServer(t, middle)
+	defer stopMiddle()
+
+	bastionDialer := NewHopDialer(hopDial("bastion", middleAddr, innerAddr), WithHopBackend(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}))
+	defer bastionDialer.Close()
+	bastion := NewProxyServerService(bastionDialer.DialContext, WithIdentity(userIdentity))
+	proxycli, stop := startGRPCServer(t, bastion)
+	defer stop()
+
+	tests := map[string]struct {
+		hello       *Hello
+		wantVia     []string
+		wantCode    codes.Code
+		wantMessage string
+	}{
+		"no hops": {
+			hello: &Hello{Target: "echo"},
+		},
+		"one hop": {
+			hello:   &Hello{Target: "echo", Hops: []string{innerAddr}},
+			wantVia: []string{"alice"},
+		},
+		"two hops": {
+			hello:   &Hello{Target: "echo", Hops: []string{middleAddr, innerAddr}},
+			wantVia: []string{"alice", "alice"},
+		},
+		"rejected by last hop": {
+			hello:       &Hello{Target: "db", Hops: []string{middleAddr, innerAddr}},
+			wantCode:    codes.NotFound,
+			wantMessage: "unknown target db",
+		},
+		"hop not allowed": {
+			hello:       &Hello{Target: "echo", Hops: []string{middleAddr, middleAddr}},
+			wantCode:    codes.PermissionDenied,
+			wantMessage: "hop " + middleAddr + " not allowed",
+		},
+		"hop not forwarding": {
+			hello:       &Hello{Target: "echo", Hops: []string{middleAddr, plainAddr, innerAddr}},
+			wantCode:    codes.Unimplemented,
+			wantMessage: "grproxy: server does not forward to hops",
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				ctx := metadata.AppendToOutgoingContext(context.TODO(), "x-user", "alice")
+				errc <- NewProxyClientService(nil, WithHello(tc.hello)).Bind(ctx, proxycli, local)
+			}()
+
+			if tc.wantCode != codes.OK {
+				err := <-errc
+				if st, _ := status.FromError(err); st.Code() != tc.wantCode || st.Message() != tc.wantMessage {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			remote.Write([]byte("ping"))
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(remote, b); err != nil || string(b) != "ping" {
+				t.Fatalf("unexpected result: %s %v", b, err)
+			}
+			if len(tc.hello.Hops) > 0 {
+				if got := inner.Tunnels(); len(got) != 1 || got[0].Identity != "alice" {
+					t.Errorf("unexpected tunnels: %+v", got)
+				}
+				mu.Lock()
+				if !reflect.DeepEqual(via, tc.wantVia) {
+					t.Errorf("unexpected via: %v", via)
+				}
+				mu.Unlock()
+			}
+			remote.(*net.TCPConn).CloseWrite()
+			if err := <-errc; err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := remote.Read(b); err != io.EOF {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_HopIdentity(t *testing.T) {
+	t.Parallel()
+
+	trusted := func(identity string) bool { return strings.HasPrefix(identity, "hop-") }
+	tests := map[string]struct {
+		identity string
+		via      []string
+		want     string
+	}{
+		"direct":         {identity: "alice", want: "alice"},
+		"untrusted":      {identity: "mallory", via: []string{"alice"}, want: "mallory"},
+		"trusted":        {identity: "hop-1", via: []string{"alice"}, want: "alice"},
+		"chain":          {identity: "hop-2", via: []string{"alice", "hop-1"}, want: "alice"},
+		"untrusted link": {identity: "hop-2", via: []string{"alice", "mallory"}, want: "mallory"},
+		"no via":         {identity: "hop-1", want: "hop-1"},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			f := HopIdentity(func(context.Context) string { return tc.identity }, trusted)
+			ctx := withHello(context.Background(), &Hello{Via: tc.via})
+			if got := f(ctx); got != tc.want {
+				t.Errorf("unexpected identity: %s", got)
+			}
+		})
+	}
+}
+
+func Test_hopConn_deadline(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		set         func(c *hopConn, t time.Time)
+		wantExpired bool
+	}{
+		"read": {
+			set: func(c *hopConn, t time.Time) {
+				c.SetReadDeadline(t)
+				c.SetWriteDeadline(time.Time{})
+			},
+			wantExpired: true,
+		},
+		"write": {
+			set: func(c *hopConn, t time.Time) {
+				c.SetDeadline(t)
+				c.SetReadDeadline(time.Time{})
+			},
+			wantExpired: true,
+		},
+		"cleared": {
+			set: func(c *hopConn, t time.Time) {
+				c.SetReadDeadline(t)
+				c.SetWriteDeadline(t)
+				c.SetDeadline(time.Time{})
+			},
+		},
+	}
+
+	for tn, tc := range tests {
+		tc := tc
+		t.Run(tn, func(t *testing.T) {
+			t.Parallel()
+
+			canceled := make(chan struct{})
+			c := &hopConn{cancel: func() { close(canceled) }}
+			tc.set(c, time.Now().Add(50*time.Millisecond))
+
+			select {
+			case <-canceled:
+			case <-time.After(200 * time.Millisecond):
+			}
+			if got := c.err(io.ErrClosedPipe) == errHopDeadline; got != tc.wantExpired {
+				t.Errorf("unexpected expired: %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package grproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc/peer"
+)
+
+// TunnelInfo describes a tunnel. On the client, Identity and Backend are
+// unset and Client is the address of the local peer.
+type TunnelInfo struct {
+	// ID identifies the tunnel while it is open. The client assigns it in
+	// Bind, and the server keeps it unless it is taken.
+	ID       string
+	Identity string
+	// Target is the target of the Hello, or else the backend address.
+	Target  string
+	Client  net.Addr
+	Backend net.Addr
+}
+
+func tunnelInfo(ctx context.Context, identity string, conn net.Conn) TunnelInfo {
+	info := TunnelInfo{Identity: identity, Backend: conn.RemoteAddr()}
+	if target, ok := TargetFromContext(ctx); ok {
+		info.Target = target
+	} else {
+		info.Target = remoteAddr(conn)
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		info.Client = p.Addr
+	}
+	return info
+}
+
+// Inspector observes, and may rewrite, the bytes of tunnels on the server.
+// Protocol decoders such as the mysql package implement it.
+type Inspector interface {
+	// Inspect wraps the writers of a new tunnel. upstream writes to the
+	// backend and downstream to the client. The wrapper of upstream may also
+	// write to downstream, for example to answer a request it dropped;
+	// downstream is safe for concurrent use.
+	Inspect(info TunnelInfo, upstream, downstream io.Writer) (io.Writer, io.Writer)
+}
+
+// InspectorFilter adapts an Inspector to a StreamFilter.
+func InspectorFilter(i Inspector) StreamFilter {
+	return inspectorFilter{inspector: i}
+}
+
+type inspectorFilter struct {
+	NopFilter
+	inspector Inspector
+}
+
+type inspectedKey struct{}
+
+// inspectedTunnel calls Inspect once the writers of both directions are
+// known, before the first write.
+type inspectedTunnel struct {
+	inspector Inspector
+	info      TunnelInfo
+	once      sync.Once
+	w         [2]io.Writer
+	wrapped   [2]io.Writer
+}
+
+func (f inspectorFilter) OnOpen(ctx context.Context, info TunnelInfo) (context.Context, error) {
+	return context.WithValue(ctx, inspectedKey{}, &inspectedTunnel{inspector: f.inspector, info: info}), nil
+}
+
+func (f inspectorFilter) WrapWriter(ctx context.Context, dir Direction, w io.Writer) io.Writer {
+	t := ctx.Value(inspectedKey{}).(*inspectedTunnel)
+	t.w[dir] = w
+	return writer(func(b []byte) (int, error) {
+		return t.writer(dir).Write(b)
+	})
+}
+
+func (t *inspectedTunnel) writer(dir Direction) io.Writer {
+	t.once.Do(func() {
+		t.wrapped[Upstream], t.wrapped[Downstream] = t.inspector.Inspect(t.info, t.w[Upstream], &syncWriter{w: t.w[Downstream]})
+	})
+	return t.wrapped[dir]
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
@@ -0,0 +1,88 @@
+package grproxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// censor drops upstream writes containing "secret" and answers them with
+// "denied".
+type censor struct {
+	infos chan TunnelInfo
+}
+
+func (c *censor) Inspect(info TunnelInfo, upstream, downstream io.Writer) (io.Writer, io.Writer) {
+	c.infos <- info
+	return writer(func(b []byte) (int, error) {
+		if bytes.Contains(b, []byte("secret")) {
+			if _, err := downstream.Write([]byte("denied")); err != nil {
+				return 0, err
+			}
+			return len(b), nil
+		}
+		return upstream.Write(b)
+	}), downstream
+}
+
+func Test_ProxyService_inspector(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		opts       []ServerServiceOption
+		clientOpts []ClientServiceOption
+	}{
+		"tunnel": {},
+		"session": {
+			opts:       []ServerServiceOption{WithResumption(Resumption{})},
+			clientOpts: []ClientServiceOption{WithClientResumption(Resumption{})},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			echo := startEchoServer(t)
+			defer echo.Close()
+
+			insp := &censor{infos: make(chan TunnelInfo, 1)}
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				return net.Dial("tcp", echo.Addr().String())
+			}, append(tc.opts, WithIdentity(func(context.Context) string { return "alice" }), WithInspector(insp))...)
+			proxycli, stop := startGRPCServer(t, svc)
+			defer stop()
+
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				opts := append(tc.clientOpts, WithHello(&Hello{Target: "echo"}))
+				errc <- NewProxyClientService(nil, opts...).Bind(context.TODO(), proxycli, local)
+			}()
+
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			remote.Write([]byte("secret"))
+			b := make([]byte, 6)
+			if _, err := io.ReadFull(remote, b); err != nil || string(b) != "denied" {
+				t.Fatalf("unexpected result: %s %v", b, err)
+			}
+			remote.Write([]byte("ping"))
+			remote.(*net.TCPConn).CloseWrite()
+			if got, err := ioutil.ReadAll(remote); err != nil || string(got) != "ping" {
+				t.Fatalf("unexpected result: %s %v", got, err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			info := <-insp.infos
+			if info.Identity != "alice" || info.Target != "echo" || info.Backend.String() != echo.Addr().String() || info.Client == nil {
+				t.Errorf("unexpected tunnel info: %+v", info)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// keepaliveCapability announces that the sender answers pings. Every peer
+// with the handshake does, so it is always offered.
+const keepaliveCapability = "keepalive"
+
+// ErrKeepaliveTimeout is returned when the peer of a tunnel did not answer a
+// ping in time.
+var ErrKeepaliveTimeout = errors.New("grproxy: peer missed heartbeat")
+
+// Keepalive configures heartbeats on tunnels. Unlike gRPC keepalive, which
+// checks the HTTP/2 connection, pings travel through the stream, so idle
+// tunnels stay alive across stateful firewalls and a dead peer is noticed
+// without writing data.
+type Keepalive struct {
+	// Interval is how long a tunnel may receive nothing before a ping is
+	// sent. It defaults to 30 seconds.
+	Interval time.Duration
+	// Timeout is how long to wait for anything from the peer after a ping.
+	// It defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// DefaultDialOptions returns the gRPC keepalive settings for connections to
+// a grproxy server. They match DefaultServerOptions: servers on the default
+// enforcement policy of gRPC close connections that ping more often than
+// every 5 minutes, so only use them with servers known to run
+// DefaultServerOptions, e.g. through WithDialOptions.
+func DefaultDialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                30 * time.Second,
+			Timeout:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}
+}
+
+// DefaultServerOptions returns the gRPC keepalive settings of a grproxy
+// server. The enforcement policy accepts the pings of DefaultDialOptions.
+func DefaultServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    60 * time.Second,
+			Timeout: 10 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             20 * time.Second,
+			PermitWithoutStream: true,
+		}),
+	}
+}
+
+// heartbeat answers the pings of the peer and, when configured, pings it.
+type heartbeat struct {
+	mu       sync.Mutex
+	send     func(*ReadWrite) error
+	interval time.Duration
+	timeout  time.Duration
+
+	lastRecv int64 // unix nanoseconds, accessed atomically
+	id       uint64
+}
+
+// newHeartbeat returns a heartbeat sending through send. It serializes send,
+// since pongs and pings are sent concurrently with data frames; the
+// returned function must be used for all frames of the stream.
+func newHeartbeat(k *Keepalive, send func(*ReadWrite) error) (*heartbeat, func(*ReadWrite) error) {
+	h := &heartbeat{lastRecv: time.Now().UnixNano()}
+	h.send = func(rw *ReadWrite) error {
+		return h.locked(func() error { return send(rw) })
+	}
+	if k != nil {
+		h.interval, h.timeout = 30*time.Second, 10*time.Second
+		if k.Interval > 0 {
+			h.interval = k.Interval
+		}
+		if k.Timeout > 0 {
+			h.timeout = k.Timeout
+		}
+	}
+	return h, h.send
+}
+
+// locked calls f, which uses the stream, while no frame is being sent.
+func (h *heartbeat) locked(f func() error) error {
+	if h == nil {
+		return f()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return f()
+}
+
+// start runs the heartbeat until the returned function is called with the
+// result of the tunnel. The returned context is canceled when the peer misses
+// its heartbeat, in which case the function returns ErrKeepaliveTimeout.
+func (h *heartbeat) start(ctx context.Context) (context.Context, func(error) error) {
+	if h == nil {
+		return ctx, func(err error) error { return err }
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.run(ctx)
+		cancel()
+	}()
+	return ctx, func(err error) error {
+		cancel()
+		if herr := <-errc; herr != nil {
+			return herr
+		}
+		return err
+	}
+}
+
+// recv wraps recv to note that the peer is alive, answer pings and drop
+// pongs.
+func (h *heartbeat) recv(recv func() (*ReadWrite, error)) func() (*ReadWrite, error) {
+	return func() (*ReadWrite, error) {
+		for {
+			rw, err := recv()
+			if err != nil {
+				return rw, err
+			}
+			atomic.StoreInt64(&h.lastRecv, time.Now().UnixNano())
+
+			switch control := rw.Control.(type) {
+			case *ReadWrite_Ping:
+				if err := h.send(&ReadWrite{Control: &ReadWrite_Pong{Pong: &Pong{Id: control.Ping.Id}}}); err != nil {
+					return nil, err
+				}
+			case *ReadWrite_Pong:
+			default:
+				return rw, nil
+			}
+		}
+	}
+}
+
+// run pings the peer whenever nothing was received for the interval, until
+// ctx is done. It returns ErrKeepaliveTimeout when nothing arrives within the
+// timeout after a ping. Without a Keepalive it only waits for ctx.
+func (h *heartbeat) run(ctx context.Context) error {
+	if h.interval == 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	timer := time.NewTimer(h.interval)
+	defer timer.Stop()
+
+	var pinged time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+		}
+
+		now := time.Now()
+		last := time.Unix(0, atomic.LoadInt64(&h.lastRecv))
+		switch {
+		case !pinged.IsZero() && last.Before(pinged):
+			if now.Sub(pinged) >= h.timeout {
+				return ErrKeepaliveTimeout
+			}
+			timer.Reset(h.timeout - now.Sub(pinged))
+		case now.Sub(last) >= h.interval:
+			pinged = now
+			h.id++
+			if err := h.send(&ReadWrite{Control: &ReadWrite_Ping{Ping: &Ping{Id: h.id}}}); err != nil {
+				return err
+			}
+			timer.Reset(h.timeout)
+		default:
+			pinged = time.Time{}
+			timer.Reset(h.interval - now.Sub(last))
+		}
+	}
+}
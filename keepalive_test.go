@@ -0,0 +1,183 @@
+package grproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func Test_heartbeat(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		answer  bool
+		wantErr error
+	}{
+		"answered": {
+			answer: true,
+		},
+		"silent": {
+			wantErr: ErrKeepaliveTimeout,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			frames := make(chan *ReadWrite, 10)
+			h, _ := newHeartbeat(&Keepalive{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}, func(rw *ReadWrite) error {
+				if ping := rw.GetPing(); ping != nil && tc.answer {
+					frames <- &ReadWrite{Control: &ReadWrite_Pong{Pong: &Pong{Id: ping.Id}}}
+				}
+				return nil
+			})
+			recv := h.recv(func() (*ReadWrite, error) {
+				return <-frames, nil
+			})
+			go recv()
+
+			ctx, cancel := context.WithTimeout(context.TODO(), 300*time.Millisecond)
+			defer cancel()
+			if err := h.run(ctx); err != tc.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_heartbeat_recv(t *testing.T) {
+	t.Parallel()
+
+	var sent []*ReadWrite
+	h, _ := newHeartbeat(nil, func(rw *ReadWrite) error {
+		sent = append(sent, rw)
+		return nil
+	})
+	recv := h.recv(frames(io.EOF,
+		&ReadWrite{Control: &ReadWrite_Ping{Ping: &Ping{Id: 7}}},
+		&ReadWrite{Control: &ReadWrite_Pong{Pong: &Pong{Id: 1}}},
+		data("abc"),
+	))
+
+	rw, err := recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rw.Buf) != "abc" {
+		t.Errorf("unexpected frame: %v", rw)
+	}
+	if len(sent) != 1 || sent[0].GetPong().GetId() != 7 {
+		t.Errorf("unexpected sent: %v", sent)
+	}
+	if _, err := recv(); err != io.EOF {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func Test_keepalive(t *testing.T) {
+	t.Parallel()
+
+	backends := make(chan net.Conn, 1)
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		backend, server := net.Pipe()
+		backends <- backend
+		return server, nil
+	}, WithKeepalive(Keepalive{Interval: 50 * time.Millisecond, Timeout: time.Second}))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	// An idle tunnel stays open while the client answers.
+	conn, errc := bindPipe(NewProxyClientService(nil, WithHello(&Hello{}), WithClientKeepalive(Keepalive{
+		Interval: 50 * time.Millisecond,
+		Timeout:  time.Second,
+	})), proxycli)
+	defer conn.Close()
+	backend := <-backends
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("unexpected end: %v", err)
+	default:
+	}
+	go backend.Write([]byte("abc"))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 3)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client that stops reading misses its heartbeat.
+	ctx, cancel := context.WithCancel(handshakeContext(context.TODO()))
+	defer cancel()
+	stream, err := proxycli.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(stream, &Hello{Capabilities: []string{keepaliveCapability}}); err != nil {
+		t.Fatal(err)
+	}
+	backend = <-backends
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := backend.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func Test_ProxyClientServer_dialOptions(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	// The server runs the default enforcement policy of gRPC, like servers
+	// built without DefaultServerOptions.
+	addr, stop := startProxyServer(t, NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}))
+	defer stop()
+
+	tests := map[string]struct {
+		opts     []ClientServerOption
+		wantOpts int
+	}{
+		"default": {},
+		"keepalive": {
+			opts:     []ClientServerOption{WithDialOptions(DefaultDialOptions()...)},
+			wantOpts: len(DefaultDialOptions()),
+		},
+	}
+
+	for tn, tc := range tests {
+		tc := tc
+		t.Run(tn, func(t *testing.T) {
+			dialed := make(chan int, 1)
+			svc := NewProxyClientService(func(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+				dialed <- len(opts)
+				return grpc.DialContext(ctx, addr, append(opts, grpc.WithInsecure())...)
+			}, WithHello(&Hello{Target: "echo"}))
+			// Serve retries failed accepts, so the listener is left open.
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go NewProxyClientServer(svc, tc.opts...).Serve(lis)
+
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte("ping"))
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+				t.Fatalf("unexpected result: %s %v", b, err)
+			}
+			if got := <-dialed; got != tc.wantOpts {
+				t.Errorf("unexpected dial options: %d", got)
+			}
+		})
+	}
+}
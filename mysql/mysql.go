@@ -0,0 +1,474 @@
+// Package mysql decodes the MySQL client/server protocol in the tunnels of a
+// grproxy server. It reports statements with their user, database and
+// duration, and blocks statements matching deny patterns.
+//
+//	insp := mysql.New(mysql.WithLogger(logger), mysql.WithDenyPatterns(regexp.MustCompile(`(?i)^\s*drop\s`)))
+//	svc := grproxy.NewProxyServerService(dialer, grproxy.WithInspector(insp))
+//
+// Tunnels that switch to TLS are forwarded without being inspected.
+package mysql
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yanolab/grproxy"
+)
+
+// Capability flags.
+const (
+	clientConnectWithDB        = 0x00000008
+	clientProtocol41           = 0x00000200
+	clientSSL                  = 0x00000800
+	clientSecureConnection     = 0x00008000
+	clientPluginAuthLenencData = 0x00200000
+	clientDeprecateEOF         = 0x01000000
+)
+
+// Commands.
+const (
+	comInitDB      = 0x02
+	comQuery       = 0x03
+	comChangeUser  = 0x11
+	comStmtPrepare = 0x16
+	comStmtExecute = 0x17
+	comStmtClose   = 0x19
+)
+
+const serverMoreResultsExists = 0x0008
+
+// BlockedError is returned to clients in place of the result of a blocked
+// statement.
+var BlockedError = Error{Code: 1227, State: "42000", Message: "statement blocked by proxy policy"}
+
+// Error is an error returned by the server.
+type Error struct {
+	Code    uint16
+	State   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Error %d (%s): %s", e.Code, e.State, e.Message)
+}
+
+// Query is a statement sent by a client.
+type Query struct {
+	Tunnel   grproxy.TunnelInfo
+	User     string
+	Database string
+	// Command is one of "Query", "Prepare", "Execute" and "InitDB". The
+	// Statement of an Execute is that of the prepared statement and the
+	// Statement of an InitDB is the database.
+	Command   string
+	Statement string
+	// Truncated is set when the statement was too large to be inspected as a
+	// whole and only its beginning is known.
+	Truncated bool
+
+	Start    time.Time
+	Duration time.Duration
+	// Rows is the number of rows in the result sets.
+	Rows    int64
+	Err     *Error
+	Blocked bool
+}
+
+// Stats are the totals of the statements seen by an Inspector.
+type Stats struct {
+	Queries  int64
+	Errors   int64
+	Blocked  int64
+	Rows     int64
+	Duration time.Duration
+}
+
+type Option func(*Inspector)
+
+// WithLogger logs every statement to l.
+func WithLogger(l *log.Logger) Option {
+	return func(i *Inspector) {
+		i.logger = l
+	}
+}
+
+// WithQueryHandler calls f once the response to a statement is complete, or
+// when it was blocked. f must not retain the Query.
+func WithQueryHandler(f func(*Query)) Option {
+	return func(i *Inspector) {
+		i.handlers = append(i.handlers, f)
+	}
+}
+
+// WithDenyPatterns blocks the statements, including prepared ones, that match
+// any of the patterns. The client gets BlockedError instead, and the statement
+// never reaches the server.
+func WithDenyPatterns(patterns ...*regexp.Regexp) Option {
+	return func(i *Inspector) {
+		i.deny = append(i.deny, patterns...)
+	}
+}
+
+// Inspector is a grproxy.Inspector for MySQL backends.
+type Inspector struct {
+	logger   *log.Logger
+	handlers []func(*Query)
+	deny     []*regexp.Regexp
+
+	// accessed atomically
+	queries  int64
+	errors   int64
+	blocked  int64
+	rows     int64
+	duration int64
+}
+
+func New(opts ...Option) *Inspector {
+	i := &Inspector{}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// Stats returns the totals so far.
+func (i *Inspector) Stats() Stats {
+	return Stats{
+		Queries:  atomic.LoadInt64(&i.queries),
+		Errors:   atomic.LoadInt64(&i.errors),
+		Blocked:  atomic.LoadInt64(&i.blocked),
+		Rows:     atomic.LoadInt64(&i.rows),
+		Duration: time.Duration(atomic.LoadInt64(&i.duration)),
+	}
+}
+
+// Inspect implements grproxy.Inspector.
+func (i *Inspector) Inspect(info grproxy.TunnelInfo, upstream, downstream io.Writer) (io.Writer, io.Writer) {
+	c := &conn{inspector: i, info: info, downstream: downstream, stmts: make(map[uint32]string)}
+	return &packetWriter{w: upstream, handle: c.clientPacket, passthrough: c.encrypted},
+		&packetWriter{w: downstream, handle: c.serverPacket, passthrough: c.encrypted}
+}
+
+func (i *Inspector) denied(stmt string) bool {
+	for _, p := range i.deny {
+		if p.MatchString(stmt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Inspector) report(q *Query) {
+	atomic.AddInt64(&i.queries, 1)
+	atomic.AddInt64(&i.rows, q.Rows)
+	atomic.AddInt64(&i.duration, int64(q.Duration))
+	switch {
+	case q.Blocked:
+		atomic.AddInt64(&i.blocked, 1)
+	case q.Err != nil:
+		atomic.AddInt64(&i.errors, 1)
+	}
+
+	if i.logger != nil {
+		result := fmt.Sprintf("%d rows", q.Rows)
+		switch {
+		case q.Blocked:
+			result = "blocked"
+		case q.Err != nil:
+			result = q.Err.Error()
+		}
+		i.logger.Printf("mysql: %s user=%s db=%s %s %q: %s in %v", q.Tunnel.Target, q.User, q.Database, q.Command, q.Statement, result, q.Duration)
+	}
+	for _, h := range i.handlers {
+		h(q)
+	}
+}
+
+type phase int
+
+const (
+	phaseHandshake phase = iota // waiting for the handshake response
+	phaseAuth                   // waiting for the result of authentication
+	phaseCommand
+	phaseTLS // encrypted, not inspected
+)
+
+type resultState int
+
+const (
+	resultFirst      resultState = iota // waiting for the first packet of a result
+	resultColumns                       // reading column definitions
+	resultColumnsEOF                    // waiting for the EOF after the columns
+	resultRows
+)
+
+// conn is the protocol state of a tunnel. Client packets are handled by the
+// upstream writer and server packets by the downstream writer, concurrently.
+type conn struct {
+	inspector  *Inspector
+	info       grproxy.TunnelInfo
+	downstream io.Writer
+
+	mu         sync.Mutex
+	phase      phase
+	serverCaps uint32
+	clientCaps uint32
+	user       string
+	database   string
+	stmts      map[uint32]string // prepared statements by id
+	dropping   bool              // dropping the rest of a blocked command
+
+	pending *Query
+	result  resultState
+	columns uint64
+}
+
+func (c *conn) encrypted() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.phase == phaseTLS
+}
+
+func (c *conn) deprecateEOF() bool {
+	return c.serverCaps&c.clientCaps&clientDeprecateEOF != 0
+}
+
+func (c *conn) clientPacket(pkt []byte, complete bool) bool {
+	seq, payload := pkt[3], pkt[4:]
+
+	c.mu.Lock()
+	switch c.phase {
+	case phaseHandshake:
+		c.handshakeResponse(payload)
+		c.mu.Unlock()
+		return true
+	case phaseCommand:
+	default:
+		c.mu.Unlock()
+		return true
+	}
+
+	if seq != 0 {
+		c.mu.Unlock()
+		return !c.dropping
+	}
+	c.dropping, c.pending = false, nil
+	if len(payload) == 0 {
+		c.mu.Unlock()
+		return true
+	}
+
+	q := &Query{
+		Tunnel:    c.info,
+		User:      c.user,
+		Database:  c.database,
+		Statement: string(payload[1:]),
+		Truncated: !complete,
+		Start:     time.Now(),
+	}
+	switch payload[0] {
+	case comQuery:
+		q.Command = "Query"
+	case comStmtPrepare:
+		q.Command = "Prepare"
+	case comInitDB:
+		q.Command = "InitDB"
+	case comStmtExecute:
+		q.Command, q.Statement = "Execute", ""
+		if len(payload) >= 5 {
+			q.Statement = c.stmts[binary.LittleEndian.Uint32(payload[1:])]
+		}
+	case comStmtClose:
+		if len(payload) >= 5 {
+			delete(c.stmts, binary.LittleEndian.Uint32(payload[1:]))
+		}
+		q = nil
+	case comChangeUser:
+		if user, _, ok := cstring(payload[1:]); ok {
+			c.user = user
+		}
+		c.phase = phaseAuth
+		q = nil
+	default:
+		q = nil
+	}
+	if q == nil {
+		c.mu.Unlock()
+		return true
+	}
+
+	if (q.Command == "Query" || q.Command == "Prepare") && c.inspector.denied(q.Statement) {
+		q.Blocked = true
+		c.dropping = true
+		c.mu.Unlock()
+
+		c.downstream.Write(errorPacket(seq+1, &BlockedError))
+		c.inspector.report(q)
+		return false
+	}
+	c.pending, c.result = q, resultFirst
+	c.mu.Unlock()
+	return true
+}
+
+// handshakeResponse reads the user and database from the response of the
+// client to the greeting of the server. It must be called with mu held.
+func (c *conn) handshakeResponse(payload []byte) {
+	c.phase = phaseAuth
+	if len(payload) < 4 {
+		return
+	}
+	caps := binary.LittleEndian.Uint32(payload)
+	if caps&clientProtocol41 == 0 {
+		return
+	}
+	c.clientCaps = caps
+	if caps&clientSSL != 0 && len(payload) == 32 {
+		c.phase = phaseTLS
+		return
+	}
+	if len(payload) < 32 {
+		return
+	}
+
+	b := payload[32:]
+	user, n, ok := cstring(b)
+	if !ok {
+		return
+	}
+	c.user, b = user, b[n:]
+
+	var auth uint64
+	switch {
+	case caps&clientPluginAuthLenencData != 0:
+		auth, n, ok = lenenc(b)
+	case caps&clientSecureConnection != 0:
+		if ok = len(b) > 0; ok {
+			auth, n = uint64(b[0]), 1
+		}
+	default:
+		_, n, ok = cstring(b)
+	}
+	if !ok || uint64(len(b)-n) < auth {
+		return
+	}
+	b = b[uint64(n)+auth:]
+
+	if caps&clientConnectWithDB != 0 {
+		if db, _, ok := cstring(b); ok {
+			c.database = db
+		}
+	}
+}
+
+func (c *conn) serverPacket(pkt []byte, complete bool) bool {
+	payload := pkt[4:]
+	if len(payload) == 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	var done *Query
+	switch c.phase {
+	case phaseHandshake:
+		// The greeting: protocol version, server version, connection id,
+		// 8 bytes of auth data, a filler and the capability flags.
+		if payload[0] == 10 {
+			if _, n, ok := cstring(payload[1:]); ok {
+				b := payload[1+n:]
+				if len(b) >= 15 {
+					c.serverCaps = uint32(binary.LittleEndian.Uint16(b[13:]))
+				}
+				if len(b) >= 20 {
+					c.serverCaps |= uint32(binary.LittleEndian.Uint16(b[18:])) << 16
+				}
+			}
+		}
+	case phaseAuth:
+		if payload[0] == 0x00 {
+			c.phase = phaseCommand
+		}
+	case phaseCommand:
+		if c.pending != nil {
+			done = c.response(payload)
+		}
+	}
+	c.mu.Unlock()
+
+	if done != nil {
+		c.inspector.report(done)
+	}
+	return true
+}
+
+// response reads a packet of the response to the pending statement. It
+// returns the statement once the response is complete. It must be called
+// with mu held.
+func (c *conn) response(payload []byte) *Query {
+	q := c.pending
+	switch c.result {
+	case resultFirst:
+		switch payload[0] {
+		case 0x00:
+			switch q.Command {
+			case "Prepare":
+				// The statement id follows. The definitions of the parameters
+				// and columns are not needed.
+				if len(payload) >= 5 {
+					c.stmts[binary.LittleEndian.Uint32(payload[1:])] = q.Statement
+				}
+			case "InitDB":
+				c.database = q.Statement
+			}
+			if q.Command != "Prepare" && okStatus(payload, false)&serverMoreResultsExists != 0 {
+				return nil
+			}
+		case 0xff:
+			q.Err = parseError(payload)
+		case 0xfb:
+			// LOCAL INFILE: the client sends the file, then the server
+			// answers with OK or ERR.
+			return nil
+		default:
+			n, _, ok := lenenc(payload)
+			if ok && n > 0 {
+				c.columns, c.result = n, resultColumns
+				return nil
+			}
+		}
+	case resultColumns:
+		if c.columns--; c.columns == 0 {
+			c.result = resultColumnsEOF
+			if c.deprecateEOF() {
+				c.result = resultRows
+			}
+		}
+		return nil
+	case resultColumnsEOF:
+		c.result = resultRows
+		return nil
+	case resultRows:
+		switch {
+		case payload[0] == 0xff:
+			q.Err = parseError(payload)
+		case payload[0] == 0xfe && (len(payload) < 9 || c.deprecateEOF() && len(payload) < 0xffffff):
+			if okStatus(payload, !c.deprecateEOF())&serverMoreResultsExists != 0 {
+				c.result = resultFirst
+				return nil
+			}
+		default:
+			q.Rows++
+			return nil
+		}
+	}
+
+	q.Duration = time.Since(q.Start)
+	c.pending = nil
+	return q
+}
@@ -0,0 +1,218 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yanolab/grproxy"
+)
+
+type fixtureLine struct {
+	dir  byte
+	data []byte
+}
+
+// readFixture reads a fixture of testdata, made of one write per line.
+func readFixture(t *testing.T, name string) []fixtureLine {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []fixtureLine
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		data, err := hex.DecodeString(strings.TrimSpace(line[1:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fixtureLine{dir: line[0], data: data})
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// replay writes the fixture through an inspector, in chunks of at most chunk
+// bytes when chunk is positive. It returns the bytes reaching the server and
+// the client.
+func replay(t *testing.T, i *Inspector, lines []fixtureLine, chunk int) (string, string) {
+	t.Helper()
+
+	var toServer, toClient bytes.Buffer
+	upstream, downstream := i.Inspect(grproxy.TunnelInfo{Target: "db"}, &toServer, &toClient)
+	for _, l := range lines {
+		w := upstream
+		switch l.dir {
+		case '<':
+			w = downstream
+		case '!':
+			continue
+		}
+		for b := l.data; len(b) > 0; {
+			n := len(b)
+			if chunk > 0 && n > chunk {
+				n = chunk
+			}
+			if _, err := w.Write(b[:n]); err != nil {
+				t.Fatal(err)
+			}
+			b = b[n:]
+		}
+	}
+	return toServer.String(), toClient.String()
+}
+
+func Test_Inspector(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fixture string
+		deny    []*regexp.Regexp
+		want    []Query
+		stats   Stats
+	}{
+		"session": {
+			fixture: "session.txt",
+			want: []Query{
+				{User: "app", Database: "shop", Command: "Query", Statement: "select @@version_comment limit 1", Rows: 1},
+				{User: "app", Database: "shop", Command: "Query", Statement: "SELECT id, name FROM users WHERE id < 3", Rows: 2},
+				{User: "app", Database: "shop", Command: "Query", Statement: "SELECT * FROM missing", Err: &Error{Code: 1146, State: "42S02", Message: "Table 'shop.missing' doesn't exist"}},
+				{User: "app", Database: "shop", Command: "InitDB", Statement: "inventory"},
+				{User: "app", Database: "inventory", Command: "Prepare", Statement: "SELECT name FROM items WHERE id = ?"},
+				{User: "app", Database: "inventory", Command: "Execute", Statement: "SELECT name FROM items WHERE id = ?", Rows: 1},
+			},
+			stats: Stats{Queries: 6, Errors: 1, Rows: 4},
+		},
+		"eof": {
+			fixture: "eof.txt",
+			want: []Query{
+				{User: "report", Command: "Query", Statement: "SELECT 1", Rows: 1},
+				{User: "report", Command: "Query", Statement: "CALL sales.summary()", Rows: 3},
+			},
+			stats: Stats{Queries: 2, Rows: 4},
+		},
+		"tls": {
+			fixture: "tls.txt",
+		},
+		"blocked": {
+			fixture: "blocked.txt",
+			deny:    []*regexp.Regexp{regexp.MustCompile(`(?i)^\s*drop\s`)},
+			want: []Query{
+				{User: "app", Database: "shop", Command: "Query", Statement: "DROP TABLE users", Blocked: true},
+				{User: "app", Database: "shop", Command: "Query", Statement: "SELECT 1", Rows: 1},
+			},
+			stats: Stats{Queries: 2, Blocked: 1, Rows: 1},
+		},
+	}
+
+	for tn, tc := range tests {
+		for _, chunk := range []int{0, 1, 7} {
+			tc, chunk := tc, chunk
+			t.Run(fmt.Sprintf("%s/%d", tn, chunk), func(t *testing.T) {
+				lines := readFixture(t, tc.fixture)
+				var got []Query
+				i := New(WithDenyPatterns(tc.deny...), WithQueryHandler(func(q *Query) {
+					if q.Start.IsZero() || q.Duration < 0 || q.Tunnel.Target != "db" {
+						t.Errorf("unexpected query: %+v", q)
+					}
+					c := *q
+					c.Tunnel, c.Start, c.Duration = grproxy.TunnelInfo{}, time.Time{}, 0
+					got = append(got, c)
+				}))
+
+				toServer, toClient := replay(t, i, lines, chunk)
+
+				// Everything but the denied statements is forwarded as it is.
+				var wantServer, wantClient bytes.Buffer
+				for n, l := range lines {
+					switch {
+					case l.dir == '<' || l.dir == '!':
+						wantClient.Write(l.data)
+					case n+1 < len(lines) && lines[n+1].dir == '!':
+					default:
+						wantServer.Write(l.data)
+					}
+				}
+				if toServer != wantServer.String() {
+					t.Errorf("unexpected bytes to server: %x", toServer)
+				}
+				if toClient != wantClient.String() {
+					t.Errorf("unexpected bytes to client: %x", toClient)
+				}
+
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("unexpected queries: %+v", got)
+				}
+				stats := i.Stats()
+				stats.Duration = 0
+				if stats != tc.stats {
+					t.Errorf("unexpected stats: %+v", stats)
+				}
+			})
+		}
+	}
+}
+
+func Test_Inspector_large(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		deny        []*regexp.Regexp
+		wantForward bool
+		wantBlocked bool
+	}{
+		"forwarded": {
+			wantForward: true,
+		},
+		"blocked": {
+			deny:        []*regexp.Regexp{regexp.MustCompile(`^INSERT INTO blobs`)},
+			wantBlocked: true,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			lines := readFixture(t, "blocked.txt")[:3]
+			stmt := "INSERT INTO blobs VALUES ('" + strings.Repeat("a", 2<<20) + "')"
+			query := packet(0, append([]byte{comQuery}, stmt...))
+			lines = append(lines, fixtureLine{dir: '>', data: query})
+
+			var got *Query
+			i := New(WithDenyPatterns(tc.deny...), WithQueryHandler(func(q *Query) {
+				c := *q
+				got = &c
+			}))
+			toServer, toClient := replay(t, i, lines, 64<<10)
+
+			if forwarded := strings.HasSuffix(toServer, string(query)); forwarded != tc.wantForward {
+				t.Errorf("unexpected forward: %v", forwarded)
+			}
+			blockedErr := string(errorPacket(1, &BlockedError))
+			if blocked := strings.HasSuffix(toClient, blockedErr); blocked != tc.wantBlocked {
+				t.Errorf("unexpected block: %v", blocked)
+			}
+			if tc.wantBlocked && (got == nil || !got.Blocked || !got.Truncated) {
+				t.Errorf("unexpected query: %+v", got)
+			}
+		})
+	}
+}
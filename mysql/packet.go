@@ -0,0 +1,171 @@
+package mysql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// maxInspected is the size of the largest packet that is buffered to be
+// inspected as a whole. Only the beginning of larger packets is inspected.
+const maxInspected = 1 << 20
+
+// packetWriter splits the bytes written to it into packets and forwards them
+// to w when handle returns true. handle is passed either a whole packet or,
+// when complete is false, the beginning of a packet larger than maxInspected.
+// passthrough reports whether the stream is no longer made of packets, after
+// which bytes are forwarded as they are.
+type packetWriter struct {
+	w           io.Writer
+	handle      func(pkt []byte, complete bool) bool
+	passthrough func() bool
+
+	buf     []byte
+	skip    int  // bytes of a large packet still to come
+	discard bool // whether to drop them
+}
+
+func (pw *packetWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if pw.skip > 0 {
+		k := len(b)
+		if k > pw.skip {
+			k = pw.skip
+		}
+		if !pw.discard {
+			if _, err := pw.w.Write(b[:k]); err != nil {
+				return 0, err
+			}
+		}
+		pw.skip -= k
+		b = b[k:]
+	}
+	pw.buf = append(pw.buf, b...)
+
+	off := 0
+	for off < len(pw.buf) {
+		rest := pw.buf[off:]
+		if pw.passthrough() {
+			if _, err := pw.w.Write(rest); err != nil {
+				return 0, err
+			}
+			off = len(pw.buf)
+			break
+		}
+		if len(rest) < 4 {
+			break
+		}
+		size := 4 + packetLen(rest)
+		if len(rest) >= size {
+			if pw.handle(rest[:size], true) {
+				if _, err := pw.w.Write(rest[:size]); err != nil {
+					return 0, err
+				}
+			}
+			off += size
+			continue
+		}
+		if size <= maxInspected {
+			break
+		}
+		pw.discard = !pw.handle(rest, false)
+		if !pw.discard {
+			if _, err := pw.w.Write(rest); err != nil {
+				return 0, err
+			}
+		}
+		pw.skip = size - len(rest)
+		off = len(pw.buf)
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[off:]...)
+	return n, nil
+}
+
+func packetLen(pkt []byte) int {
+	return int(pkt[0]) | int(pkt[1])<<8 | int(pkt[2])<<16
+}
+
+// packet builds a packet with the sequence id seq.
+func packet(seq byte, payload []byte) []byte {
+	n := len(payload)
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...)
+}
+
+// lenenc reads a length-encoded integer. ok is false when b is too short.
+func lenenc(b []byte) (v uint64, n int, ok bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	switch b[0] {
+	case 0xfc:
+		n = 3
+	case 0xfd:
+		n = 4
+	case 0xfe:
+		n = 9
+	default:
+		return uint64(b[0]), 1, true
+	}
+	if len(b) < n {
+		return 0, 0, false
+	}
+	for i := n - 1; i > 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, true
+}
+
+// cstring reads a NUL-terminated string. ok is false when there is no NUL.
+func cstring(b []byte) (s string, n int, ok bool) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", 0, false
+	}
+	return string(b[:i]), i + 1, true
+}
+
+// okStatus returns the status flags of an OK packet, or of an EOF packet when
+// eof is true.
+func okStatus(payload []byte, eof bool) uint16 {
+	if eof {
+		if len(payload) < 5 {
+			return 0
+		}
+		return binary.LittleEndian.Uint16(payload[3:])
+	}
+	b := payload[1:]
+	for i := 0; i < 2; i++ { // affected rows and last insert id
+		_, n, ok := lenenc(b)
+		if !ok {
+			return 0
+		}
+		b = b[n:]
+	}
+	if len(b) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+// parseError decodes an ERR packet.
+func parseError(payload []byte) *Error {
+	e := &Error{}
+	if len(payload) < 3 {
+		return e
+	}
+	e.Code = binary.LittleEndian.Uint16(payload[1:])
+	msg := payload[3:]
+	if len(msg) >= 6 && msg[0] == '#' {
+		e.State, msg = string(msg[1:6]), msg[6:]
+	}
+	e.Message = string(msg)
+	return e
+}
+
+// errorPacket encodes e as an ERR packet.
+func errorPacket(seq byte, e *Error) []byte {
+	payload := []byte{0xff, byte(e.Code), byte(e.Code >> 8), '#'}
+	payload = append(payload, e.State...)
+	payload = append(payload, e.Message...)
+	return packet(seq, payload)
+}
@@ -0,0 +1,126 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// maxDecoded is the size of the largest message that is buffered to be
+// decoded as a whole. Only the beginning of larger messages is decoded.
+const maxDecoded = 1 << 20
+
+// framing is how the next bytes of a direction are delimited.
+type framing int
+
+const (
+	framingTyped     framing = iota // a type byte, then a length
+	framingUntyped                  // a length only, as startup messages
+	framingByte                     // one byte, as the answer to SSLRequest
+	framingEncrypted                // TLS or GSSAPI, not decoded
+)
+
+// decoder splits the bytes of a direction into messages and passes them to
+// handle. typ is zero for untyped messages. When truncated is true, body is
+// the beginning of a message larger than maxDecoded.
+type decoder struct {
+	framing func() framing
+	handle  func(typ byte, body []byte, truncated bool)
+
+	buf  []byte
+	skip int  // bytes of a large message still to come
+	lost bool // whether the stream stopped making sense
+}
+
+func (d *decoder) Write(b []byte) (int, error) {
+	n := len(b)
+	if d.lost {
+		return n, nil
+	}
+	if d.skip > 0 {
+		k := len(b)
+		if k > d.skip {
+			k = d.skip
+		}
+		d.skip -= k
+		b = b[k:]
+	}
+	d.buf = append(d.buf, b...)
+
+	off := 0
+	for off < len(d.buf) && !d.lost {
+		rest := d.buf[off:]
+		header := 4
+		switch d.framing() {
+		case framingEncrypted:
+			off = len(d.buf)
+			continue
+		case framingByte:
+			d.handle(rest[0], nil, false)
+			off++
+			continue
+		case framingTyped:
+			header = 5
+		}
+		if len(rest) < header {
+			break
+		}
+		var typ byte
+		if header == 5 {
+			typ = rest[0]
+		}
+		length := int(binary.BigEndian.Uint32(rest[header-4:]))
+		if length < 4 {
+			// Not a message: the decoder is out of sync with the stream.
+			d.lost = true
+			break
+		}
+		size := header - 4 + length
+		if len(rest) < size {
+			if size <= maxDecoded {
+				break
+			}
+			d.handle(typ, rest[header:], true)
+			d.skip = size - len(rest)
+			off = len(d.buf)
+			continue
+		}
+		d.handle(typ, rest[header:size], false)
+		off += size
+	}
+	if d.lost {
+		off = len(d.buf)
+	}
+	d.buf = append(d.buf[:0], d.buf[off:]...)
+	return n, nil
+}
+
+// cstring reads a NUL-terminated string. Without a NUL, it returns the rest
+// of b.
+func cstring(b []byte) (string, []byte) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b), nil
+	}
+	return string(b[:i]), b[i+1:]
+}
+
+// parseError decodes an ErrorResponse.
+func parseError(body []byte) *Error {
+	e := &Error{}
+	for len(body) > 0 && body[0] != 0 {
+		field := body[0]
+		var value string
+		value, body = cstring(body[1:])
+		switch field {
+		case 'S':
+			e.Severity = value
+		case 'C':
+			e.Code = value
+		case 'M':
+			e.Message = value
+		case 'D':
+			e.Detail = value
+		}
+	}
+	return e
+}
@@ -0,0 +1,340 @@
+// Package postgres decodes the PostgreSQL frontend/backend protocol in the
+// tunnels of a grproxy server and audits logins, queries and errors.
+//
+//	insp := postgres.New(postgres.NewJSONSink(auditLog))
+//	svc := grproxy.NewProxyServerService(dialer, grproxy.WithInspector(insp))
+//
+// The bytes of tunnels are never changed. Tunnels that negotiate TLS or GSSAPI
+// encryption with the server are passed through without being decoded.
+package postgres
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/yanolab/grproxy"
+)
+
+// Codes of the untyped messages of a client.
+const (
+	protocolVersion3 = 196608
+	sslRequest       = 80877103
+	gssencRequest    = 80877104
+)
+
+// EventKind is the kind of an audit Event.
+type EventKind string
+
+const (
+	// EventStartup is sent when a client starts a session.
+	EventStartup EventKind = "startup"
+	// EventQuery is sent when a client runs a simple query or executes an
+	// extended query.
+	EventQuery EventKind = "query"
+	// EventError is sent when the server reports an error, including failed
+	// logins.
+	EventError EventKind = "error"
+)
+
+// Error is an ErrorResponse of the server.
+type Error struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Severity + ": " + e.Message + " (SQLSTATE " + e.Code + ")"
+}
+
+// Event is an audit record of a tunnel.
+type Event struct {
+	Time   time.Time
+	Kind   EventKind
+	Tunnel grproxy.TunnelInfo
+
+	User        string
+	Database    string
+	Application string
+
+	// Query is the text of a query. For an error, it is the query that was
+	// running, if any.
+	Query string
+	// Statement is the name of the prepared statement of an extended query.
+	Statement string
+	Extended  bool
+	// Truncated is set when the query was too large to be decoded as a whole
+	// and only its beginning is known.
+	Truncated bool
+
+	Err *Error
+}
+
+// Sink receives audit events. Audit is called concurrently by the tunnels and
+// must not retain the Event.
+type Sink interface {
+	Audit(e *Event)
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(e *Event)
+
+func (f SinkFunc) Audit(e *Event) {
+	f(e)
+}
+
+type jsonEvent struct {
+	Time        time.Time `json:"time"`
+	Kind        EventKind `json:"event"`
+	Identity    string    `json:"identity,omitempty"`
+	Target      string    `json:"target,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Database    string    `json:"database,omitempty"`
+	Application string    `json:"application,omitempty"`
+	Query       string    `json:"query,omitempty"`
+	Statement   string    `json:"statement,omitempty"`
+	Extended    bool      `json:"extended,omitempty"`
+	Truncated   bool      `json:"truncated,omitempty"`
+	Err         *Error    `json:"error,omitempty"`
+}
+
+// NewJSONSink writes events to w as JSON objects, one per line. Write errors
+// are ignored.
+func NewJSONSink(w io.Writer) Sink {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return SinkFunc(func(e *Event) {
+		je := &jsonEvent{
+			Time:        e.Time,
+			Kind:        e.Kind,
+			Identity:    e.Tunnel.Identity,
+			Target:      e.Tunnel.Target,
+			User:        e.User,
+			Database:    e.Database,
+			Application: e.Application,
+			Query:       e.Query,
+			Statement:   e.Statement,
+			Extended:    e.Extended,
+			Truncated:   e.Truncated,
+			Err:         e.Err,
+		}
+		if e.Tunnel.Client != nil {
+			je.Client = e.Tunnel.Client.String()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		enc.Encode(je)
+	})
+}
+
+// Inspector is a grproxy.Inspector for PostgreSQL backends.
+type Inspector struct {
+	sink Sink
+}
+
+func New(sink Sink) *Inspector {
+	return &Inspector{sink: sink}
+}
+
+// Inspect implements grproxy.Inspector.
+func (i *Inspector) Inspect(info grproxy.TunnelInfo, upstream, downstream io.Writer) (io.Writer, io.Writer) {
+	c := &conn{
+		sink:    i.sink,
+		info:    info,
+		stmts:   make(map[string]string),
+		portals: make(map[string]string),
+	}
+	return &observer{w: upstream, d: &decoder{framing: c.clientFraming, handle: c.clientMessage}},
+		&observer{w: downstream, d: &decoder{framing: c.serverFraming, handle: c.serverMessage}}
+}
+
+// observer decodes the bytes written to w. They are decoded before they are
+// written through, so that the answer to an encryption request switches the
+// tunnel to passthrough before the client can start its TLS handshake.
+type observer struct {
+	w io.Writer
+	d *decoder
+}
+
+func (o *observer) Write(b []byte) (int, error) {
+	o.d.Write(b)
+	return o.w.Write(b)
+}
+
+type phase int
+
+const (
+	phaseStartup    phase = iota // waiting for a startup message
+	phaseEncryption              // waiting for the answer to an encryption request
+	phaseSession
+	phaseEncrypted
+)
+
+// conn is the protocol state of a tunnel. Client messages are decoded by the
+// upstream writer and server messages by the downstream writer, concurrently.
+type conn struct {
+	sink Sink
+	info grproxy.TunnelInfo
+
+	mu          sync.Mutex
+	phase       phase
+	user        string
+	database    string
+	application string
+	stmts       map[string]string // query of prepared statements by name
+	portals     map[string]string // statement of portals by name
+	running     *Event            // the query running, until the server is ready
+}
+
+func (c *conn) clientFraming() framing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.phase {
+	case phaseStartup:
+		return framingUntyped
+	case phaseEncrypted:
+		return framingEncrypted
+	default:
+		return framingTyped
+	}
+}
+
+func (c *conn) serverFraming() framing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.phase {
+	case phaseEncryption:
+		return framingByte
+	case phaseEncrypted:
+		return framingEncrypted
+	default:
+		return framingTyped
+	}
+}
+
+// event returns an event of the tunnel. It must be called with mu held.
+func (c *conn) event(kind EventKind) *Event {
+	return &Event{
+		Time:        time.Now(),
+		Kind:        kind,
+		Tunnel:      c.info,
+		User:        c.user,
+		Database:    c.database,
+		Application: c.application,
+	}
+}
+
+func (c *conn) clientMessage(typ byte, body []byte, truncated bool) {
+	c.mu.Lock()
+	var e *Event
+	switch typ {
+	case 0:
+		e = c.startup(body)
+	case 'Q':
+		query, _ := cstring(body)
+		e = c.event(EventQuery)
+		e.Query, e.Truncated = query, truncated
+		c.running = e
+	case 'P':
+		name, rest := cstring(body)
+		query, _ := cstring(rest)
+		c.stmts[name] = query
+		// Errors in the query are reported before it is executed.
+		c.running = &Event{Query: query, Statement: name, Extended: true, Truncated: truncated}
+	case 'B':
+		portal, rest := cstring(body)
+		stmt, _ := cstring(rest)
+		c.portals[portal] = stmt
+	case 'E':
+		portal, _ := cstring(body)
+		stmt := c.portals[portal]
+		e = c.event(EventQuery)
+		e.Query, e.Statement, e.Extended = c.stmts[stmt], stmt, true
+		c.running = e
+	case 'C':
+		if len(body) > 0 {
+			name, _ := cstring(body[1:])
+			switch body[0] {
+			case 'S':
+				delete(c.stmts, name)
+			case 'P':
+				delete(c.portals, name)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if e != nil {
+		c.sink.Audit(e)
+	}
+}
+
+// startup decodes an untyped message. It must be called with mu held.
+func (c *conn) startup(body []byte) *Event {
+	if len(body) < 4 {
+		return nil
+	}
+	switch binary.BigEndian.Uint32(body) {
+	case sslRequest, gssencRequest:
+		c.phase = phaseEncryption
+		return nil
+	case protocolVersion3:
+	default:
+		// A CancelRequest, or a protocol this package does not know.
+		return nil
+	}
+
+	c.phase = phaseSession
+	b := body[4:]
+	for len(b) > 0 && b[0] != 0 {
+		var key, value string
+		key, b = cstring(b)
+		value, b = cstring(b)
+		switch key {
+		case "user":
+			c.user = value
+		case "database":
+			c.database = value
+		case "application_name":
+			c.application = value
+		}
+	}
+	if c.database == "" {
+		c.database = c.user
+	}
+	return c.event(EventStartup)
+}
+
+func (c *conn) serverMessage(typ byte, body []byte, truncated bool) {
+	c.mu.Lock()
+	var e *Event
+	switch {
+	case c.phase == phaseEncryption:
+		// The answer to an encryption request is a single byte.
+		c.phase = phaseStartup
+		if typ == 'S' || typ == 'G' {
+			c.phase = phaseEncrypted
+		}
+	case typ == 'E':
+		e = c.event(EventError)
+		e.Err = parseError(body)
+		if r := c.running; r != nil {
+			e.Query, e.Statement, e.Extended, e.Truncated = r.Query, r.Statement, r.Extended, r.Truncated
+		}
+	case typ == 'Z':
+		c.running = nil
+	}
+	c.mu.Unlock()
+
+	if e != nil {
+		c.sink.Audit(e)
+	}
+}
@@ -0,0 +1,282 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yanolab/grproxy"
+)
+
+type fixtureLine struct {
+	dir  byte
+	data []byte
+}
+
+// readFixture reads a fixture of testdata, made of one write per line.
+func readFixture(t *testing.T, name string) []fixtureLine {
+	t.Helper()
+
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var lines []fixtureLine
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		data, err := hex.DecodeString(strings.TrimSpace(line[1:]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, fixtureLine{dir: line[0], data: data})
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+// replay writes the fixture through an inspector, in chunks of at most chunk
+// bytes when chunk is positive. It returns the bytes reaching the server and
+// the client.
+func replay(t *testing.T, i *Inspector, lines []fixtureLine, chunk int) (string, string) {
+	t.Helper()
+
+	var toServer, toClient bytes.Buffer
+	upstream, downstream := i.Inspect(grproxy.TunnelInfo{Target: "db"}, &toServer, &toClient)
+	for _, l := range lines {
+		w := upstream
+		if l.dir == '<' {
+			w = downstream
+		}
+		for b := l.data; len(b) > 0; {
+			n := len(b)
+			if chunk > 0 && n > chunk {
+				n = chunk
+			}
+			if _, err := w.Write(b[:n]); err != nil {
+				t.Fatal(err)
+			}
+			b = b[n:]
+		}
+	}
+	return toServer.String(), toClient.String()
+}
+
+func Test_Inspector(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fixture string
+		want    []Event
+	}{
+		"simple": {
+			fixture: "simple.txt",
+			want: []Event{
+				{Kind: EventStartup, User: "app", Database: "shop", Application: "psql"},
+				{Kind: EventQuery, User: "app", Database: "shop", Application: "psql", Query: "SELECT id, name FROM users WHERE id < 3;"},
+				{Kind: EventQuery, User: "app", Database: "shop", Application: "psql", Query: "SELECT * FROM missing;"},
+				{Kind: EventError, User: "app", Database: "shop", Application: "psql", Query: "SELECT * FROM missing;", Err: &Error{
+					Severity: "ERROR",
+					Code:     "42P01",
+					Message:  `relation "missing" does not exist`,
+				}},
+			},
+		},
+		"extended": {
+			fixture: "extended.txt",
+			want: []Event{
+				{Kind: EventStartup, User: "app", Database: "shop", Application: "billing"},
+				{Kind: EventQuery, User: "app", Database: "shop", Application: "billing", Query: "SELECT name FROM items WHERE id = $1", Statement: "s1", Extended: true},
+				{Kind: EventQuery, User: "app", Database: "shop", Application: "billing", Query: "UPDATE items SET qty = qty - 1 WHERE id = $1", Extended: true},
+				{Kind: EventError, User: "app", Database: "shop", Application: "billing", Query: "UPDATE items SET qty = qty - 1 WHERE id = $1", Extended: true, Err: &Error{
+					Severity: "ERROR",
+					Code:     "23514",
+					Message:  `new row for relation "items" violates check constraint "items_qty_check"`,
+					Detail:   "Failing row contains (2, bolt, -1).",
+				}},
+				{Kind: EventError, User: "app", Database: "shop", Application: "billing", Query: "SELEC 1", Statement: "s2", Extended: true, Err: &Error{
+					Severity: "ERROR",
+					Code:     "42601",
+					Message:  `syntax error at or near "SELEC"`,
+				}},
+			},
+		},
+		"tls": {
+			fixture: "tls.txt",
+		},
+		"tls refused": {
+			fixture: "tls_refused.txt",
+			want: []Event{
+				{Kind: EventStartup, User: "app", Database: "shop"},
+				{Kind: EventError, User: "app", Database: "shop", Err: &Error{
+					Severity: "FATAL",
+					Code:     "28P01",
+					Message:  `password authentication failed for user "app"`,
+				}},
+			},
+		},
+	}
+
+	for tn, tc := range tests {
+		for _, chunk := range []int{0, 1, 7} {
+			tc, chunk := tc, chunk
+			t.Run(fmt.Sprintf("%s/%d", tn, chunk), func(t *testing.T) {
+				lines := readFixture(t, tc.fixture)
+				var (
+					mu  sync.Mutex
+					got []Event
+				)
+				i := New(SinkFunc(func(e *Event) {
+					if e.Time.IsZero() || e.Tunnel.Target != "db" {
+						t.Errorf("unexpected event: %+v", e)
+					}
+					c := *e
+					c.Time, c.Tunnel = time.Time{}, grproxy.TunnelInfo{}
+					mu.Lock()
+					got = append(got, c)
+					mu.Unlock()
+				}))
+
+				toServer, toClient := replay(t, i, lines, chunk)
+
+				var wantServer, wantClient bytes.Buffer
+				for _, l := range lines {
+					if l.dir == '<' {
+						wantClient.Write(l.data)
+					} else {
+						wantServer.Write(l.data)
+					}
+				}
+				if toServer != wantServer.String() || toClient != wantClient.String() {
+					t.Error("unexpected bytes")
+				}
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("unexpected events: %+v", got)
+				}
+			})
+		}
+	}
+}
+
+func Test_Inspector_large(t *testing.T) {
+	t.Parallel()
+
+	var got []*Event
+	i := New(SinkFunc(func(e *Event) {
+		got = append(got, e)
+	}))
+	lines := readFixture(t, "extended.txt")[:2]
+	query := "INSERT INTO blobs VALUES ('" + strings.Repeat("a", 2<<20) + "');"
+	msg := append([]byte{'Q', 0, 0, 0, 0}, query+"\x00"...)
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(msg)-1))
+	lines = append(lines, fixtureLine{dir: '>', data: msg}, fixtureLine{dir: '>', data: []byte{'X', 0, 0, 0, 4}})
+
+	toServer, _ := replay(t, i, lines, 64<<10)
+	if !strings.Contains(toServer, string(msg)) {
+		t.Error("unexpected bytes")
+	}
+	if len(got) != 2 {
+		t.Fatalf("unexpected events: %v", got)
+	}
+	if e := got[1]; !e.Truncated || !strings.HasPrefix(query, e.Query) || len(e.Query) == 0 {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
+
+func Test_NewJSONSink(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	sink := NewJSONSink(&buf)
+	sink.Audit(&Event{
+		Time:   time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Kind:   EventError,
+		Tunnel: grproxy.TunnelInfo{Identity: "alice", Target: "db", Client: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}},
+		User:   "app",
+		Query:  "SELECT 1",
+		Err:    &Error{Severity: "ERROR", Code: "57014", Message: "canceling statement due to user request"},
+	})
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"time":     "2020-01-02T03:04:05Z",
+		"event":    "error",
+		"identity": "alice",
+		"target":   "db",
+		"client":   "10.0.0.1:5000",
+		"user":     "app",
+		"query":    "SELECT 1",
+		"error": map[string]interface{}{
+			"severity": "ERROR",
+			"code":     "57014",
+			"message":  "canceling statement due to user request",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected record: %v", got)
+	}
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func Test_Inspector_encryptionAnswer(t *testing.T) {
+	t.Parallel()
+
+	var got []Event
+	i := New(SinkFunc(func(e *Event) {
+		got = append(got, *e)
+	}))
+
+	// The client starts its handshake as soon as the server agrees to
+	// encryption, before the downstream write returns.
+	var upstream io.Writer
+	encrypted := []byte("Q\x00\x00\x00\x0dSELECT 1\x00")
+	upstream, downstream := i.Inspect(grproxy.TunnelInfo{}, ioutil.Discard, writerFunc(func(b []byte) (int, error) {
+		if bytes.Equal(b, []byte("S")) {
+			if _, err := upstream.Write(encrypted); err != nil {
+				return 0, err
+			}
+		}
+		return len(b), nil
+	}))
+
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request, 8)
+	binary.BigEndian.PutUint32(request[4:], sslRequest)
+	if _, err := upstream.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downstream.Write([]byte("S")); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("unexpected events: %+v", got)
+	}
+}
@@ -2,7 +2,12 @@ package grproxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"sync"
+	"time"
 )
 
 type reader func(b []byte) (int, error)
@@ -17,25 +22,134 @@ func (w writer) Write(b []byte) (int, error) {
 	return w(b)
 }
 
+// CloseError is returned by a receiver when the peer closed its direction of
+// the tunnel for a reason other than EOF.
+type CloseError struct {
+	Reason  Close_Reason
+	Message string
+}
+
+func (e *CloseError) Error() string {
+	if e.Message == "" {
+		return "grproxy: peer closed: " + e.Reason.String()
+	}
+	return "grproxy: peer closed: " + e.Reason.String() + ": " + e.Message
+}
+
+var errUnexpectedControl = errors.New("grproxy: unexpected control frame")
+
+// newReceiver reads data frames as defined by protocol version 2: the length
+// is len(Buf), empty frames are keepalives and a close frame ends the stream.
+// Frames larger than the read buffer are returned over several reads.
 func newReceiver(recv func() (*ReadWrite, error)) io.Reader {
+	return &receiver{recv: recv}
+}
+
+// receiver implements io.WriterTo so that io.CopyBuffer writes the received
+// payload straight to the destination instead of copying it into its buffer.
+type receiver struct {
+	recv    func() (*ReadWrite, error)
+	pending []byte
+	err     error
+}
+
+// fill receives frames until there is data pending or an error.
+func (r *receiver) fill() error {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return r.err
+		}
+
+		var rw *ReadWrite
+		rw, r.err = r.recv()
+		if r.err != nil {
+			return r.err
+		}
+		switch control := rw.Control.(type) {
+		case nil:
+			r.pending = rw.Buf
+		case *ReadWrite_Close:
+			if control.Close.Reason == Close_EOF {
+				r.err = io.EOF
+			} else {
+				r.err = &CloseError{Reason: control.Close.Reason, Message: control.Close.Message}
+			}
+		default:
+			r.err = errUnexpectedControl
+		}
+	}
+	return nil
+}
+
+func (r *receiver) Read(b []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *receiver) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for {
+		if err := r.fill(); err != nil {
+			if err == io.EOF {
+				return written, nil
+			}
+			return written, err
+		}
+
+		n, err := w.Write(r.pending)
+		written += int64(n)
+		r.pending = r.pending[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// newLegacyReceiver reads data frames of peers older than protocol version 2,
+// which take the length from Len.
+func newLegacyReceiver(recv func() (*ReadWrite, error)) io.Reader {
 	return reader(func(b []byte) (int, error) {
 		req, err := recv()
 		if err != nil {
 			return 0, err
 		}
+		if req.Len < 0 || int(req.Len) > len(req.Buf) {
+			return 0, fmt.Errorf("grproxy: invalid frame length %d for %d bytes", req.Len, len(req.Buf))
+		}
 
 		n := copy(b, req.Buf[0:req.Len])
 		return n, nil
 	})
 }
 
+// receiverFor returns the receiver for the negotiated protocol version.
+func receiverFor(version uint32, recv func() (*ReadWrite, error)) io.Reader {
+	if version < 2 {
+		return newLegacyReceiver(recv)
+	}
+	return newReceiver(recv)
+}
+
+var framePool = sync.Pool{
+	New: func() interface{} { return new(ReadWrite) },
+}
+
+// newSender sends every write as a data frame. The frames are pooled, so send
+// must not retain them after it returns, which gRPC streams don't.
 func newSender(send func(*ReadWrite) error) io.Writer {
 	return writer(func(b []byte) (int, error) {
 		n := len(b)
-		if err := send(&ReadWrite{
-			Buf: b,
-			Len: int32(n),
-		}); err != nil {
+		rw := framePool.Get().(*ReadWrite)
+		rw.Buf, rw.Len = b, int32(n)
+		err := send(rw)
+		rw.Reset()
+		framePool.Put(rw)
+		if err != nil {
 			return 0, err
 		}
 
@@ -43,19 +157,60 @@ func newSender(send func(*ReadWrite) error) io.Writer {
 	})
 }
 
-func proxy(ctx context.Context, w io.Writer, r io.Reader, b []byte) error {
-	ch := make(chan error)
+// proxy copies r to w until EOF, an error or ctx is done. One of w and r
+// writes to or reads from conn. When ctx is done first, the deadline of conn
+// is expired to interrupt the copy, since conns ignore contexts. A copy blocked
+// on a gRPC stream returns when the stream ends, which follows the end of the
+// tunnel. Either way, the copy goroutine does not outlive the tunnel.
+func proxy(ctx context.Context, conn net.Conn, w io.Writer, r io.Reader, b []byte) error {
+	// Buffered, so that the copy goroutine can end after proxy returned.
+	ch := make(chan error, 1)
 
 	go func() {
-		defer close(ch)
 		_, err := io.CopyBuffer(w, r, b)
 		ch <- err
 	}()
 
 	select {
 	case <-ctx.Done():
+		if conn != nil {
+			conn.SetDeadline(aLongTimeAgo)
+		}
 		return ctx.Err()
 	case err := <-ch:
 		return err
 	}
 }
+
+// aLongTimeAgo is a deadline that has already passed.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// sendClose tells the peer that no more data follows. err is the reason the
+// direction ended, nil for EOF.
+func sendClose(send func(*ReadWrite) error, err error) error {
+	return send(closeFrame(err))
+}
+
+// closeFrame returns the close frame for err. A CloseError received from
+// the next hop of a chain is passed on as is.
+func closeFrame(err error) *ReadWrite {
+	c := &Close{Reason: Close_EOF}
+	ce, isClose := err.(*CloseError)
+	switch {
+	case isClose:
+		c.Reason, c.Message = ce.Reason, ce.Message
+	case err == context.Canceled:
+		c.Reason = Close_CANCELED
+	case err != nil:
+		c.Reason = Close_ERROR
+		c.Message = err.Error()
+	}
+	return &ReadWrite{Control: &ReadWrite_Close{Close: c}}
+}
+
+// closeWrite half-closes conn when it supports it, so the other side sees EOF.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
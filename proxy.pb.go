@@ -25,12 +25,83 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+type Encoding int32
+
+const (
+	Encoding_IDENTITY Encoding = 0
+	Encoding_GZIP     Encoding = 1
+	Encoding_SNAPPY   Encoding = 2
+	Encoding_ZSTD     Encoding = 3
+)
+
+var Encoding_name = map[int32]string{
+	0: "IDENTITY",
+	1: "GZIP",
+	2: "SNAPPY",
+	3: "ZSTD",
+}
+
+var Encoding_value = map[string]int32{
+	"IDENTITY": 0,
+	"GZIP":     1,
+	"SNAPPY":   2,
+	"ZSTD":     3,
+}
+
+func (x Encoding) String() string {
+	return proto.EnumName(Encoding_name, int32(x))
+}
+
+func (Encoding) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{0}
+}
+
+type Close_Reason int32
+
+const (
+	Close_EOF      Close_Reason = 0
+	Close_ERROR    Close_Reason = 1
+	Close_CANCELED Close_Reason = 2
+)
+
+var Close_Reason_name = map[int32]string{
+	0: "EOF",
+	1: "ERROR",
+	2: "CANCELED",
+}
+
+var Close_Reason_value = map[string]int32{
+	"EOF":      0,
+	"ERROR":    1,
+	"CANCELED": 2,
+}
+
+func (x Close_Reason) String() string {
+	return proto.EnumName(Close_Reason_name, int32(x))
+}
+
+func (Close_Reason) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{5, 0}
+}
+
 type ReadWrite struct {
-	Buf                  []byte   `protobuf:"bytes,1,opt,name=buf,proto3" json:"buf,omitempty"`
-	Len                  int32    `protobuf:"varint,2,opt,name=len,proto3" json:"len,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Buf []byte `protobuf:"bytes,1,opt,name=buf,proto3" json:"buf,omitempty"`
+	Len int32  `protobuf:"varint,2,opt,name=len,proto3" json:"len,omitempty"` // Deprecated: Do not use.
+	// Types that are valid to be assigned to Control:
+	//	*ReadWrite_Hello
+	//	*ReadWrite_Accept
+	//	*ReadWrite_Reject
+	//	*ReadWrite_Close
+	//	*ReadWrite_Resume
+	//	*ReadWrite_Ping
+	//	*ReadWrite_Pong
+	Control              isReadWrite_Control `protobuf_oneof:"control"`
+	Encoding             Encoding            `protobuf:"varint,7,opt,name=encoding,proto3,enum=main.Encoding" json:"encoding,omitempty"`
+	Seq                  uint64              `protobuf:"varint,8,opt,name=seq,proto3" json:"seq,omitempty"`
+	Ack                  uint64              `protobuf:"varint,9,opt,name=ack,proto3" json:"ack,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}            `json:"-"`
+	XXX_unrecognized     []byte              `json:"-"`
+	XXX_sizecache        int32               `json:"-"`
 }
 
 func (m *ReadWrite) Reset()         { *m = ReadWrite{} }
@@ -65,6 +136,7 @@ func (m *ReadWrite) GetBuf() []byte {
 	return nil
 }
 
+// Deprecated: Do not use.
 func (m *ReadWrite) GetLen() int32 {
 	if m != nil {
 		return m.Len
@@ -72,23 +144,795 @@ func (m *ReadWrite) GetLen() int32 {
 	return 0
 }
 
+type isReadWrite_Control interface {
+	isReadWrite_Control()
+}
+
+type ReadWrite_Hello struct {
+	Hello *Hello `protobuf:"bytes,3,opt,name=hello,proto3,oneof"`
+}
+
+type ReadWrite_Accept struct {
+	Accept *Accept `protobuf:"bytes,4,opt,name=accept,proto3,oneof"`
+}
+
+type ReadWrite_Reject struct {
+	Reject *Reject `protobuf:"bytes,5,opt,name=reject,proto3,oneof"`
+}
+
+type ReadWrite_Close struct {
+	Close *Close `protobuf:"bytes,6,opt,name=close,proto3,oneof"`
+}
+
+type ReadWrite_Resume struct {
+	Resume *Resume `protobuf:"bytes,10,opt,name=resume,proto3,oneof"`
+}
+
+type ReadWrite_Ping struct {
+	Ping *Ping `protobuf:"bytes,11,opt,name=ping,proto3,oneof"`
+}
+
+type ReadWrite_Pong struct {
+	Pong *Pong `protobuf:"bytes,12,opt,name=pong,proto3,oneof"`
+}
+
+func (*ReadWrite_Hello) isReadWrite_Control() {}
+
+func (*ReadWrite_Accept) isReadWrite_Control() {}
+
+func (*ReadWrite_Reject) isReadWrite_Control() {}
+
+func (*ReadWrite_Close) isReadWrite_Control() {}
+
+func (*ReadWrite_Resume) isReadWrite_Control() {}
+
+func (*ReadWrite_Ping) isReadWrite_Control() {}
+
+func (*ReadWrite_Pong) isReadWrite_Control() {}
+
+func (m *ReadWrite) GetControl() isReadWrite_Control {
+	if m != nil {
+		return m.Control
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetHello() *Hello {
+	if x, ok := m.GetControl().(*ReadWrite_Hello); ok {
+		return x.Hello
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetAccept() *Accept {
+	if x, ok := m.GetControl().(*ReadWrite_Accept); ok {
+		return x.Accept
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetReject() *Reject {
+	if x, ok := m.GetControl().(*ReadWrite_Reject); ok {
+		return x.Reject
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetClose() *Close {
+	if x, ok := m.GetControl().(*ReadWrite_Close); ok {
+		return x.Close
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetResume() *Resume {
+	if x, ok := m.GetControl().(*ReadWrite_Resume); ok {
+		return x.Resume
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetPing() *Ping {
+	if x, ok := m.GetControl().(*ReadWrite_Ping); ok {
+		return x.Ping
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetPong() *Pong {
+	if x, ok := m.GetControl().(*ReadWrite_Pong); ok {
+		return x.Pong
+	}
+	return nil
+}
+
+func (m *ReadWrite) GetEncoding() Encoding {
+	if m != nil {
+		return m.Encoding
+	}
+	return Encoding_IDENTITY
+}
+
+func (m *ReadWrite) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *ReadWrite) GetAck() uint64 {
+	if m != nil {
+		return m.Ack
+	}
+	return 0
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*ReadWrite) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*ReadWrite_Hello)(nil),
+		(*ReadWrite_Accept)(nil),
+		(*ReadWrite_Reject)(nil),
+		(*ReadWrite_Close)(nil),
+		(*ReadWrite_Resume)(nil),
+		(*ReadWrite_Ping)(nil),
+		(*ReadWrite_Pong)(nil),
+	}
+}
+
+type Hello struct {
+	Version              uint32      `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Target               string      `protobuf:"bytes,2,opt,name=target,proto3" json:"target,omitempty"`
+	Capabilities         []string    `protobuf:"bytes,3,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	Client               *ClientInfo `protobuf:"bytes,4,opt,name=client,proto3" json:"client,omitempty"`
+	TunnelId             string      `protobuf:"bytes,5,opt,name=tunnel_id,json=tunnelId,proto3" json:"tunnel_id,omitempty"`
+	SourceAddr           string      `protobuf:"bytes,6,opt,name=source_addr,json=sourceAddr,proto3" json:"source_addr,omitempty"`
+	DestinationAddr      string      `protobuf:"bytes,7,opt,name=destination_addr,json=destinationAddr,proto3" json:"destination_addr,omitempty"`
+	Hops                 []string    `protobuf:"bytes,8,rep,name=hops,proto3" json:"hops,omitempty"`
+	Via                  []string    `protobuf:"bytes,9,rep,name=via,proto3" json:"via,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
+}
+
+func (m *Hello) Reset()         { *m = Hello{} }
+func (m *Hello) String() string { return proto.CompactTextString(m) }
+func (*Hello) ProtoMessage()    {}
+func (*Hello) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{1}
+}
+
+func (m *Hello) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Hello.Unmarshal(m, b)
+}
+func (m *Hello) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Hello.Marshal(b, m, deterministic)
+}
+func (m *Hello) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Hello.Merge(m, src)
+}
+func (m *Hello) XXX_Size() int {
+	return xxx_messageInfo_Hello.Size(m)
+}
+func (m *Hello) XXX_DiscardUnknown() {
+	xxx_messageInfo_Hello.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Hello proto.InternalMessageInfo
+
+func (m *Hello) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Hello) GetTarget() string {
+	if m != nil {
+		return m.Target
+	}
+	return ""
+}
+
+func (m *Hello) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+func (m *Hello) GetClient() *ClientInfo {
+	if m != nil {
+		return m.Client
+	}
+	return nil
+}
+
+func (m *Hello) GetTunnelId() string {
+	if m != nil {
+		return m.TunnelId
+	}
+	return ""
+}
+
+func (m *Hello) GetSourceAddr() string {
+	if m != nil {
+		return m.SourceAddr
+	}
+	return ""
+}
+
+func (m *Hello) GetDestinationAddr() string {
+	if m != nil {
+		return m.DestinationAddr
+	}
+	return ""
+}
+
+func (m *Hello) GetHops() []string {
+	if m != nil {
+		return m.Hops
+	}
+	return nil
+}
+
+func (m *Hello) GetVia() []string {
+	if m != nil {
+		return m.Via
+	}
+	return nil
+}
+
+type ClientInfo struct {
+	Name                 string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Version              string   `protobuf:"bytes,2,opt,name=version,proto3" json:"version,omitempty"`
+	Hostname             string   `protobuf:"bytes,3,opt,name=hostname,proto3" json:"hostname,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ClientInfo) Reset()         { *m = ClientInfo{} }
+func (m *ClientInfo) String() string { return proto.CompactTextString(m) }
+func (*ClientInfo) ProtoMessage()    {}
+func (*ClientInfo) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{2}
+}
+
+func (m *ClientInfo) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ClientInfo.Unmarshal(m, b)
+}
+func (m *ClientInfo) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ClientInfo.Marshal(b, m, deterministic)
+}
+func (m *ClientInfo) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ClientInfo.Merge(m, src)
+}
+func (m *ClientInfo) XXX_Size() int {
+	return xxx_messageInfo_ClientInfo.Size(m)
+}
+func (m *ClientInfo) XXX_DiscardUnknown() {
+	xxx_messageInfo_ClientInfo.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ClientInfo proto.InternalMessageInfo
+
+func (m *ClientInfo) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *ClientInfo) GetVersion() string {
+	if m != nil {
+		return m.Version
+	}
+	return ""
+}
+
+func (m *ClientInfo) GetHostname() string {
+	if m != nil {
+		return m.Hostname
+	}
+	return ""
+}
+
+type Accept struct {
+	Version              uint32   `protobuf:"varint,1,opt,name=version,proto3" json:"version,omitempty"`
+	Capabilities         []string `protobuf:"bytes,2,rep,name=capabilities,proto3" json:"capabilities,omitempty"`
+	RemoteAddr           string   `protobuf:"bytes,3,opt,name=remote_addr,json=remoteAddr,proto3" json:"remote_addr,omitempty"`
+	SessionId            string   `protobuf:"bytes,4,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Accept) Reset()         { *m = Accept{} }
+func (m *Accept) String() string { return proto.CompactTextString(m) }
+func (*Accept) ProtoMessage()    {}
+func (*Accept) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{3}
+}
+
+func (m *Accept) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Accept.Unmarshal(m, b)
+}
+func (m *Accept) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Accept.Marshal(b, m, deterministic)
+}
+func (m *Accept) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Accept.Merge(m, src)
+}
+func (m *Accept) XXX_Size() int {
+	return xxx_messageInfo_Accept.Size(m)
+}
+func (m *Accept) XXX_DiscardUnknown() {
+	xxx_messageInfo_Accept.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Accept proto.InternalMessageInfo
+
+func (m *Accept) GetVersion() uint32 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
+func (m *Accept) GetCapabilities() []string {
+	if m != nil {
+		return m.Capabilities
+	}
+	return nil
+}
+
+func (m *Accept) GetRemoteAddr() string {
+	if m != nil {
+		return m.RemoteAddr
+	}
+	return ""
+}
+
+func (m *Accept) GetSessionId() string {
+	if m != nil {
+		return m.SessionId
+	}
+	return ""
+}
+
+type Reject struct {
+	Code                 uint32   `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message              string   `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Reject) Reset()         { *m = Reject{} }
+func (m *Reject) String() string { return proto.CompactTextString(m) }
+func (*Reject) ProtoMessage()    {}
+func (*Reject) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{4}
+}
+
+func (m *Reject) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Reject.Unmarshal(m, b)
+}
+func (m *Reject) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Reject.Marshal(b, m, deterministic)
+}
+func (m *Reject) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Reject.Merge(m, src)
+}
+func (m *Reject) XXX_Size() int {
+	return xxx_messageInfo_Reject.Size(m)
+}
+func (m *Reject) XXX_DiscardUnknown() {
+	xxx_messageInfo_Reject.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Reject proto.InternalMessageInfo
+
+func (m *Reject) GetCode() uint32 {
+	if m != nil {
+		return m.Code
+	}
+	return 0
+}
+
+func (m *Reject) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+type Close struct {
+	Reason               Close_Reason `protobuf:"varint,1,opt,name=reason,proto3,enum=main.Close_Reason" json:"reason,omitempty"`
+	Message              string       `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}     `json:"-"`
+	XXX_unrecognized     []byte       `json:"-"`
+	XXX_sizecache        int32        `json:"-"`
+}
+
+func (m *Close) Reset()         { *m = Close{} }
+func (m *Close) String() string { return proto.CompactTextString(m) }
+func (*Close) ProtoMessage()    {}
+func (*Close) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{5}
+}
+
+func (m *Close) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Close.Unmarshal(m, b)
+}
+func (m *Close) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Close.Marshal(b, m, deterministic)
+}
+func (m *Close) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Close.Merge(m, src)
+}
+func (m *Close) XXX_Size() int {
+	return xxx_messageInfo_Close.Size(m)
+}
+func (m *Close) XXX_DiscardUnknown() {
+	xxx_messageInfo_Close.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Close proto.InternalMessageInfo
+
+func (m *Close) GetReason() Close_Reason {
+	if m != nil {
+		return m.Reason
+	}
+	return Close_EOF
+}
+
+func (m *Close) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
+type Resume struct {
+	SessionId            string   `protobuf:"bytes,1,opt,name=session_id,json=sessionId,proto3" json:"session_id,omitempty"`
+	Ack                  uint64   `protobuf:"varint,2,opt,name=ack,proto3" json:"ack,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Resume) Reset()         { *m = Resume{} }
+func (m *Resume) String() string { return proto.CompactTextString(m) }
+func (*Resume) ProtoMessage()    {}
+func (*Resume) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{6}
+}
+
+func (m *Resume) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Resume.Unmarshal(m, b)
+}
+func (m *Resume) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Resume.Marshal(b, m, deterministic)
+}
+func (m *Resume) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Resume.Merge(m, src)
+}
+func (m *Resume) XXX_Size() int {
+	return xxx_messageInfo_Resume.Size(m)
+}
+func (m *Resume) XXX_DiscardUnknown() {
+	xxx_messageInfo_Resume.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Resume proto.InternalMessageInfo
+
+func (m *Resume) GetSessionId() string {
+	if m != nil {
+		return m.SessionId
+	}
+	return ""
+}
+
+func (m *Resume) GetAck() uint64 {
+	if m != nil {
+		return m.Ack
+	}
+	return 0
+}
+
+type Ping struct {
+	Id                   uint64   `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Ping) Reset()         { *m = Ping{} }
+func (m *Ping) String() string { return proto.CompactTextString(m) }
+func (*Ping) ProtoMessage()    {}
+func (*Ping) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{7}
+}
+
+func (m *Ping) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Ping.Unmarshal(m, b)
+}
+func (m *Ping) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Ping.Marshal(b, m, deterministic)
+}
+func (m *Ping) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Ping.Merge(m, src)
+}
+func (m *Ping) XXX_Size() int {
+	return xxx_messageInfo_Ping.Size(m)
+}
+func (m *Ping) XXX_DiscardUnknown() {
+	xxx_messageInfo_Ping.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Ping proto.InternalMessageInfo
+
+func (m *Ping) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+type Pong struct {
+	Id                   uint64   `protobuf:"varint,1,opt,name=id,proto3" json:"id,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Pong) Reset()         { *m = Pong{} }
+func (m *Pong) String() string { return proto.CompactTextString(m) }
+func (*Pong) ProtoMessage()    {}
+func (*Pong) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{8}
+}
+
+func (m *Pong) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Pong.Unmarshal(m, b)
+}
+func (m *Pong) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Pong.Marshal(b, m, deterministic)
+}
+func (m *Pong) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Pong.Merge(m, src)
+}
+func (m *Pong) XXX_Size() int {
+	return xxx_messageInfo_Pong.Size(m)
+}
+func (m *Pong) XXX_DiscardUnknown() {
+	xxx_messageInfo_Pong.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Pong proto.InternalMessageInfo
+
+func (m *Pong) GetId() uint64 {
+	if m != nil {
+		return m.Id
+	}
+	return 0
+}
+
+type StreamHeader struct {
+	Method               string           `protobuf:"bytes,1,opt,name=method,proto3" json:"method,omitempty"`
+	Metadata             []*MetadataEntry `protobuf:"bytes,2,rep,name=metadata,proto3" json:"metadata,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
+	XXX_unrecognized     []byte           `json:"-"`
+	XXX_sizecache        int32            `json:"-"`
+}
+
+func (m *StreamHeader) Reset()         { *m = StreamHeader{} }
+func (m *StreamHeader) String() string { return proto.CompactTextString(m) }
+func (*StreamHeader) ProtoMessage()    {}
+func (*StreamHeader) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{9}
+}
+
+func (m *StreamHeader) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamHeader.Unmarshal(m, b)
+}
+func (m *StreamHeader) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamHeader.Marshal(b, m, deterministic)
+}
+func (m *StreamHeader) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamHeader.Merge(m, src)
+}
+func (m *StreamHeader) XXX_Size() int {
+	return xxx_messageInfo_StreamHeader.Size(m)
+}
+func (m *StreamHeader) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamHeader.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamHeader proto.InternalMessageInfo
+
+func (m *StreamHeader) GetMethod() string {
+	if m != nil {
+		return m.Method
+	}
+	return ""
+}
+
+func (m *StreamHeader) GetMetadata() []*MetadataEntry {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+type MetadataEntry struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Values               []string `protobuf:"bytes,2,rep,name=values,proto3" json:"values,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MetadataEntry) Reset()         { *m = MetadataEntry{} }
+func (m *MetadataEntry) String() string { return proto.CompactTextString(m) }
+func (*MetadataEntry) ProtoMessage()    {}
+func (*MetadataEntry) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{10}
+}
+
+func (m *MetadataEntry) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MetadataEntry.Unmarshal(m, b)
+}
+func (m *MetadataEntry) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MetadataEntry.Marshal(b, m, deterministic)
+}
+func (m *MetadataEntry) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetadataEntry.Merge(m, src)
+}
+func (m *MetadataEntry) XXX_Size() int {
+	return xxx_messageInfo_MetadataEntry.Size(m)
+}
+func (m *MetadataEntry) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetadataEntry.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetadataEntry proto.InternalMessageInfo
+
+func (m *MetadataEntry) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *MetadataEntry) GetValues() []string {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+type StreamStatus struct {
+	Code                 uint32   `protobuf:"varint,1,opt,name=code,proto3" json:"code,omitempty"`
+	Message              string   `protobuf:"bytes,2,opt,name=message,proto3" json:"message,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StreamStatus) Reset()         { *m = StreamStatus{} }
+func (m *StreamStatus) String() string { return proto.CompactTextString(m) }
+func (*StreamStatus) ProtoMessage()    {}
+func (*StreamStatus) Descriptor() ([]byte, []int) {
+	return fileDescriptor_700b50b08ed8dbaf, []int{11}
+}
+
+func (m *StreamStatus) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StreamStatus.Unmarshal(m, b)
+}
+func (m *StreamStatus) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StreamStatus.Marshal(b, m, deterministic)
+}
+func (m *StreamStatus) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StreamStatus.Merge(m, src)
+}
+func (m *StreamStatus) XXX_Size() int {
+	return xxx_messageInfo_StreamStatus.Size(m)
+}
+func (m *StreamStatus) XXX_DiscardUnknown() {
+	xxx_messageInfo_StreamStatus.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StreamStatus proto.InternalMessageInfo
+
+func (m *StreamStatus) GetCode() uint32 {
+	if m != nil {
+		return m.Code
+	}
+	return 0
+}
+
+func (m *StreamStatus) GetMessage() string {
+	if m != nil {
+		return m.Message
+	}
+	return ""
+}
+
 func init() {
+	proto.RegisterEnum("main.Encoding", Encoding_name, Encoding_value)
+	proto.RegisterEnum("main.Close_Reason", Close_Reason_name, Close_Reason_value)
 	proto.RegisterType((*ReadWrite)(nil), "main.ReadWrite")
+	proto.RegisterType((*Hello)(nil), "main.Hello")
+	proto.RegisterType((*ClientInfo)(nil), "main.ClientInfo")
+	proto.RegisterType((*Accept)(nil), "main.Accept")
+	proto.RegisterType((*Reject)(nil), "main.Reject")
+	proto.RegisterType((*Close)(nil), "main.Close")
+	proto.RegisterType((*Resume)(nil), "main.Resume")
+	proto.RegisterType((*Ping)(nil), "main.Ping")
+	proto.RegisterType((*Pong)(nil), "main.Pong")
+	proto.RegisterType((*StreamHeader)(nil), "main.StreamHeader")
+	proto.RegisterType((*MetadataEntry)(nil), "main.MetadataEntry")
+	proto.RegisterType((*StreamStatus)(nil), "main.StreamStatus")
 }
 
 func init() { proto.RegisterFile("proxy.proto", fileDescriptor_700b50b08ed8dbaf) }
 
 var fileDescriptor_700b50b08ed8dbaf = []byte{
-	// 133 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2e, 0x28, 0xca, 0xaf,
-	0xa8, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0xc9, 0x4d, 0xcc, 0xcc, 0x53, 0xd2, 0xe7,
-	0xe2, 0x0c, 0x4a, 0x4d, 0x4c, 0x09, 0x2f, 0xca, 0x2c, 0x49, 0x15, 0x12, 0xe0, 0x62, 0x4e, 0x2a,
-	0x4d, 0x93, 0x60, 0x54, 0x60, 0xd4, 0xe0, 0x09, 0x02, 0x31, 0x41, 0x22, 0x39, 0xa9, 0x79, 0x12,
-	0x4c, 0x0a, 0x8c, 0x1a, 0xac, 0x41, 0x20, 0xa6, 0x91, 0x23, 0x17, 0x4f, 0x00, 0xc8, 0x94, 0xe0,
-	0xd4, 0xa2, 0xb2, 0xcc, 0xe4, 0x54, 0x21, 0x43, 0x2e, 0x76, 0xe7, 0xfc, 0xbc, 0xbc, 0xd4, 0xe4,
-	0x12, 0x21, 0x7e, 0x3d, 0x90, 0x91, 0x7a, 0x70, 0xf3, 0xa4, 0xd0, 0x05, 0x94, 0x18, 0x34, 0x18,
-	0x0d, 0x18, 0x93, 0xd8, 0xc0, 0x0e, 0x30, 0x06, 0x04, 0x00, 0x00, 0xff, 0xff, 0x8e, 0xa3, 0xc9,
-	0xcc, 0x8f, 0x00, 0x00, 0x00,
+	// 813 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x55, 0x6d, 0x8f, 0xdb, 0x44,
+	0x10, 0x8e, 0x5f, 0x92, 0xd8, 0x93, 0xf4, 0x6a, 0x2d, 0xa8, 0xb2, 0x8a, 0x50, 0x23, 0x23, 0xa1,
+	0x70, 0x1f, 0x0e, 0x08, 0x12, 0xa2, 0x12, 0x5f, 0xee, 0x25, 0x90, 0x48, 0x70, 0x8d, 0x36, 0x27,
+	0xaa, 0xde, 0x97, 0x6a, 0xcf, 0x9e, 0x26, 0xe6, 0x9c, 0xdd, 0x60, 0x6f, 0x4e, 0xdc, 0x1f, 0xe0,
+	0x17, 0x20, 0x7e, 0x2f, 0x9a, 0xdd, 0xf5, 0x91, 0x9c, 0xaa, 0x8a, 0x7e, 0x9b, 0x79, 0xe6, 0xf1,
+	0xec, 0xcc, 0x33, 0x3b, 0x6b, 0x18, 0x6c, 0x6b, 0xf5, 0xe7, 0xfd, 0xc9, 0xb6, 0x56, 0x5a, 0xb1,
+	0x70, 0x23, 0x4a, 0x99, 0xfd, 0x1d, 0x40, 0xcc, 0x51, 0x14, 0xaf, 0xeb, 0x52, 0x23, 0x4b, 0x20,
+	0xb8, 0xd9, 0xbd, 0x4b, 0xbd, 0x91, 0x37, 0x1e, 0x72, 0x32, 0xd9, 0xa7, 0x10, 0x54, 0x28, 0x53,
+	0x7f, 0xe4, 0x8d, 0xbb, 0x67, 0x7e, 0xea, 0x71, 0x72, 0xd9, 0x17, 0xd0, 0x5d, 0x63, 0x55, 0xa9,
+	0x34, 0x18, 0x79, 0xe3, 0xc1, 0x64, 0x70, 0x42, 0xb9, 0x4e, 0x66, 0x04, 0xcd, 0x3a, 0xdc, 0xc6,
+	0xd8, 0x97, 0xd0, 0x13, 0x79, 0x8e, 0x5b, 0x9d, 0x86, 0x86, 0x35, 0xb4, 0xac, 0x53, 0x83, 0xcd,
+	0x3a, 0xdc, 0x45, 0x89, 0x57, 0xe3, 0xef, 0x98, 0xeb, 0xb4, 0xbb, 0xcf, 0xe3, 0x06, 0x23, 0x9e,
+	0x8d, 0xd2, 0xa1, 0x79, 0xa5, 0x1a, 0x4c, 0x7b, 0xfb, 0x87, 0x9e, 0x13, 0x44, 0x87, 0x9a, 0x98,
+	0x4d, 0xd6, 0xec, 0x36, 0x98, 0xc2, 0x61, 0x32, 0xc2, 0x6c, 0x32, 0xb2, 0xd8, 0x08, 0xc2, 0x6d,
+	0x29, 0x57, 0xe9, 0xc0, 0xb0, 0xc0, 0xb2, 0x16, 0xa5, 0x5c, 0xcd, 0x3a, 0xdc, 0x44, 0x0c, 0x43,
+	0xc9, 0x55, 0x3a, 0x3c, 0x60, 0x28, 0xc7, 0x50, 0x72, 0xc5, 0x8e, 0x21, 0x42, 0x99, 0xab, 0x82,
+	0xf2, 0xf4, 0x47, 0xde, 0xf8, 0x68, 0x72, 0x64, 0x59, 0x53, 0x87, 0xf2, 0x87, 0x38, 0x29, 0xdb,
+	0xe0, 0x1f, 0x69, 0x34, 0xf2, 0xc6, 0x21, 0x27, 0x93, 0x10, 0x91, 0xdf, 0xa6, 0xb1, 0x45, 0x44,
+	0x7e, 0x7b, 0x16, 0x43, 0x3f, 0x57, 0x52, 0xd7, 0xaa, 0xca, 0xfe, 0xf1, 0xa1, 0x6b, 0xe4, 0x64,
+	0x29, 0xf4, 0xef, 0xb0, 0x6e, 0x4a, 0x25, 0xcd, 0x58, 0x9e, 0xf0, 0xd6, 0x65, 0xcf, 0xa0, 0xa7,
+	0x45, 0xbd, 0x42, 0x6d, 0xa6, 0x13, 0x73, 0xe7, 0xb1, 0x0c, 0x86, 0xb9, 0xd8, 0x8a, 0x9b, 0xb2,
+	0x2a, 0x75, 0x89, 0x4d, 0x1a, 0x8c, 0x82, 0x71, 0xcc, 0x0f, 0x30, 0x36, 0x86, 0x5e, 0x5e, 0x95,
+	0x28, 0xdb, 0xd9, 0x24, 0xad, 0x98, 0x84, 0xcd, 0xe5, 0x3b, 0xc5, 0x5d, 0x9c, 0x7d, 0x06, 0xb1,
+	0xde, 0x49, 0x89, 0xd5, 0xdb, 0xb2, 0x30, 0x03, 0x8a, 0x79, 0x64, 0x81, 0x79, 0xc1, 0x5e, 0xc0,
+	0xa0, 0x51, 0xbb, 0x3a, 0xc7, 0xb7, 0xa2, 0x28, 0x6a, 0x33, 0x98, 0x98, 0x83, 0x85, 0x4e, 0x8b,
+	0xa2, 0x66, 0x5f, 0x41, 0x52, 0x60, 0xa3, 0x4b, 0x29, 0x74, 0xa9, 0xa4, 0x65, 0xf5, 0x0d, 0xeb,
+	0xe9, 0x1e, 0x6e, 0xa8, 0x0c, 0xc2, 0xb5, 0xda, 0x36, 0x69, 0x64, 0xca, 0x35, 0x36, 0x69, 0x74,
+	0x57, 0x8a, 0x34, 0x36, 0x10, 0x99, 0xd9, 0x6f, 0x00, 0xff, 0x15, 0x49, 0xdf, 0x48, 0xb1, 0x41,
+	0xa3, 0x4c, 0xcc, 0x8d, 0xbd, 0x2f, 0x98, 0xd5, 0xa5, 0x75, 0xd9, 0x73, 0x88, 0xd6, 0xaa, 0xd1,
+	0xe6, 0x8b, 0xc0, 0x76, 0xd2, 0xfa, 0xd9, 0x5f, 0x1e, 0xf4, 0xec, 0xcd, 0xfc, 0x80, 0xe2, 0x8f,
+	0x95, 0xf5, 0xdf, 0xa3, 0xec, 0x0b, 0x18, 0xd4, 0xb8, 0x51, 0xda, 0x49, 0x62, 0xcf, 0x01, 0x0b,
+	0x99, 0x3e, 0x3f, 0x07, 0x68, 0xb0, 0xa1, 0x7c, 0xa4, 0x68, 0x68, 0xe2, 0xb1, 0x43, 0xe6, 0x45,
+	0xf6, 0x3d, 0xf4, 0xec, 0xcd, 0xa7, 0xe6, 0x72, 0x55, 0xa0, 0x2b, 0xc2, 0xd8, 0x54, 0xdb, 0x06,
+	0x9b, 0x46, 0xac, 0xb0, 0x6d, 0xce, 0xb9, 0xd9, 0x3d, 0x74, 0xcd, 0x2a, 0xb0, 0x63, 0xda, 0x00,
+	0xd1, 0xb8, 0xea, 0x8f, 0x26, 0x6c, 0x6f, 0x4f, 0x4e, 0xb8, 0x89, 0x70, 0xc7, 0xf8, 0x40, 0xba,
+	0x63, 0x2a, 0xc3, 0x70, 0xfa, 0x10, 0x4c, 0x5f, 0xfd, 0x94, 0x74, 0x58, 0x0c, 0xdd, 0x29, 0xe7,
+	0xaf, 0x78, 0xe2, 0xb1, 0x21, 0x44, 0xe7, 0xa7, 0x97, 0xe7, 0xd3, 0x5f, 0xa6, 0x17, 0x89, 0x9f,
+	0xbd, 0x24, 0xae, 0xd9, 0xaa, 0xc3, 0xde, 0xbc, 0x47, 0xbd, 0xb5, 0x57, 0xde, 0x7f, 0xb8, 0xf2,
+	0xd9, 0x33, 0x08, 0x69, 0xe9, 0xd8, 0x11, 0xf8, 0xee, 0x83, 0x90, 0xfb, 0x65, 0x61, 0x70, 0xf5,
+	0x1e, 0xfc, 0x35, 0x0c, 0x97, 0xba, 0x46, 0xb1, 0x99, 0xa1, 0x28, 0xb0, 0xa6, 0x1d, 0xd8, 0xa0,
+	0x5e, 0xab, 0xf6, 0x30, 0xe7, 0xb1, 0xaf, 0x21, 0xda, 0xa0, 0x16, 0x85, 0xd0, 0xc2, 0x4c, 0x69,
+	0x30, 0xf9, 0xc4, 0xca, 0xf0, 0xab, 0x43, 0xa7, 0x52, 0xd7, 0xf7, 0xfc, 0x81, 0x94, 0xbd, 0x84,
+	0x27, 0x07, 0x21, 0xaa, 0xf5, 0x16, 0xef, 0x5d, 0x5a, 0x32, 0xe9, 0xac, 0x3b, 0x51, 0xed, 0x1e,
+	0xe6, 0xee, 0xbc, 0xec, 0xc7, 0xb6, 0xa6, 0xa5, 0x16, 0x7a, 0xd7, 0x7c, 0xdc, 0xdc, 0x8e, 0x7f,
+	0x80, 0xa8, 0x7d, 0x2e, 0x48, 0xd6, 0xf9, 0xc5, 0xf4, 0xf2, 0x6a, 0x7e, 0xf5, 0x26, 0xe9, 0xb0,
+	0x08, 0xc2, 0x9f, 0xaf, 0xe7, 0x8b, 0xc4, 0x63, 0x00, 0xbd, 0xe5, 0xe5, 0xe9, 0x62, 0xf1, 0x26,
+	0xf1, 0x09, 0xbd, 0x5e, 0x5e, 0x5d, 0x24, 0xc1, 0x64, 0x07, 0xc3, 0x05, 0xbd, 0xe7, 0x4b, 0xac,
+	0xef, 0xca, 0x1c, 0xd9, 0xb7, 0xd0, 0x3f, 0x57, 0x52, 0xd2, 0xd5, 0x79, 0xda, 0xbe, 0x7a, 0xee,
+	0x61, 0x7f, 0xfe, 0x18, 0xc8, 0x3a, 0x63, 0xef, 0x1b, 0x8f, 0x4d, 0x20, 0xe2, 0x28, 0xb4, 0x16,
+	0xf9, 0xfa, 0xff, 0x7e, 0x73, 0x16, 0x5f, 0xf7, 0x57, 0xb5, 0xf9, 0x91, 0xdc, 0xf4, 0xcc, 0x9f,
+	0xe4, 0xbb, 0x7f, 0x07, 0x00, 0x86, 0x4b, 0xa6, 0x51, 0x58, 0x06, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -104,6 +948,7 @@ const _ = grpc.SupportPackageIsVersion4
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type ProxyServiceClient interface {
 	Connect(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ConnectClient, error)
+	Reattach(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ReattachClient, error)
 }
 
 type proxyServiceClient struct {
@@ -145,9 +990,41 @@ func (x *proxyServiceConnectClient) Recv() (*ReadWrite, error) {
 	return m, nil
 }
 
+func (c *proxyServiceClient) Reattach(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ReattachClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_ProxyService_serviceDesc.Streams[1], "/main.ProxyService/Reattach", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &proxyServiceReattachClient{stream}
+	return x, nil
+}
+
+type ProxyService_ReattachClient interface {
+	Send(*ReadWrite) error
+	Recv() (*ReadWrite, error)
+	grpc.ClientStream
+}
+
+type proxyServiceReattachClient struct {
+	grpc.ClientStream
+}
+
+func (x *proxyServiceReattachClient) Send(m *ReadWrite) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *proxyServiceReattachClient) Recv() (*ReadWrite, error) {
+	m := new(ReadWrite)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // ProxyServiceServer is the server API for ProxyService service.
 type ProxyServiceServer interface {
 	Connect(ProxyService_ConnectServer) error
+	Reattach(ProxyService_ReattachServer) error
 }
 
 // UnimplementedProxyServiceServer can be embedded to have forward compatible implementations.
@@ -157,6 +1034,9 @@ type UnimplementedProxyServiceServer struct {
 func (*UnimplementedProxyServiceServer) Connect(srv ProxyService_ConnectServer) error {
 	return status.Errorf(codes.Unimplemented, "method Connect not implemented")
 }
+func (*UnimplementedProxyServiceServer) Reattach(srv ProxyService_ReattachServer) error {
+	return status.Errorf(codes.Unimplemented, "method Reattach not implemented")
+}
 
 func RegisterProxyServiceServer(s *grpc.Server, srv ProxyServiceServer) {
 	s.RegisterService(&_ProxyService_serviceDesc, srv)
@@ -188,6 +1068,32 @@ func (x *proxyServiceConnectServer) Recv() (*ReadWrite, error) {
 	return m, nil
 }
 
+func _ProxyService_Reattach_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ProxyServiceServer).Reattach(&proxyServiceReattachServer{stream})
+}
+
+type ProxyService_ReattachServer interface {
+	Send(*ReadWrite) error
+	Recv() (*ReadWrite, error)
+	grpc.ServerStream
+}
+
+type proxyServiceReattachServer struct {
+	grpc.ServerStream
+}
+
+func (x *proxyServiceReattachServer) Send(m *ReadWrite) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *proxyServiceReattachServer) Recv() (*ReadWrite, error) {
+	m := new(ReadWrite)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 var _ProxyService_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "main.ProxyService",
 	HandlerType: (*ProxyServiceServer)(nil),
@@ -199,6 +1105,12 @@ var _ProxyService_serviceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Reattach",
+			Handler:       _ProxyService_Reattach_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "proxy.proto",
 }
@@ -5,8 +5,13 @@ import (
 	"context"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_receiver(t *testing.T) {
@@ -158,7 +163,7 @@ func Test_proxy(t *testing.T) {
 
 	for tn, tc := range tests {
 		t.Run(tn, func(t *testing.T) {
-			err := proxy(tc.args.ctx, tc.args.w, tc.args.r, make([]byte, 1024))
+			err := proxy(tc.args.ctx, nil, tc.args.w, tc.args.r, make([]byte, 1024))
 			if (err != nil) != tc.wantErr {
 				t.Fatal(err)
 			} else if err != nil {
@@ -173,3 +178,366 @@ func Test_proxy(t *testing.T) {
 		})
 	}
 }
+
+// frames returns a recv function that yields rws and then err.
+func frames(err error, rws ...*ReadWrite) func() (*ReadWrite, error) {
+	return func() (*ReadWrite, error) {
+		if len(rws) == 0 {
+			return nil, err
+		}
+		rw := rws[0]
+		rws = rws[1:]
+		return rw, nil
+	}
+}
+
+func data(s string) *ReadWrite {
+	return &ReadWrite{Buf: []byte(s), Len: int32(len(s))}
+}
+
+func readAll(r io.Reader, size int) ([]byte, error) {
+	var got []byte
+	b := make([]byte, size)
+	for {
+		n, err := r.Read(b)
+		got = append(got, b[:n]...)
+		if err != nil {
+			return got, err
+		}
+	}
+}
+
+type receiverTest struct {
+	frames  []*ReadWrite
+	err     error
+	want    []byte
+	wantErr error
+}
+
+func runReceiverTests(t *testing.T, newReceiver func(func() (*ReadWrite, error)) io.Reader, tests map[string]receiverTest) {
+	t.Helper()
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			r := newReceiver(frames(tc.err, tc.frames...))
+			got, err := readAll(r, 1024)
+			if !reflect.DeepEqual(err, tc.wantErr) {
+				t.Fatalf("unexpected error got:%v want:%v", err, tc.wantErr)
+			}
+			if !bytes.Equal(got, tc.want) {
+				t.Errorf("unexpected result got:%s want:%s", got, tc.want)
+			}
+		})
+	}
+}
+
+// receiverConformance lists the frames that the legacy and the version 2
+// receivers must handle identically.
+var receiverConformance = map[string]receiverTest{
+	"single frame": {
+		frames:  []*ReadWrite{data("abcde")},
+		err:     io.EOF,
+		want:    []byte("abcde"),
+		wantErr: io.EOF,
+	},
+	"multiple frames": {
+		frames:  []*ReadWrite{data("abc"), data("de")},
+		err:     io.EOF,
+		want:    []byte("abcde"),
+		wantErr: io.EOF,
+	},
+	"keepalive": {
+		frames:  []*ReadWrite{data("abc"), {}, data("de")},
+		err:     io.EOF,
+		want:    []byte("abcde"),
+		wantErr: io.EOF,
+	},
+	"no data": {
+		err:     io.EOF,
+		wantErr: io.EOF,
+	},
+	"recv error": {
+		frames:  []*ReadWrite{data("abc")},
+		err:     errTest,
+		want:    []byte("abc"),
+		wantErr: errTest,
+	},
+}
+
+var errTest = errors.New("error")
+
+func Test_receiverConformance(t *testing.T) {
+	t.Parallel()
+
+	t.Run("legacy", func(t *testing.T) {
+		runReceiverTests(t, newLegacyReceiver, receiverConformance)
+	})
+	t.Run("v2", func(t *testing.T) {
+		runReceiverTests(t, newReceiver, receiverConformance)
+	})
+}
+
+func Test_receiverV2(t *testing.T) {
+	t.Parallel()
+
+	runReceiverTests(t, newReceiver, map[string]receiverTest{
+		"len ignored": {
+			frames:  []*ReadWrite{{Buf: []byte("abcde"), Len: 2}},
+			err:     io.EOF,
+			want:    []byte("abcde"),
+			wantErr: io.EOF,
+		},
+		"frame larger than buffer": {
+			frames:  []*ReadWrite{data(string(bytes.Repeat([]byte("a"), 3000)))},
+			err:     io.EOF,
+			want:    bytes.Repeat([]byte("a"), 3000),
+			wantErr: io.EOF,
+		},
+		"close eof": {
+			frames: []*ReadWrite{
+				data("abc"),
+				{Control: &ReadWrite_Close{Close: &Close{Reason: Close_EOF}}},
+				data("ignored"),
+			},
+			err:     errTest,
+			want:    []byte("abc"),
+			wantErr: io.EOF,
+		},
+		"close error": {
+			frames: []*ReadWrite{
+				{Control: &ReadWrite_Close{Close: &Close{Reason: Close_ERROR, Message: "reset"}}},
+			},
+			err:     io.EOF,
+			wantErr: &CloseError{Reason: Close_ERROR, Message: "reset"},
+		},
+		"unexpected control": {
+			frames: []*ReadWrite{
+				{Control: &ReadWrite_Hello{Hello: &Hello{}}},
+			},
+			err:     io.EOF,
+			wantErr: errUnexpectedControl,
+		},
+	})
+}
+
+func Test_legacyReceiver(t *testing.T) {
+	t.Parallel()
+
+	runReceiverTests(t, newLegacyReceiver, map[string]receiverTest{
+		"len honored": {
+			frames:  []*ReadWrite{{Buf: []byte("abcde"), Len: 2}},
+			err:     io.EOF,
+			want:    []byte("ab"),
+			wantErr: io.EOF,
+		},
+		"len too large": {
+			frames:  []*ReadWrite{{Buf: []byte("abcde"), Len: 6}},
+			err:     io.EOF,
+			wantErr: errors.New("grproxy: invalid frame length 6 for 5 bytes"),
+		},
+	})
+}
+
+func Test_sendClose(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		err  error
+		want *Close
+	}{
+		"eof": {
+			want: &Close{Reason: Close_EOF},
+		},
+		"error": {
+			err:  errTest,
+			want: &Close{Reason: Close_ERROR, Message: "error"},
+		},
+		"canceled": {
+			err:  context.Canceled,
+			want: &Close{Reason: Close_CANCELED},
+		},
+		"peer closed": {
+			err:  &CloseError{Reason: Close_ERROR, Message: "reset"},
+			want: &Close{Reason: Close_ERROR, Message: "reset"},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			var got *ReadWrite
+			if err := sendClose(func(rw *ReadWrite) error {
+				got = rw
+				return nil
+			}, tc.err); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.GetClose(), tc.want) {
+				t.Errorf("unexpected close: %v", got)
+			}
+		})
+	}
+}
+
+// BenchmarkReceiver compares copying frames through the io.CopyBuffer buffer
+// with writing them straight to the destination.
+func BenchmarkReceiver(b *testing.B) {
+	rw := &ReadWrite{Buf: bytes.Repeat([]byte("a"), 4096), Len: 4096}
+	const frames = 256
+
+	recv := func() func() (*ReadWrite, error) {
+		n := 0
+		return func() (*ReadWrite, error) {
+			if n == frames {
+				return nil, io.EOF
+			}
+			n++
+			return rw, nil
+		}
+	}
+
+	b.Run("read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(frames * 4096)
+		buf := make([]byte, 4096)
+		for i := 0; i < b.N; i++ {
+			// Hide WriterTo so the buffer is used.
+			r := reader(newReceiver(recv()).Read)
+			io.CopyBuffer(ioutil.Discard, r, buf)
+		}
+	})
+	b.Run("writeto", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(frames * 4096)
+		buf := make([]byte, 4096)
+		for i := 0; i < b.N; i++ {
+			io.CopyBuffer(ioutil.Discard, newReceiver(recv()), buf)
+		}
+	})
+}
+
+func BenchmarkSenderAllocs(b *testing.B) {
+	w := newSender(func(*ReadWrite) error { return nil })
+	buf := bytes.Repeat([]byte("a"), 4096)
+
+	b.ReportAllocs()
+	b.SetBytes(4096)
+	for i := 0; i < b.N; i++ {
+		w.Write(buf)
+	}
+}
+
+func Test_receiver_WriteTo(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		recv    func() (*ReadWrite, error)
+		want    []byte
+		wantErr bool
+	}{
+		"eof": {
+			recv: frames(io.EOF, data("abc"), &ReadWrite{}, data("de")),
+			want: []byte("abcde"),
+		},
+		"close": {
+			recv: frames(errTest, data("abc"), &ReadWrite{Control: &ReadWrite_Close{Close: &Close{}}}),
+			want: []byte("abc"),
+		},
+		"error": {
+			recv:    frames(errTest, data("abc")),
+			want:    []byte("abc"),
+			wantErr: true,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := newReceiver(tc.recv).(io.WriterTo).WriteTo(&buf)
+			if (err != nil) != tc.wantErr {
+				t.Fatal(err)
+			}
+			if n != int64(len(tc.want)) || !bytes.Equal(buf.Bytes(), tc.want) {
+				t.Errorf("unexpected result: %d %s", n, buf.Bytes())
+			}
+		})
+	}
+}
+
+// goroutines returns the stacks of the goroutines running grproxy code, by
+// goroutine id.
+func goroutines() map[string]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := make(map[string]string)
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "yanolab/grproxy.") {
+			stacks[g[:strings.Index(g, " [")]] = g
+		}
+	}
+	return stacks
+}
+
+// checkLeaks fails when goroutines running grproxy code, other than those in
+// before, do not end within a few seconds.
+func checkLeaks(t *testing.T, before map[string]string) {
+	t.Helper()
+
+	var leaked []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		leaked = leaked[:0]
+		for id, stack := range goroutines() {
+			if _, ok := before[id]; !ok {
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+	}
+	t.Errorf("leaked goroutines:\n%s", strings.Join(leaked, "\n\n"))
+}
+
+// Test_proxy_leak cancels tunnels while the conns at both ends are idle and
+// open. It does not run in parallel, so that other tests do not start
+// goroutines.
+func Test_proxy_leak(t *testing.T) {
+	before := goroutines()
+
+	backends := make(chan net.Conn, 1)
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		backend, server := net.Pipe()
+		backends <- backend
+		return server, nil
+	})
+	proxycli, stop := startGRPCServer(t, svc)
+
+	var conns []net.Conn
+	for _, opts := range [][]ClientServiceOption{nil, {WithHello(&Hello{})}} {
+		local, remote := net.Pipe()
+		ctx, cancel := context.WithCancel(context.TODO())
+		errc := make(chan error, 1)
+		go func() {
+			errc <- NewProxyClientService(nil, opts...).Bind(ctx, proxycli, local)
+		}()
+		conns = append(conns, local, remote, <-backends)
+
+		cancel()
+		if err := <-errc; err == nil {
+			t.Error("expected error")
+		}
+	}
+	stop()
+
+	checkLeaks(t, before)
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
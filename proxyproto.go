@@ -0,0 +1,274 @@
+package grproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+// ProxyTLVIdentity is the PROXY protocol v2 TLV type that carries the client
+// identity by default. It is the first type of the range reserved for custom
+// use.
+const ProxyTLVIdentity = 0xE0
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol configures the PROXY protocol header written on every backend
+// connection before any tunnel data, so that backends such as HAProxy see the
+// address of the client that connected to the grproxy client instead of the
+// address of the server. The addresses come from the Hello of the clients
+// trusted with WithTrustedSourceAddr; for other clients the source is the
+// address of the gRPC peer and the destination the backend.
+type ProxyProtocol struct {
+	// Version is 1 for the text header or 2 for the binary one. It defaults
+	// to 1.
+	Version int
+	// IdentityTLV is the type of the version 2 TLV carrying the client
+	// identity. It defaults to ProxyTLVIdentity. The TLV is left out for
+	// clients without an identity.
+	IdentityTLV byte
+}
+
+// header returns the PROXY protocol header of a tunnel. Addresses that are
+// unknown or not TCP make the header announce an unknown connection.
+func (p *ProxyProtocol) header(src, dst *net.TCPAddr, identity string) []byte {
+	if p.Version != 2 {
+		return proxyHeaderV1(src, dst)
+	}
+
+	var tlvs []byte
+	if identity != "" && len(identity) <= 0xffff {
+		typ := p.IdentityTLV
+		if typ == 0 {
+			typ = ProxyTLVIdentity
+		}
+		tlvs = appendProxyTLV(tlvs, typ, []byte(identity))
+	}
+	return proxyHeaderV2(src, dst, tlvs)
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+}
+
+// ipv6String formats IPv4 addresses as IPv4-mapped IPv6 addresses.
+func ipv6String(ip net.IP) string {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.String()
+	}
+	return ip.String()
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr, tlvs []byte) []byte {
+	var (
+		family byte // AF_UNSPEC
+		addrs  []byte
+	)
+	if src != nil && dst != nil {
+		if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+			family = 0x11 // TCP over IPv4
+			addrs = append(append(addrs, src4...), dst4...)
+		} else {
+			family = 0x21 // TCP over IPv6
+			addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+		}
+		addrs = append(addrs, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+
+	b := make([]byte, 0, len(proxyV2Signature)+4+len(addrs)+len(tlvs))
+	b = append(b, proxyV2Signature...)
+	b = append(b, 0x21, family) // version 2, PROXY command
+	b = append(b, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(addrs)+len(tlvs)))
+	b = append(b, addrs...)
+	return append(b, tlvs...)
+}
+
+func appendProxyTLV(b []byte, typ byte, value []byte) []byte {
+	b = append(b, typ, byte(len(value)>>8), byte(len(value)))
+	return append(b, value...)
+}
+
+// proxyAddrs returns the source and destination addresses of the PROXY
+// protocol header of a tunnel whose backend connection is conn. The addresses
+// of the Hello are only used when trusted, since clients can put any address
+// there.
+func proxyAddrs(ctx context.Context, conn net.Conn, trusted bool) (src, dst *net.TCPAddr) {
+	if hello, ok := HelloFromContext(ctx); ok && trusted && hello.SourceAddr != "" {
+		return parseTCPAddr(hello.SourceAddr), parseTCPAddr(hello.DestinationAddr)
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		src = parseTCPAddr(p.Addr.String())
+	}
+	return src, parseTCPAddr(remoteAddr(conn))
+}
+
+// parseTCPAddr parses a host:port address with a literal IP, or returns nil.
+func parseTCPAddr(s string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
+
+// proxyHeaderTimeout bounds the time trusted peers have to send their PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+var errProxyHeader = errors.New("grproxy: invalid PROXY protocol header")
+
+// proxyConn is a connection whose addresses were taken from its PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// trustedProxy reports whether addr is in one of the trusted networks.
+func trustedProxy(addr net.Addr, trusted []*net.IPNet) bool {
+	if addr == nil {
+		return false
+	}
+	a := parseTCPAddr(addr.String())
+	if a == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header that starts conn and
+// returns conn with the addresses of the header. Headers of unknown or local
+// connections keep the addresses of conn.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	var src, dst net.Addr
+	switch {
+	case bytes.Equal(b, proxyV2Signature):
+		src, dst, err = readProxyHeaderV2(r)
+	case bytes.HasPrefix(b, []byte("PROXY ")):
+		src, dst, err = readProxyHeaderV1(r)
+	default:
+		err = errProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &proxyConn{Conn: conn, r: r, remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	if src != nil {
+		pc.remote, pc.local = src, dst
+	}
+	return pc, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	src := parseTCPAddr(net.JoinHostPort(fields[2], fields[4]))
+	dst := parseTCPAddr(net.JoinHostPort(fields[3], fields[5]))
+	if src == nil || dst == nil || (fields[1] == "TCP4" && (src.IP.To4() == nil || dst.IP.To4() == nil)) {
+		return nil, nil, errProxyHeader
+	}
+	return src, dst, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, nil, err
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if verCmd>>4 != 2 || verCmd&0xf > 1 {
+		return nil, nil, errProxyHeader
+	}
+	if verCmd&0xf == 0 { // LOCAL command
+		return nil, nil, nil
+	}
+
+	if family&0xf != 1 { // not STREAM, e.g. UDP
+		return nil, nil, nil
+	}
+	var n int
+	switch family >> 4 {
+	case 1:
+		n = net.IPv4len
+	case 2:
+		n = net.IPv6len
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil, nil
+	}
+	if len(body) < 2*n+4 {
+		return nil, nil, errProxyHeader
+	}
+	src := &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	dst := &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return src, dst, nil
+}
@@ -0,0 +1,264 @@
+package grproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func Test_ProxyProtocol_header(t *testing.T) {
+	t.Parallel()
+
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3306}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	sig := string(proxyV2Signature)
+
+	tests := map[string]struct {
+		p        ProxyProtocol
+		src, dst *net.TCPAddr
+		identity string
+		want     string
+	}{
+		"v1 tcp4": {
+			src: v4, dst: v4dst,
+			identity: "alice",
+			want:     "PROXY TCP4 192.0.2.1 192.0.2.2 56324 3306\r\n",
+		},
+		"v1 tcp6": {
+			src: v6, dst: v4dst,
+			want: "PROXY TCP6 2001:db8::1 ::ffff:192.0.2.2 56324 3306\r\n",
+		},
+		"v1 unknown": {
+			dst:  v4dst,
+			want: "PROXY UNKNOWN\r\n",
+		},
+		"v2 tcp4": {
+			p:   ProxyProtocol{Version: 2},
+			src: v4, dst: v4dst,
+			want: sig + "\x21\x11\x00\x0c" + "\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x0c\xea",
+		},
+		"v2 identity": {
+			p:   ProxyProtocol{Version: 2},
+			src: v4, dst: v4dst,
+			identity: "alice",
+			want:     sig + "\x21\x11\x00\x14" + "\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x0c\xea" + "\xe0\x00\x05alice",
+		},
+		"v2 identity type": {
+			p:        ProxyProtocol{Version: 2, IdentityTLV: 0xe5},
+			identity: "bob",
+			want:     sig + "\x21\x00\x00\x06" + "\xe5\x00\x03bob",
+		},
+		"v2 tcp6": {
+			p:   ProxyProtocol{Version: 2},
+			src: v6, dst: v4dst,
+			want: sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xc0\x00\x02\x02" +
+				"\xdc\x04\x0c\xea",
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			if got := tc.p.header(tc.src, tc.dst, tc.identity); string(got) != tc.want {
+				t.Errorf("unexpected header: %q", got)
+			}
+		})
+	}
+}
+
+func Test_ProxyServerService_proxyProtocol(t *testing.T) {
+	t.Parallel()
+
+	// Untrusted clients get the address of the gRPC peer and the backend.
+	peerHeader := func(local net.Conn, backend string) string {
+		_, port, _ := net.SplitHostPort(backend)
+		return `^PROXY TCP4 127\.0\.0\.1 127\.0\.0\.1 \d+ ` + port + "\r\n$"
+	}
+	tests := map[string]struct {
+		hello   bool
+		trusted func(identity string) bool
+		want    func(local net.Conn, backend string) string
+	}{
+		"client addresses": {
+			hello:   true,
+			trusted: func(identity string) bool { return identity == "alice" },
+			want: func(local net.Conn, backend string) string {
+				src, dst := local.RemoteAddr().(*net.TCPAddr), local.LocalAddr().(*net.TCPAddr)
+				return "^" + regexp.QuoteMeta(string(proxyHeaderV1(src, dst))) + "$"
+			},
+		},
+		"untrusted client": {
+			hello:   true,
+			trusted: func(identity string) bool { return identity == "bob" },
+			want:    peerHeader,
+		},
+		"no trusted clients": {
+			hello: true,
+			want:  peerHeader,
+		},
+		"legacy client": {
+			want: peerHeader,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+			opts := []ServerServiceOption{
+				WithProxyProtocol(ProxyProtocol{}),
+				WithIdentity(func(context.Context) string { return "alice" }),
+			}
+			if tc.trusted != nil {
+				opts = append(opts, WithTrustedSourceAddr(tc.trusted))
+			}
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				return net.Dial("tcp", lis.Addr().String())
+			}, opts...)
+			proxycli, stop := startGRPCServer(t, svc)
+			defer stop()
+
+			var cliOpts []ClientServiceOption
+			if tc.hello {
+				cliOpts = append(cliOpts, WithHello(&Hello{Target: "backend"}))
+			}
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			go func() {
+				defer local.Close()
+				NewProxyClientService(nil, cliOpts...).Bind(context.TODO(), proxycli, local)
+			}()
+
+			backend, err := lis.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backend.Close()
+			backend.SetDeadline(time.Now().Add(5 * time.Second))
+			header, err := bufio.NewReader(backend).ReadString('\n')
+			if err != nil || !regexp.MustCompile(tc.want(local, lis.Addr().String())).MatchString(header) {
+				t.Errorf("unexpected header: %q %v", header, err)
+			}
+		})
+	}
+}
+
+func Test_readProxyHeader(t *testing.T) {
+	t.Parallel()
+
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 3306}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v2 := &ProxyProtocol{Version: 2}
+
+	tests := map[string]struct {
+		header           string
+		wantSrc, wantDst string
+		wantErr          bool
+	}{
+		"v1 tcp4": {
+			header:  string(proxyHeaderV1(v4, v4dst)),
+			wantSrc: "192.0.2.1:56324", wantDst: "192.0.2.2:3306",
+		},
+		"v1 tcp6": {
+			header:  string(proxyHeaderV1(v6, v4dst)),
+			wantSrc: "[2001:db8::1]:56324", wantDst: "192.0.2.2:3306",
+		},
+		"v1 unknown": {
+			header:  "PROXY UNKNOWN ignored\r\n",
+			wantSrc: "pipe", wantDst: "pipe",
+		},
+		"v2 tcp4": {
+			header:  string(v2.header(v4, v4dst, "alice")),
+			wantSrc: "192.0.2.1:56324", wantDst: "192.0.2.2:3306",
+		},
+		"v2 tcp6": {
+			header:  string(v2.header(v6, v4dst, "")),
+			wantSrc: "[2001:db8::1]:56324", wantDst: "192.0.2.2:3306",
+		},
+		"v2 local": {
+			header:  string(proxyV2Signature) + "\x20\x00\x00\x00",
+			wantSrc: "pipe", wantDst: "pipe",
+		},
+		"v2 udp4": {
+			header:  string(proxyV2Signature) + "\x21\x12\x00\x0c" + "\xc0\x00\x02\x01\xc0\x00\x02\x02\xdc\x04\x0c\xea",
+			wantSrc: "pipe", wantDst: "pipe",
+		},
+		"v1 tcp4 with ipv6": {
+			header:  "PROXY TCP4 2001:db8::1 192.0.2.2 56324 3306\r\n",
+			wantErr: true,
+		},
+		"v1 bad port": {
+			header:  "PROXY TCP4 192.0.2.1 192.0.2.2 65536 3306\r\n",
+			wantErr: true,
+		},
+		"v2 short addresses": {
+			header:  string(proxyV2Signature) + "\x21\x11\x00\x04\xc0\x00\x02\x01",
+			wantErr: true,
+		},
+		"no header": {
+			header:  "GET / HTTP/1.1\r\n",
+			wantErr: true,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			go remote.Write([]byte(tc.header + "data"))
+
+			conn, err := readProxyHeader(local)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if src, dst := conn.RemoteAddr().String(), conn.LocalAddr().String(); src != tc.wantSrc || dst != tc.wantDst {
+				t.Errorf("unexpected addresses: %s %s", src, dst)
+			}
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(conn, b); err != nil || string(b) != "data" {
+				t.Errorf("unexpected data: %q %v", b, err)
+			}
+		})
+	}
+}
+
+func Test_trustedProxy(t *testing.T) {
+	t.Parallel()
+
+	_, lb, _ := net.ParseCIDR("10.0.0.0/8")
+	_, lb6, _ := net.ParseCIDR("fd00::/8")
+	trusted := []*net.IPNet{lb, lb6}
+
+	tests := map[string]struct {
+		addr net.Addr
+		want bool
+	}{
+		"trusted":    {addr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1}, want: true},
+		"trusted v6": {addr: &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1}, want: true},
+		"untrusted":  {addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}},
+		"not tcp":    {addr: &net.UnixAddr{Name: "/tmp/sock", Net: "unix"}},
+		"no address": {},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			if got := trustedProxy(tc.addr, trusted); got != tc.want {
+				t.Errorf("unexpected result: %v", got)
+			}
+		})
+	}
+}
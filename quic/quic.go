@@ -0,0 +1,278 @@
+// Package quic carries grproxy tunnels over QUIC, one QUIC stream per tunnel.
+// Unlike tunnels sharing an HTTP/2 connection, a tunnel then only stalls on
+// the packets it lost itself, which matters on lossy, high-latency links.
+//
+//	lis, err := quic.ListenAddr(":4433", serverTLS, nil)
+//	go grproxy.ServeStreams(lis, svc)
+//
+//	client := quic.NewClient("proxy.example.com:4433", clientTLS, nil)
+//	srv := grproxy.NewProxyClientServer(cli, grproxy.WithServiceClient(grproxy.NewStreamClient(client.DialStream)))
+//
+// It is a module of its own because quic-go needs a newer Go than grproxy.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// NextProto is the ALPN protocol of grproxy over QUIC. It is used when the TLS
+// configuration does not set NextProtos.
+const NextProto = "grproxy"
+
+// DefaultConfig returns the QUIC configuration used when none is given. It
+// allows many concurrent tunnels per connection and keeps idle connections
+// alive.
+func DefaultConfig() *quicgo.Config {
+	return &quicgo.Config{
+		MaxIncomingStreams: 1 << 16,
+		KeepAlivePeriod:    15 * time.Second,
+	}
+}
+
+func tlsConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if len(config.NextProtos) > 0 {
+		return config
+	}
+	config = config.Clone()
+	config.NextProtos = []string{NextProto}
+	return config
+}
+
+func quicConfig(config *quicgo.Config) *quicgo.Config {
+	if config == nil {
+		return DefaultConfig()
+	}
+	return config
+}
+
+// streamConn is a QUIC stream as a net.Conn. CloseWrite ends the sending side
+// of the stream, and Close both sides.
+type streamConn struct {
+	quicgo.Stream
+	conn quicgo.Connection
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ConnectionState returns the TLS state of the QUIC connection, which grproxy
+// puts in the peer of the stream.
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+func (c *streamConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// Listener accepts the QUIC streams that clients open on any of their
+// connections. Pass it to grproxy.ServeStreams or grproxy.WithStreamListener.
+type Listener struct {
+	ln *quicgo.Listener
+
+	streams chan net.Conn
+	ctx     context.Context
+	cancel  context.CancelFunc
+	err     error // set before ctx is canceled
+	once    sync.Once
+}
+
+// Listen listens for QUIC connections on conn.
+func Listen(conn net.PacketConn, tlsConf *tls.Config, config *quicgo.Config) (*Listener, error) {
+	ln, err := quicgo.Listen(conn, tlsConfig(tlsConf), quicConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	return newListener(ln), nil
+}
+
+// ListenAddr listens for QUIC connections on the UDP address addr.
+func ListenAddr(addr string, tlsConf *tls.Config, config *quicgo.Config) (*Listener, error) {
+	ln, err := quicgo.ListenAddr(addr, tlsConfig(tlsConf), quicConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	return newListener(ln), nil
+}
+
+func newListener(ln *quicgo.Listener) *Listener {
+	l := &Listener{ln: ln, streams: make(chan net.Conn)}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	go l.acceptConns()
+	return l
+}
+
+func (l *Listener) acceptConns() {
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			l.close(err)
+			return
+		}
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *Listener) acceptStreams(conn quicgo.Connection) {
+	for {
+		stream, err := conn.AcceptStream(l.ctx)
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- &streamConn{Stream: stream, conn: conn}:
+		case <-l.ctx.Done():
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			return
+		}
+	}
+}
+
+func (l *Listener) close(err error) {
+	l.once.Do(func() {
+		l.err = err
+		l.cancel()
+		l.ln.Close()
+	})
+}
+
+// Accept returns the next stream opened by a client.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, l.err
+	}
+}
+
+// Close stops accepting streams and closes the listener with its connections.
+func (l *Listener) Close() error {
+	l.close(errors.New("grproxy/quic: listener closed"))
+	return nil
+}
+
+// Addr returns the UDP address of the listener.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+type ClientOption func(*Client)
+
+// WithPacketConn dials from conn instead of a new UDP socket.
+func WithPacketConn(conn net.PacketConn) ClientOption {
+	return func(c *Client) {
+		c.tr = &quicgo.Transport{Conn: conn}
+	}
+}
+
+// Client opens QUIC streams to a server on a single connection, which is
+// dialed on first use and again once it is lost.
+type Client struct {
+	addr    string
+	tlsConf *tls.Config
+	config  *quicgo.Config
+	tr      *quicgo.Transport
+
+	mu   sync.Mutex
+	conn quicgo.Connection
+	gen  int // incremented by Close, to drop connections dialed meanwhile
+}
+
+// NewClient returns a client of the QUIC server at the UDP address addr.
+func NewClient(addr string, tlsConf *tls.Config, config *quicgo.Config, opts ...ClientOption) *Client {
+	c := &Client{
+		addr:    addr,
+		tlsConf: tlsConfig(tlsConf),
+		config:  quicConfig(config),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *Client) connect(ctx context.Context) (quicgo.Connection, error) {
+	c.mu.Lock()
+	conn, gen := c.conn, c.gen
+	c.mu.Unlock()
+	if conn != nil && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.gen != gen:
+		conn.CloseWithError(0, "")
+		return nil, errors.New("grproxy/quic: client closed")
+	case c.conn != nil && c.conn.Context().Err() == nil:
+		// Another stream dialed it first.
+		conn.CloseWithError(0, "")
+		return c.conn, nil
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *Client) dial(ctx context.Context) (quicgo.Connection, error) {
+	if c.tr == nil {
+		return quicgo.DialAddr(ctx, c.addr, c.tlsConf, c.config)
+	}
+	addr, err := net.ResolveUDPAddr("udp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.tr.Dial(ctx, addr, c.tlsConf, c.config)
+}
+
+// DialStream opens a stream to the server. It is a grproxy.StreamDialer.
+func (c *Client) DialStream(ctx context.Context) (net.Conn, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{Stream: stream, conn: conn}, nil
+}
+
+// Close closes the connection of the client. Later streams dial a new one.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.CloseWithError(0, "")
+}
@@ -0,0 +1,349 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yanolab/grproxy"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// testTLS returns the TLS configurations of a server with a self-signed
+// certificate and of a client trusting it.
+func testTLS(t testing.TB) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grproxy"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: pool, ServerName: "localhost"}
+}
+
+// lossyConn drops the given fraction of the packets written to it.
+type lossyConn struct {
+	net.PacketConn
+	loss float64
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if mrand.Float64() < c.loss {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listenUDP(t testing.TB, loss float64) net.PacketConn {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyConn{PacketConn: conn, loss: loss}
+}
+
+func startEchoServer(t testing.TB) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis
+}
+
+// startQUICServer serves svc over QUIC, dropping the given fraction of the
+// packets in both directions.
+func startQUICServer(t testing.TB, svc grproxy.ProxyServiceServer, loss float64) (grproxy.ProxyServiceClient, func()) {
+	t.Helper()
+
+	serverTLS, clientTLS := testTLS(t)
+	serverConn, clientConn := listenUDP(t, loss), listenUDP(t, loss)
+	lis, err := Listen(serverConn, serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grproxy.ServeStreams(lis, svc)
+
+	client := NewClient(lis.Addr().String(), clientTLS, nil, WithPacketConn(clientConn))
+	return grproxy.NewStreamClient(client.DialStream), func() {
+		client.Close()
+		lis.Close()
+		serverConn.Close()
+		clientConn.Close()
+	}
+}
+
+func newEchoService(echo net.Listener) *grproxy.ProxyServerService {
+	return grproxy.NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}, grproxy.WithIdentity(func(ctx context.Context) string {
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && info.State.ServerName == "localhost" {
+				return "tls"
+			}
+		}
+		return ""
+	}))
+}
+
+// echoTunnel binds a tunnel through proxycli, sends size random bytes and
+// checks that they come back.
+func echoTunnel(proxycli grproxy.ProxyServiceClient, size int) error {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- grproxy.NewProxyClientService(nil, grproxy.WithHello(&grproxy.Hello{Target: "echo"})).Bind(context.TODO(), proxycli, local)
+	}()
+
+	want := make([]byte, size)
+	rand.Read(want)
+	remote.SetDeadline(time.Now().Add(30 * time.Second))
+	go remote.Write(want)
+	got := make([]byte, size)
+	if _, err := io.ReadFull(remote, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("unexpected echo of %d bytes", size)
+	}
+	remote.Close()
+	return <-errc
+}
+
+func Test_loopback(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		loss float64
+	}{
+		"no loss": {},
+		"loss":    {loss: 0.05},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			echo := startEchoServer(t)
+			defer echo.Close()
+			svc := newEchoService(echo)
+			proxycli, stop := startQUICServer(t, svc, tc.loss)
+			defer stop()
+
+			var wg sync.WaitGroup
+			errs := make([]error, 8)
+			for i := range errs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs[i] = echoTunnel(proxycli, 64<<10)
+				}(i)
+			}
+			wg.Wait()
+			for i, err := range errs {
+				if err != nil {
+					t.Errorf("unexpected error of tunnel %d: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_loopback_identity(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	svc := newEchoService(echo)
+	proxycli, stop := startQUICServer(t, svc, 0)
+	defer stop()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go func() {
+		defer local.Close()
+		grproxy.NewProxyClientService(nil, grproxy.WithHello(&grproxy.Hello{Target: "echo"})).Bind(context.TODO(), proxycli, local)
+	}()
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	go remote.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(remote, b); err != nil {
+		t.Fatal(err)
+	}
+	if got := svc.Tunnels(); len(got) != 1 || got[0].Identity != "tls" || got[0].Peer == "" {
+		t.Errorf("unexpected tunnels: %+v", got)
+	}
+}
+
+func Test_Listener_Close(t *testing.T) {
+	t.Parallel()
+
+	serverTLS, _ := testTLS(t)
+	lis, err := ListenAddr("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := lis.Accept()
+		errc <- err
+	}()
+	lis.Close()
+	if err := <-errc; err == nil {
+		t.Error("unexpected success of accept")
+	}
+}
+
+// BenchmarkThroughput echoes 1 MiB per iteration through 4 concurrent
+// tunnels, over QUIC with simulated packet loss and, for comparison, over
+// gRPC on TCP without loss.
+func BenchmarkThroughput(b *testing.B) {
+	const size = 1 << 20
+
+	transports := []struct {
+		name  string
+		loss  float64
+		start func(b *testing.B, svc grproxy.ProxyServiceServer, loss float64) (grproxy.ProxyServiceClient, func())
+	}{
+		{name: "grpc", start: startGRPCServer},
+		{name: "quic", start: startQUICBenchServer},
+		{name: "quic/loss=1%", loss: 0.01, start: startQUICBenchServer},
+		{name: "quic/loss=5%", loss: 0.05, start: startQUICBenchServer},
+	}
+
+	for _, tr := range transports {
+		b.Run(tr.name, func(b *testing.B) {
+			echo := startEchoServer(b)
+			defer echo.Close()
+			proxycli, stop := tr.start(b, newEchoService(echo), tr.loss)
+			defer stop()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for n := 0; n < b.N/4+1; n++ {
+						if err := echoTunnel(proxycli, size/4); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func startQUICBenchServer(b *testing.B, svc grproxy.ProxyServiceServer, loss float64) (grproxy.ProxyServiceClient, func()) {
+	return startQUICServer(b, svc, loss)
+}
+
+func startGRPCServer(b *testing.B, svc grproxy.ProxyServiceServer, _ float64) (grproxy.ProxyServiceClient, func()) {
+	b.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	grpcsrv := grpc.NewServer()
+	grproxy.RegisterProxyServiceServer(grpcsrv, svc)
+	go grpcsrv.Serve(lis)
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		b.Fatal(err)
+	}
+	return grproxy.NewProxyServiceClient(conn), func() {
+		conn.Close()
+		grpcsrv.Stop()
+	}
+}
+
+func Test_Client_connect(t *testing.T) {
+	t.Parallel()
+
+	serverTLS, clientTLS := testTLS(t)
+	lis, err := ListenAddr("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client := NewClient(lis.Addr().String(), clientTLS, nil)
+	defer client.Close()
+
+	// The first streams dial concurrently and share one connection.
+	conns := make([]net.Conn, 4)
+	errs := make([]error, len(conns))
+	var wg sync.WaitGroup
+	for i := range conns {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conns[i], errs[i] = client.DialStream(ctx)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error of stream %d: %v", i, err)
+		}
+		defer conns[i].Close()
+		if conns[i].(*streamConn).conn != client.conn {
+			t.Errorf("unexpected connection of stream %d", i)
+		}
+	}
+}
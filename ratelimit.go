@@ -0,0 +1,280 @@
+package grproxy
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit is a token bucket configuration in bytes per second.
+// A zero Rate means unlimited. Burst defaults to Rate.
+type RateLimit struct {
+	Rate  int
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0
+}
+
+// RateLimits configures bandwidth limits. Every limit is applied to each
+// direction of a tunnel separately.
+type RateLimits struct {
+	// Global is shared by all tunnels.
+	Global RateLimit
+	// Tunnel is applied to each tunnel on its own.
+	Tunnel RateLimit
+	// Identity is shared by all tunnels of the same client identity.
+	Identity RateLimit
+	// Target is shared by all tunnels to the same target.
+	Target RateLimit
+
+	// Identities and Targets override Identity and Target for specific names.
+	Identities map[string]RateLimit
+	Targets    map[string]RateLimit
+}
+
+// RateLimitStats reports how long streams were throttled.
+type RateLimitStats struct {
+	// Streams is the number of tunnel directions that were throttled at least once.
+	Streams int64
+	// Throttled is the total time spent waiting for tokens.
+	Throttled time.Duration
+}
+
+const (
+	// bucketIdleRefills is how many times the refill time of a shared bucket
+	// it must be unused before it is evicted. By then it is full, so a new
+	// bucket behaves the same.
+	bucketIdleRefills = 10
+	// bucketSweepInterval is how often shared buckets are checked for
+	// eviction.
+	bucketSweepInterval = time.Minute
+)
+
+type bucketKey struct {
+	dir  Direction
+	kind string
+	name string
+}
+
+// RateLimiter applies RateLimits to tunnels.
+type RateLimiter struct {
+	limits RateLimits
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+
+	streams   int64
+	throttled int64
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:    limits,
+		buckets:   make(map[bucketKey]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Stats returns the throttling statistics collected so far.
+func (l *RateLimiter) Stats() RateLimitStats {
+	return RateLimitStats{
+		Streams:   atomic.LoadInt64(&l.streams),
+		Throttled: time.Duration(atomic.LoadInt64(&l.throttled)),
+	}
+}
+
+func (l *RateLimiter) shared(key bucketKey, limit RateLimit) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now := time.Now(); now.Sub(l.lastSweep) >= bucketSweepInterval {
+		l.sweep(now)
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = newTokenBucket(limit)
+		l.buckets[key] = b
+	}
+	return b
+}
+
+// sweep evicts the shared buckets that were idle long enough, so that
+// clients rotating identities or targets do not grow the map forever. It must
+// be called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.evict(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// bucketRef is a bucket of a tunnel. A shared bucket that was evicted is
+// looked up again, so that tunnels keep sharing one bucket per key.
+type bucketRef struct {
+	*tokenBucket
+	key   bucketKey
+	limit RateLimit
+}
+
+func (l *RateLimiter) reserve(r *bucketRef, n int) time.Duration {
+	for {
+		if d, ok := r.reserve(n); ok {
+			return d
+		}
+		r.tokenBucket = l.shared(r.key, r.limit)
+	}
+}
+
+func (l *RateLimiter) tunnelBuckets(dir Direction, identity, target string) []*bucketRef {
+	var buckets []*bucketRef
+	share := func(key bucketKey, limit RateLimit) {
+		buckets = append(buckets, &bucketRef{tokenBucket: l.shared(key, limit), key: key, limit: limit})
+	}
+	if l.limits.Global.enabled() {
+		share(bucketKey{dir: dir, kind: "global"}, l.limits.Global)
+	}
+	if l.limits.Tunnel.enabled() {
+		buckets = append(buckets, &bucketRef{tokenBucket: newTokenBucket(l.limits.Tunnel)})
+	}
+	limit, ok := l.limits.Identities[identity]
+	if !ok {
+		limit = l.limits.Identity
+	}
+	if limit.enabled() {
+		share(bucketKey{dir: dir, kind: "identity", name: identity}, limit)
+	}
+	limit, ok = l.limits.Targets[target]
+	if !ok {
+		limit = l.limits.Target
+	}
+	if limit.enabled() {
+		share(bucketKey{dir: dir, kind: "target", name: target}, limit)
+	}
+	return buckets
+}
+
+// writer wraps w so that writes in the given direction respect the limits for
+// the identity and target.
+func (l *RateLimiter) writer(ctx context.Context, w io.Writer, dir Direction, identity, target string) io.Writer {
+	buckets := l.tunnelBuckets(dir, identity, target)
+	if len(buckets) == 0 {
+		return w
+	}
+
+	var throttled bool
+	return writer(func(b []byte) (int, error) {
+		written := 0
+		for len(b) > 0 {
+			n := len(b)
+			for _, bucket := range buckets {
+				if n > bucket.burst {
+					n = bucket.burst
+				}
+			}
+
+			var wait time.Duration
+			for _, bucket := range buckets {
+				if d := l.reserve(bucket, n); d > wait {
+					wait = d
+				}
+			}
+			if wait > 0 {
+				if !throttled {
+					throttled = true
+					atomic.AddInt64(&l.streams, 1)
+				}
+				atomic.AddInt64(&l.throttled, int64(wait))
+				if err := sleep(ctx, wait); err != nil {
+					return written, err
+				}
+			}
+
+			m, err := w.Write(b[:n])
+			written += m
+			if err != nil {
+				return written, err
+			}
+			b = b[n:]
+		}
+		return written, nil
+	})
+}
+
+type tokenBucket struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	tokens  float64
+	last    time.Time
+	evicted bool
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.Rate
+	}
+	return &tokenBucket{
+		rate:   float64(limit.Rate),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// evict marks the bucket evicted if it was unused for bucketIdleRefills times
+// the time it takes to refill.
+func (b *tokenBucket) evict(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	refill := time.Duration(float64(b.burst) / b.rate * float64(time.Second))
+	if now.Sub(b.last) < bucketIdleRefills*refill {
+		return false
+	}
+	b.evicted = true
+	return true
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has
+// to wait until they are actually available. It returns false when the
+// bucket was evicted.
+func (b *tokenBucket) reserve(n int) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.evicted {
+		return 0, false
+	}
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(b.burst) {
+		b.tokens = float64(b.burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0, true
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,208 @@
+package grproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter_writer(t *testing.T) {
+	t.Parallel()
+
+	type args struct {
+		ctx      context.Context
+		identity string
+		target   string
+		b        []byte
+	}
+	tests := map[string]struct {
+		limits      RateLimits
+		args        args
+		minDuration time.Duration
+		throttled   bool
+		wantErr     bool
+	}{
+		"unlimited": {
+			args: args{
+				ctx: context.TODO(),
+				b:   bytes.Repeat([]byte("a"), 3000),
+			},
+		},
+		"tunnel": {
+			limits: RateLimits{
+				Tunnel: RateLimit{Rate: 10000, Burst: 1000},
+			},
+			args: args{
+				ctx: context.TODO(),
+				b:   bytes.Repeat([]byte("a"), 3000),
+			},
+			minDuration: 150 * time.Millisecond,
+			throttled:   true,
+		},
+		"identity override": {
+			limits: RateLimits{
+				Identity:   RateLimit{Rate: 1},
+				Identities: map[string]RateLimit{"alice": {Rate: 10000, Burst: 1000}},
+			},
+			args: args{
+				ctx:      context.TODO(),
+				identity: "alice",
+				b:        bytes.Repeat([]byte("a"), 3000),
+			},
+			minDuration: 150 * time.Millisecond,
+			throttled:   true,
+		},
+		"target within burst": {
+			limits: RateLimits{
+				Target: RateLimit{Rate: 10000, Burst: 5000},
+			},
+			args: args{
+				ctx:    context.TODO(),
+				target: "db:3306",
+				b:      bytes.Repeat([]byte("a"), 3000),
+			},
+		},
+		"context cancel": {
+			limits: RateLimits{
+				Global: RateLimit{Rate: 1},
+			},
+			args: args{
+				ctx: func() context.Context {
+					ctx, cancel := context.WithCancel(context.TODO())
+					cancel()
+					return ctx
+				}(),
+				b: bytes.Repeat([]byte("a"), 3000),
+			},
+			throttled: true,
+			wantErr:   true,
+		},
+	}
+
+	for tn, tc := range tests {
+		tc := tc
+		t.Run(tn, func(t *testing.T) {
+			t.Parallel()
+
+			l := NewRateLimiter(tc.limits)
+			buf := &bytes.Buffer{}
+			w := l.writer(tc.args.ctx, buf, Upstream, tc.args.identity, tc.args.target)
+
+			start := time.Now()
+			n, err := w.Write(tc.args.b)
+			if (err != nil) != tc.wantErr {
+				t.Fatal(err)
+			}
+			if got := l.Stats().Streams > 0; got != tc.throttled {
+				t.Errorf("unexpected throttled: %v", got)
+			}
+			if err != nil {
+				return
+			}
+
+			if d := time.Since(start); d < tc.minDuration {
+				t.Errorf("finished too early: %v", d)
+			}
+			if n != len(tc.args.b) || !reflect.DeepEqual(buf.Bytes(), tc.args.b) {
+				t.Errorf("unexpected result: %d", n)
+			}
+		})
+	}
+}
+
+func Test_RateLimiter_shared(t *testing.T) {
+	t.Parallel()
+
+	l := NewRateLimiter(RateLimits{
+		Identity: RateLimit{Rate: 10000, Burst: 2000},
+	})
+
+	// Each tunnel fits in the burst, but two tunnels of the same identity don't.
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		w := l.writer(context.TODO(), &bytes.Buffer{}, Downstream, "bob", "")
+		if _, err := w.Write(bytes.Repeat([]byte("a"), 2000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("finished too early: %v", d)
+	}
+
+	// Other identities and directions have their own buckets.
+	for _, w := range []struct {
+		dir      Direction
+		identity string
+	}{
+		{dir: Downstream, identity: "carol"},
+		{dir: Upstream, identity: "bob"},
+	} {
+		start := time.Now()
+		w := l.writer(context.TODO(), &bytes.Buffer{}, w.dir, w.identity, "")
+		if _, err := w.Write(bytes.Repeat([]byte("a"), 2000)); err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Errorf("unexpected throttling: %v", d)
+		}
+	}
+}
+
+func Test_RateLimiter_sweep(t *testing.T) {
+	t.Parallel()
+
+	l := NewRateLimiter(RateLimits{
+		Identity: RateLimit{Rate: 10000, Burst: 1000},
+	})
+	for _, identity := range []string{"alice", "bob", "carol"} {
+		w := l.writer(context.TODO(), &bytes.Buffer{}, Downstream, identity, "")
+		if _, err := w.Write([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bob := l.writer(context.TODO(), &bytes.Buffer{}, Upstream, "bob", "")
+
+	// The buckets refill in 100ms, so they are idle after a second.
+	l.mu.Lock()
+	l.sweep(time.Now().Add(500 * time.Millisecond))
+	if len(l.buckets) != 4 {
+		t.Errorf("unexpected buckets: %d", len(l.buckets))
+	}
+	l.sweep(time.Now().Add(time.Second))
+	if len(l.buckets) != 0 {
+		t.Errorf("unexpected buckets: %d", len(l.buckets))
+	}
+	l.mu.Unlock()
+
+	// A writer whose bucket was evicted shares the new one with later
+	// tunnels of the same identity.
+	start := time.Now()
+	if _, err := bob.Write(bytes.Repeat([]byte("a"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	w := l.writer(context.TODO(), &bytes.Buffer{}, Upstream, "bob", "")
+	if _, err := w.Write(bytes.Repeat([]byte("a"), 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("finished too early: %v", d)
+	}
+	if len(l.buckets) != 1 {
+		t.Errorf("unexpected buckets: %d", len(l.buckets))
+	}
+}
+
+func Test_RateLimiter_writeError(t *testing.T) {
+	t.Parallel()
+
+	l := NewRateLimiter(RateLimits{Tunnel: RateLimit{Rate: 1000000}})
+	w := l.writer(context.TODO(), writer(func(b []byte) (int, error) {
+		return 0, errors.New("error")
+	}), Upstream, "", "")
+	if _, err := w.Write([]byte("abcde")); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,501 @@
+package grproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordFormat is the file format of a Recorder.
+type RecordFormat int
+
+const (
+	// RecordJSONL writes one JSON object per line: an "open" record with the
+	// tunnel's identity, target and addresses, "data" records with the base64
+	// payload of one write, a "truncated" record when the size cap is reached
+	// and a "close" record.
+	RecordJSONL RecordFormat = iota
+	// RecordPcapng writes the payload as TCP segments with synthesized headers
+	// between the client and the backend, so that tools like Wireshark can
+	// follow every tunnel as a TCP stream. Tunnels share the connection of the
+	// client, so the client port is replaced by a number per tunnel.
+	RecordPcapng
+)
+
+// Recording configures a Recorder.
+type Recording struct {
+	Path   string
+	Format RecordFormat
+
+	// Identities and Targets select the tunnels to record. A non-empty list
+	// must contain the client identity, or the target, which is the target of
+	// the Hello or else the backend address.
+	Identities []string
+	Targets    []string
+
+	// MaxTunnelBytes caps the payload recorded per tunnel. Zero means no cap.
+	MaxTunnelBytes int64
+	// MaxFileSize rotates the file once it grows beyond the size. Rotated
+	// files get the suffixes .1, .2 and so on, .1 being the newest. Zero
+	// disables rotation.
+	MaxFileSize int64
+	// MaxFiles is the number of rotated files kept. It defaults to 5.
+	MaxFiles int
+}
+
+// Recorder writes the bytes flowing through tunnels to a file for debugging
+// and audit. Records are buffered; they are flushed when a tunnel ends and on
+// Close.
+type Recorder struct {
+	config  Recording
+	encoder recordEncoder
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	err     error
+	tunnels uint64
+}
+
+// NewRecorder creates or truncates the file at r.Path.
+func NewRecorder(r Recording) (*Recorder, error) {
+	rec := &Recorder{config: r}
+	switch r.Format {
+	case RecordJSONL:
+		rec.encoder = jsonlEncoder{}
+	case RecordPcapng:
+		rec.encoder = pcapngEncoder{}
+	default:
+		return nil, fmt.Errorf("grproxy: unknown record format %d", r.Format)
+	}
+	if rec.config.MaxFiles <= 0 {
+		rec.config.MaxFiles = 5
+	}
+
+	if err := rec.create(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// Close flushes and closes the file. It returns the first error the recorder
+// ran into; records are dropped after an error.
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if err := rec.w.Flush(); err != nil && rec.err == nil {
+		rec.err = err
+	}
+	if err := rec.f.Close(); err != nil && rec.err == nil {
+		rec.err = err
+	}
+	return rec.err
+}
+
+func (rec *Recorder) create() error {
+	f, err := os.Create(rec.config.Path)
+	if err != nil {
+		return err
+	}
+	rec.f, rec.w, rec.size = f, bufio.NewWriter(f), 0
+
+	header := rec.encoder.header()
+	n, err := rec.w.Write(header)
+	rec.size += int64(n)
+	return err
+}
+
+func (rec *Recorder) rotate() error {
+	if err := rec.w.Flush(); err != nil {
+		return err
+	}
+	if err := rec.f.Close(); err != nil {
+		return err
+	}
+
+	path := rec.config.Path
+	for i := rec.config.MaxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+	return rec.create()
+}
+
+// write encodes e. It must be called with mu held.
+func (rec *Recorder) write(t *recordedTunnel, e *recordEvent) {
+	if rec.err != nil {
+		return
+	}
+
+	if max := rec.config.MaxFileSize; max > 0 && rec.size >= max {
+		if rec.err = rec.rotate(); rec.err != nil {
+			return
+		}
+		// Repeat the open record, so that every file makes sense on its own.
+		if e.kind != recordOpen {
+			rec.write(t, &recordEvent{time: e.time, kind: recordOpen})
+		}
+	}
+
+	n, err := rec.w.Write(rec.encoder.encode(t, e))
+	rec.size += int64(n)
+	if rec.err == nil {
+		rec.err = err
+	}
+}
+
+func (rec *Recorder) recorded(identity, target string) bool {
+	return matches(rec.config.Identities, identity) && matches(rec.config.Targets, target)
+}
+
+func matches(names []string, name string) bool {
+	if len(names) == 0 {
+		return true
+	}
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// start begins recording a tunnel. It returns nil when rec is nil or the
+// tunnel is not selected.
+func (rec *Recorder) start(info TunnelInfo) *recordedTunnel {
+	if rec == nil || !rec.recorded(info.Identity, info.Target) {
+		return nil
+	}
+
+	t := &recordedTunnel{
+		rec:      rec,
+		identity: info.Identity,
+		target:   info.Target,
+		client:   info.Client,
+		backend:  info.Backend,
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.tunnels++
+	t.id = rec.tunnels
+	rec.write(t, &recordEvent{time: time.Now(), kind: recordOpen})
+	return t
+}
+
+type recordKind int
+
+const (
+	recordOpen recordKind = iota
+	recordData
+	recordTruncated
+	recordClose
+)
+
+type recordEvent struct {
+	time time.Time
+	kind recordKind
+	dir  Direction
+	data []byte
+}
+
+// recordedTunnel is a tunnel being recorded. Upstream is the direction from
+// the client to the backend.
+type recordedTunnel struct {
+	rec      *Recorder
+	id       uint64
+	identity string
+	target   string
+	client   net.Addr
+	backend  net.Addr
+
+	// guarded by Recorder.mu
+	recorded  int64
+	truncated bool
+	closed    bool
+	seq       [2]uint32 // next TCP sequence number per direction
+}
+
+// writer wraps w to record the bytes written in the direction dir.
+func (t *recordedTunnel) writer(w io.Writer, dir Direction) io.Writer {
+	if t == nil {
+		return w
+	}
+	return writer(func(b []byte) (int, error) {
+		t.record(dir, b)
+		return w.Write(b)
+	})
+}
+
+func (t *recordedTunnel) record(dir Direction, b []byte) {
+	rec := t.rec
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if t.truncated || t.closed || len(b) == 0 {
+		return
+	}
+	now := time.Now()
+	if max := rec.config.MaxTunnelBytes; max > 0 && t.recorded+int64(len(b)) > max {
+		b = b[:max-t.recorded]
+		t.truncated = true
+	}
+	if len(b) > 0 {
+		t.recorded += int64(len(b))
+		rec.write(t, &recordEvent{time: now, kind: recordData, dir: dir, data: b})
+	}
+	if t.truncated {
+		rec.write(t, &recordEvent{time: now, kind: recordTruncated})
+	}
+}
+
+// close records the end of the tunnel and flushes the file.
+func (t *recordedTunnel) close() {
+	if t == nil {
+		return
+	}
+	rec := t.rec
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	rec.write(t, &recordEvent{time: time.Now(), kind: recordClose})
+	if rec.err == nil {
+		rec.err = rec.w.Flush()
+	}
+}
+
+type recordEncoder interface {
+	// header starts every file.
+	header() []byte
+	encode(t *recordedTunnel, e *recordEvent) []byte
+}
+
+type jsonlEncoder struct{}
+
+type jsonRecord struct {
+	Time      time.Time `json:"time"`
+	Tunnel    uint64    `json:"tunnel"`
+	Event     string    `json:"event"`
+	Direction string    `json:"direction,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+	Data      []byte    `json:"data,omitempty"`
+}
+
+func (jsonlEncoder) header() []byte {
+	return nil
+}
+
+func (jsonlEncoder) encode(t *recordedTunnel, e *recordEvent) []byte {
+	r := jsonRecord{Time: e.time, Tunnel: t.id}
+	switch e.kind {
+	case recordOpen:
+		r.Event, r.Identity, r.Target = "open", t.identity, t.target
+		if t.client != nil {
+			r.Client = t.client.String()
+		}
+		if t.backend != nil {
+			r.Backend = t.backend.String()
+		}
+	case recordData:
+		r.Event, r.Data, r.Direction = "data", e.data, e.dir.String()
+	case recordTruncated:
+		r.Event = "truncated"
+	case recordClose:
+		r.Event = "close"
+	}
+
+	b, _ := json.Marshal(&r)
+	return append(b, '\n')
+}
+
+// pcapngEncoder writes a section header and one raw IP interface, followed by
+// an enhanced packet block per TCP segment.
+type pcapngEncoder struct{}
+
+const (
+	pcapngLinkTypeRaw = 101
+	// maxSegment keeps the synthesized packets below the IP length limit.
+	maxSegment = 32 << 10
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+func (pcapngEncoder) header() []byte {
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], 0x0A0D0D0A)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	binary.LittleEndian.PutUint64(shb[16:], ^uint64(0))
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], 1)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+
+	return append(shb, idb...)
+}
+
+func (pcapngEncoder) encode(t *recordedTunnel, e *recordEvent) []byte {
+	var b []byte
+	switch e.kind {
+	case recordOpen:
+		// The handshake starts both directions at sequence number 0.
+		t.seq = [2]uint32{}
+		b = appendSegment(b, t, e.time, Upstream, tcpSYN, nil)
+		b = appendSegment(b, t, e.time, Downstream, tcpSYN|tcpACK, nil)
+		b = appendSegment(b, t, e.time, Upstream, tcpACK, nil)
+	case recordData:
+		for data := e.data; len(data) > 0; {
+			n := len(data)
+			if n > maxSegment {
+				n = maxSegment
+			}
+			b = appendSegment(b, t, e.time, e.dir, tcpPSH|tcpACK, data[:n])
+			data = data[n:]
+		}
+	case recordClose:
+		b = appendSegment(b, t, e.time, Upstream, tcpFIN|tcpACK, nil)
+		b = appendSegment(b, t, e.time, Downstream, tcpFIN|tcpACK, nil)
+	}
+	return b
+}
+
+// endpoints returns the synthesized addresses of the client and the backend.
+func (t *recordedTunnel) endpoints() (net.IP, uint16, net.IP, uint16) {
+	clientIP, backendIP := net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)
+	backendPort := uint16(1)
+	if a, ok := t.client.(*net.TCPAddr); ok && a.IP != nil {
+		clientIP = a.IP
+	}
+	if a, ok := t.backend.(*net.TCPAddr); ok && a.IP != nil {
+		backendIP, backendPort = a.IP, uint16(a.Port)
+	}
+	return clientIP, uint16(1024 + t.id%64000), backendIP, backendPort
+}
+
+// appendSegment appends an enhanced packet block with a TCP segment in the
+// direction dir and advances the sequence number.
+func appendSegment(b []byte, t *recordedTunnel, ts time.Time, dir Direction, flags byte, payload []byte) []byte {
+	srcIP, srcPort, dstIP, dstPort := t.endpoints()
+	if dir == Downstream {
+		srcIP, srcPort, dstIP, dstPort = dstIP, dstPort, srcIP, srcPort
+	}
+
+	seq := t.seq[dir]
+	ack := t.seq[1-dir]
+	t.seq[dir] += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		t.seq[dir]++
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+
+	var packet []byte
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+		binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+		packet = append(ip, tcp...)
+	} else {
+		ip := make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], srcIP.To16())
+		copy(ip[24:], dstIP.To16())
+
+		pseudo := make([]byte, 40)
+		copy(pseudo[0:], ip[8:40])
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(tcp)))
+		pseudo[39] = 6
+		binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+		packet = append(ip, tcp...)
+	}
+
+	padded := (len(packet) + 3) &^ 3
+	total := 28 + padded + 4
+	epb := make([]byte, 28, total)
+	binary.LittleEndian.PutUint32(epb[0:], 6)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(total))
+	us := uint64(ts.UnixNano() / int64(time.Microsecond))
+	binary.LittleEndian.PutUint32(epb[12:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(epb[16:], uint32(us))
+	binary.LittleEndian.PutUint32(epb[20:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(epb[24:], uint32(len(packet)))
+	epb = append(epb, packet...)
+	epb = append(epb, make([]byte, padded-len(packet))...)
+	epb = append(epb, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(epb[total-4:], uint32(total))
+
+	return append(b, epb...)
+}
+
+// sum adds b to the ones' complement sum s.
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the internet checksum of b, continuing the sum s.
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,290 @@
+package grproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/peer"
+)
+
+func tempPath(t *testing.T, name string) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "grproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, name), func() { os.RemoveAll(dir) }
+}
+
+func readRecords(t *testing.T, path string) []jsonRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []jsonRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var r jsonRecord
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func Test_Recorder_jsonl(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		recording Recording
+		identity  string
+		target    string
+		want      []string
+	}{
+		"all": {
+			want: []string{"open", "data:upstream:abc", "data:downstream:defgh", "close"},
+		},
+		"identity": {
+			recording: Recording{Identities: []string{"alice"}},
+			identity:  "alice",
+			want:      []string{"open", "data:upstream:abc", "data:downstream:defgh", "close"},
+		},
+		"other identity": {
+			recording: Recording{Identities: []string{"alice"}},
+			identity:  "bob",
+		},
+		"target": {
+			recording: Recording{Targets: []string{"db"}},
+			target:    "db",
+			want:      []string{"open", "data:upstream:abc", "data:downstream:defgh", "close"},
+		},
+		"other target": {
+			recording: Recording{Targets: []string{"db"}},
+			target:    "cache",
+		},
+		"truncated": {
+			recording: Recording{MaxTunnelBytes: 5},
+			want:      []string{"open", "data:upstream:abc", "data:downstream:de", "truncated", "close"},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			path, cleanup := tempPath(t, "tunnels.jsonl")
+			defer cleanup()
+
+			tc.recording.Path = path
+			rec, err := NewRecorder(tc.recording)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ctx := withHello(context.TODO(), &Hello{Target: tc.target})
+			conn, _ := net.Pipe()
+			rt := rec.start(tunnelInfo(ctx, tc.identity, conn))
+			var buf bytes.Buffer
+			rt.writer(&buf, Upstream).Write([]byte("abc"))
+			rt.writer(&buf, Downstream).Write([]byte("defgh"))
+			rt.close()
+			if err := rec.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if buf.String() != "abcdefgh" {
+				t.Errorf("unexpected written: %s", buf.String())
+			}
+			var got []string
+			for _, r := range readRecords(t, path) {
+				if r.Event == "data" {
+					got = append(got, "data:"+r.Direction+":"+string(r.Data))
+					continue
+				}
+				got = append(got, r.Event)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected records: %q", got)
+			}
+		})
+	}
+}
+
+func Test_Recorder_pcapng(t *testing.T) {
+	t.Parallel()
+
+	path, cleanup := tempPath(t, "tunnels.pcapng")
+	defer cleanup()
+	rec, err := NewRecorder(Recording{Path: path, Format: RecordPcapng})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local, remote := tcpPipe(t)
+	defer local.Close()
+	defer remote.Close()
+	ctx := peer.NewContext(context.TODO(), &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}})
+	rt := rec.start(tunnelInfo(ctx, "", local))
+	up := bytes.Repeat([]byte("a"), 40<<10)
+	rt.writer(ioutil.Discard, Upstream).Write(up)
+	rt.writer(ioutil.Discard, Downstream).Write([]byte("ok"))
+	rt.close()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(b) != 0x0A0D0D0A || binary.LittleEndian.Uint32(b[8:]) != 0x1A2B3C4D {
+		t.Fatal("unexpected section header")
+	}
+	b = b[28:]
+	if binary.LittleEndian.Uint32(b) != 1 || binary.LittleEndian.Uint16(b[8:]) != pcapngLinkTypeRaw {
+		t.Fatal("unexpected interface description")
+	}
+	b = b[20:]
+
+	var (
+		payload [2][]byte
+		flags   []byte
+	)
+	backendPort := uint16(local.RemoteAddr().(*net.TCPAddr).Port)
+	for len(b) > 0 {
+		if binary.LittleEndian.Uint32(b) != 6 {
+			t.Fatalf("unexpected block type: %d", binary.LittleEndian.Uint32(b))
+		}
+		total := binary.LittleEndian.Uint32(b[4:])
+		packet := b[28 : 28+binary.LittleEndian.Uint32(b[20:])]
+		b = b[total:]
+
+		ip, tcp := packet[:20], packet[20:]
+		if checksum(0, ip) != 0 {
+			t.Error("invalid ip checksum")
+		}
+		pseudo := append(append([]byte{}, ip[12:20]...), 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+		if checksum(sum(0, pseudo), tcp) != 0 {
+			t.Error("invalid tcp checksum")
+		}
+
+		dir := Upstream
+		if binary.BigEndian.Uint16(tcp[0:]) == backendPort {
+			dir = Downstream
+		}
+		if seq := binary.BigEndian.Uint32(tcp[4:]); tcp[13]&tcpSYN == 0 && int(seq) != len(payload[dir])+1 {
+			t.Errorf("unexpected seq %d", seq)
+		}
+		payload[dir] = append(payload[dir], tcp[20:]...)
+		flags = append(flags, tcp[13])
+	}
+
+	if !bytes.Equal(payload[Upstream], up) || string(payload[Downstream]) != "ok" {
+		t.Error("unexpected payload")
+	}
+	want := []byte{tcpSYN, tcpSYN | tcpACK, tcpACK, tcpPSH | tcpACK, tcpPSH | tcpACK, tcpPSH | tcpACK, tcpFIN | tcpACK, tcpFIN | tcpACK}
+	if !bytes.Equal(flags, want) {
+		t.Errorf("unexpected flags: %v", flags)
+	}
+}
+
+func Test_Recorder_rotation(t *testing.T) {
+	t.Parallel()
+
+	path, cleanup := tempPath(t, "tunnels.jsonl")
+	defer cleanup()
+	rec, err := NewRecorder(Recording{Path: path, MaxFileSize: 200, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, _ := net.Pipe()
+	rt := rec.start(tunnelInfo(context.TODO(), "", conn))
+	w := rt.writer(ioutil.Discard, Upstream)
+	for i := 0; i < 20; i++ {
+		w.Write([]byte("abcdefghij"))
+	}
+	rt.close()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{path, path + ".1", path + ".2"} {
+		records := readRecords(t, p)
+		if len(records) == 0 || records[0].Event != "open" {
+			t.Errorf("%s does not start with open: %v", p, records)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("unexpected file: %v", err)
+	}
+}
+
+func Test_ProxyService_recorder(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	path, cleanup := tempPath(t, "tunnels.jsonl")
+	defer cleanup()
+	rec, err := NewRecorder(Recording{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}, WithRecorder(rec))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- NewProxyClientService(nil, WithHello(&Hello{Target: "echo"})).Bind(context.TODO(), proxycli, local)
+	}()
+
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	remote.Write([]byte("ping"))
+	remote.(*net.TCPConn).CloseWrite()
+	if got, err := ioutil.ReadAll(remote); err != nil || string(got) != "ping" {
+		t.Fatalf("unexpected result: %s %v", got, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 4 {
+		t.Fatalf("unexpected records: %v", records)
+	}
+	if r := records[0]; r.Event != "open" || r.Target != "echo" || r.Backend != echo.Addr().String() || r.Client == "" {
+		t.Errorf("unexpected open: %+v", r)
+	}
+	if r := records[1]; r.Direction != "upstream" || string(r.Data) != "ping" {
+		t.Errorf("unexpected upstream: %+v", r)
+	}
+	if r := records[2]; r.Direction != "downstream" || string(r.Data) != "ping" {
+		t.Errorf("unexpected downstream: %+v", r)
+	}
+}
@@ -1,25 +1,99 @@
 package grproxy
 
 import (
+	"context"
 	"net"
+	"net/http"
 
 	grpc "google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+type ServerOption func(*ProxyServer)
+
+// WithHealthChecker registers grpc.health.v1 on the server and runs the
+// checker while the server is serving.
+func WithHealthChecker(h *HealthChecker) ServerOption {
+	return func(srv *ProxyServer) {
+		srv.health = h
+	}
+}
+
+// WithAdmin registers the grproxy.admin.v1 service of the proxy service on the
+// server. See NewAdminServer.
+func WithAdmin() ServerOption {
+	return func(srv *ProxyServer) {
+		srv.admin = true
+	}
+}
+
+// WithDebugListener serves h, such as the handler of the debug package, on
+// lis while the server is serving.
+func WithDebugListener(lis net.Listener, h http.Handler) ServerOption {
+	return func(srv *ProxyServer) {
+		srv.debugLis, srv.debugHandler = lis, h
+	}
+}
+
+// WithStreamListener also serves the proxy service with ServeStreams on lis,
+// e.g. a listener of QUIC streams, while the server is serving.
+func WithStreamListener(lis net.Listener, opts ...StreamServerOption) ServerOption {
+	return func(srv *ProxyServer) {
+		srv.streamLis, srv.streamOpts = lis, opts
+	}
+}
+
 type ProxyServer struct {
 	service *ProxyServerService
 	grpcsrv *grpc.Server
+	health  *HealthChecker
+	admin   bool
+
+	debugLis     net.Listener
+	debugHandler http.Handler
+
+	streamLis  net.Listener
+	streamOpts []StreamServerOption
 }
 
-func NewProxyServer(grpcsrv *grpc.Server, service *ProxyServerService) *ProxyServer {
+func NewProxyServer(grpcsrv *grpc.Server, service *ProxyServerService, opts ...ServerOption) *ProxyServer {
 	RegisterProxyServiceServer(grpcsrv, service)
 
-	return &ProxyServer{
+	srv := &ProxyServer{
 		service: service,
 		grpcsrv: grpcsrv,
 	}
+	for _, opt := range opts {
+		opt(srv)
+	}
+	if srv.health != nil {
+		healthpb.RegisterHealthServer(grpcsrv, srv.health.HealthServer())
+	}
+	if srv.admin {
+		RegisterAdminServiceServer(grpcsrv, NewAdminServer(service))
+	}
+	return srv
 }
 
 func (srv *ProxyServer) Serve(lis net.Listener) error {
+	if srv.health != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go srv.health.Run(ctx)
+	}
+	if srv.debugLis != nil {
+		defer serveDebug(srv.debugLis, srv.debugHandler)()
+	}
+	if srv.streamLis != nil {
+		go ServeStreams(srv.streamLis, srv.service, srv.streamOpts...)
+		defer srv.streamLis.Close()
+	}
 	return srv.grpcsrv.Serve(lis)
 }
+
+// serveDebug serves h on lis until the returned function is called.
+func serveDebug(lis net.Listener, h http.Handler) func() error {
+	hs := &http.Server{Handler: h}
+	go hs.Serve(lis)
+	return hs.Close
+}
@@ -0,0 +1,448 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var errNoServers = errors.New("grproxy: no servers available")
+
+// ServerPolicy decides which grproxy server a tunnel is opened on.
+type ServerPolicy int
+
+const (
+	// PriorityPolicy uses servers in the configured order.
+	PriorityPolicy ServerPolicy = iota
+	// RoundRobinPolicy starts each tunnel at the next server.
+	RoundRobinPolicy
+	// LatencyPolicy prefers the server that opened streams fastest recently.
+	LatencyPolicy
+)
+
+type ServerPoolOption func(*ServerPool)
+
+// WithServerPolicy sets the server selection policy. The default is PriorityPolicy.
+func WithServerPolicy(p ServerPolicy) ServerPoolOption {
+	return func(pool *ServerPool) {
+		pool.policy = p
+	}
+}
+
+// WithCircuitBreaker skips a server for cooldown after failures consecutive
+// errors. After the cooldown a single tunnel is allowed to probe it again.
+func WithCircuitBreaker(failures int, cooldown time.Duration) ServerPoolOption {
+	return func(pool *ServerPool) {
+		pool.breakFailures = failures
+		pool.breakCooldown = cooldown
+	}
+}
+
+// ServerPool opens tunnels on one of several grproxy servers. When a server
+// fails to open the stream, before any data has flowed, the next server is
+// tried. ServerPool implements ProxyServiceClient and can be passed to
+// WithServiceClient.
+type ServerPool struct {
+	dial    func(ctx context.Context, endpoint string) (*grpc.ClientConn, error)
+	servers []*poolServer
+	policy  ServerPolicy
+
+	breakFailures int
+	breakCooldown time.Duration
+
+	mu     sync.Mutex
+	next   int
+	closed bool
+}
+
+type poolServer struct {
+	endpoint string
+
+	// guarded by ServerPool.mu
+	conn      *grpc.ClientConn
+	latency   time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewServerPool creates a pool of endpoints. dial is called lazily the first
+// time an endpoint is used.
+func NewServerPool(endpoints []string, dial func(ctx context.Context, endpoint string) (*grpc.ClientConn, error), opts ...ServerPoolOption) *ServerPool {
+	pool := &ServerPool{
+		dial:          dial,
+		breakFailures: 5,
+		breakCooldown: 30 * time.Second,
+	}
+	for _, endpoint := range endpoints {
+		pool.servers = append(pool.servers, &poolServer{endpoint: endpoint})
+	}
+	for _, opt := range opts {
+		opt(pool)
+	}
+	return pool
+}
+
+// Connect opens the stream on the first available server. Until the first
+// answer arrives, a Reject or an error moves the stream to the next server and
+// replays the Hello there.
+func (pool *ServerPool) Connect(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ConnectClient, error) {
+	s := &poolStream{pool: pool, ctx: ctx, opts: opts, rest: pool.candidates()}
+	if len(s.rest) == 0 {
+		return nil, errNoServers
+	}
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reattach opens the stream on the first available server, like Connect. The
+// session is only found when that is the server that opened it.
+func (pool *ServerPool) Reattach(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ReattachClient, error) {
+	servers := pool.candidates()
+	if len(servers) == 0 {
+		return nil, errNoServers
+	}
+
+	var lastErr error
+	for _, s := range servers {
+		if !pool.probe(s) {
+			continue
+		}
+		conn, err := pool.conn(ctx, s)
+		if err != nil {
+			pool.report(s, 0, err)
+			lastErr = err
+			continue
+		}
+
+		start := time.Now()
+		stream, err := NewProxyServiceClient(conn).Reattach(ctx, opts...)
+		pool.report(s, time.Since(start), err)
+		if err == nil {
+			return stream, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = errNoServers
+	}
+	return nil, lastErr
+}
+
+// Ready fails when no server is available: every circuit is open, or the
+// connection of the server is failing.
+func (pool *ServerPool) Ready(ctx context.Context) error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, s := range pool.servers {
+		if !s.openUntil.IsZero() {
+			continue
+		}
+		if s.conn != nil {
+			if state := s.conn.GetState(); state == connectivity.TransientFailure || state == connectivity.Shutdown {
+				continue
+			}
+		}
+		return nil
+	}
+	return errNoServers
+}
+
+// Close closes the connections to all servers.
+func (pool *ServerPool) Close() error {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	pool.closed = true
+	var err error
+	for _, s := range pool.servers {
+		if s.conn == nil {
+			continue
+		}
+		if cerr := s.conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		s.conn = nil
+	}
+	return err
+}
+
+// conn returns the connection to s, dialing it outside the lock the first time.
+func (pool *ServerPool) conn(ctx context.Context, s *poolServer) (*grpc.ClientConn, error) {
+	pool.mu.Lock()
+	conn := s.conn
+	pool.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := pool.dial(ctx, s.endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	switch {
+	case pool.closed:
+		conn.Close()
+		return nil, errors.New("grproxy: server pool closed")
+	case s.conn != nil:
+		// Another tunnel dialed it first.
+		conn.Close()
+		return s.conn, nil
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+// probe reports whether a tunnel may be opened on s. Only one tunnel at a time
+// probes a server whose circuit is half open.
+func (pool *ServerPool) probe(s *poolServer) bool {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if s.openUntil.IsZero() {
+		return true
+	}
+	if s.probing || time.Now().Before(s.openUntil) {
+		return false
+	}
+	s.probing = true
+	return true
+}
+
+// candidates returns the servers whose circuit is closed, or half open and not
+// being probed yet, in the order they should be tried.
+func (pool *ServerPool) candidates() []*poolServer {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	now := time.Now()
+	servers := make([]*poolServer, 0, len(pool.servers))
+	for _, s := range pool.servers {
+		switch {
+		case s.openUntil.IsZero():
+			servers = append(servers, s)
+		case now.After(s.openUntil) && !s.probing:
+			servers = append(servers, s)
+		}
+	}
+
+	switch pool.policy {
+	case RoundRobinPolicy:
+		if len(servers) > 0 {
+			i := pool.next % len(servers)
+			pool.next++
+			servers = append(servers[i:], servers[:i]...)
+		}
+	case LatencyPolicy:
+		sort.SliceStable(servers, func(i, j int) bool {
+			return servers[i].latency < servers[j].latency
+		})
+	}
+	return servers
+}
+
+func (pool *ServerPool) report(s *poolServer, latency time.Duration, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	s.probing = false
+	if err == nil {
+		s.failures = 0
+		s.openUntil = time.Time{}
+		if s.latency == 0 {
+			s.latency = latency
+		} else {
+			s.latency = (s.latency*7 + latency) / 8
+		}
+		return
+	}
+
+	s.failures++
+	if !s.openUntil.IsZero() || (pool.breakFailures > 0 && s.failures >= pool.breakFailures) {
+		s.openUntil = time.Now().Add(pool.breakCooldown)
+	}
+}
+
+// poolStream is a Connect stream of a ServerPool. Until the first answer of the
+// server arrives, only the Hello has been sent, so a Reject or an error can be
+// retried on the next server. Once data flows the stream stays where it is.
+type poolStream struct {
+	pool *ServerPool
+	ctx  context.Context
+	opts []grpc.CallOption
+
+	mu       sync.Mutex
+	stream   ProxyService_ConnectClient
+	server   *poolServer
+	rest     []*poolServer
+	start    time.Time
+	hello    *ReadWrite
+	answered bool
+	settled  bool
+}
+
+// next opens the stream on the next server that works and replays the Hello.
+// s.mu is held, or the stream is not shared yet.
+func (s *poolStream) next() error {
+	var lastErr error
+	for len(s.rest) > 0 && s.ctx.Err() == nil {
+		server := s.rest[0]
+		s.rest = s.rest[1:]
+		if !s.pool.probe(server) {
+			continue
+		}
+
+		start := time.Now()
+		stream, err := s.open(server)
+		if err != nil {
+			s.pool.report(server, 0, err)
+			lastErr = err
+			continue
+		}
+		s.stream, s.server, s.start, s.answered = stream, server, start, false
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = s.ctx.Err()
+	}
+	if lastErr == nil {
+		lastErr = errNoServers
+	}
+	return lastErr
+}
+
+func (s *poolStream) open(server *poolServer) (ProxyService_ConnectClient, error) {
+	conn, err := s.pool.conn(s.ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := NewProxyServiceClient(conn).Connect(s.ctx, s.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if s.hello != nil {
+		if err := stream.Send(s.hello); err != nil {
+			return nil, sendError(stream, err)
+		}
+	}
+	return stream, nil
+}
+
+// retry records the first answer of stream and moves to the next server when
+// it failed before any data has flowed.
+func (s *poolStream) retry(stream ProxyService_ConnectClient, failure error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stream != s.stream {
+		// The stream already moved on.
+		return true
+	}
+	if !s.answered {
+		s.answered = true
+		s.pool.report(s.server, time.Since(s.start), serverError(failure))
+	}
+	if failure == nil || s.settled {
+		s.settled = true
+		return false
+	}
+	return s.next() == nil
+}
+
+func (s *poolStream) current() ProxyService_ConnectClient {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stream
+}
+
+func (s *poolStream) Send(rw *ReadWrite) error {
+	s.mu.Lock()
+	if !s.settled {
+		if rw.GetHello() != nil {
+			s.hello = proto.Clone(rw).(*ReadWrite)
+		} else {
+			s.settled = true
+		}
+	}
+	stream, settled := s.stream, s.settled
+	s.mu.Unlock()
+
+	err := stream.Send(rw)
+	if err == nil || settled {
+		return err
+	}
+	err = sendError(stream, err)
+	if s.retry(stream, err) {
+		return nil
+	}
+	return err
+}
+
+func (s *poolStream) Recv() (*ReadWrite, error) {
+	for {
+		stream := s.current()
+		rw, err := stream.Recv()
+		failure := err
+		if err == io.EOF {
+			// The server ended the stream cleanly.
+			failure = nil
+		}
+		if reject := rw.GetReject(); err == nil && reject != nil {
+			failure = status.Error(codes.Code(reject.Code), reject.Message)
+		}
+		if !s.retry(stream, failure) {
+			return rw, err
+		}
+	}
+}
+
+func (s *poolStream) Header() (metadata.MD, error) { return s.current().Header() }
+func (s *poolStream) Trailer() metadata.MD         { return s.current().Trailer() }
+func (s *poolStream) CloseSend() error             { return s.current().CloseSend() }
+func (s *poolStream) Context() context.Context     { return s.current().Context() }
+func (s *poolStream) SendMsg(m interface{}) error  { return s.current().SendMsg(m) }
+func (s *poolStream) RecvMsg(m interface{}) error  { return s.current().RecvMsg(m) }
+
+// sendError returns the status that broke stream when Send fails with io.EOF.
+func sendError(stream ProxyService_ConnectClient, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if _, err := stream.Recv(); err != nil {
+		return err
+	}
+	return status.Error(codes.Unavailable, "grproxy: stream closed")
+}
+
+// serverError is the part of a failure that counts against the server. A
+// server that answers with a Reject is healthy unless it is unavailable or
+// overloaded.
+func serverError(err error) error {
+	if st, ok := status.FromError(err); ok {
+		switch st.Code() {
+		case codes.OK, codes.InvalidArgument, codes.NotFound, codes.PermissionDenied,
+			codes.Unauthenticated, codes.FailedPrecondition, codes.Unimplemented:
+			return nil
+		}
+	}
+	return err
+}
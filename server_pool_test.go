@@ -0,0 +1,271 @@
+package grproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type namedProxyServer struct {
+	UnimplementedProxyServiceServer
+
+	name   string
+	reject error // answers the Hello with a Reject
+}
+
+func (s *namedProxyServer) Connect(srv ProxyService_ConnectServer) error {
+	if s.reject != nil {
+		if _, err := srv.Recv(); err != nil {
+			return err
+		}
+		return sendReject(srv, s.reject)
+	}
+	return srv.Send(&ReadWrite{Buf: []byte(s.name), Len: int32(len(s.name))})
+}
+
+func insecureDial(ctx context.Context, endpoint string) (*grpc.ClientConn, error) {
+	return grpc.DialContext(ctx, endpoint, grpc.WithInsecure())
+}
+
+func connectName(t *testing.T, pool *ServerPool) (string, error) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	stream, err := pool.Connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	rw, err := stream.Recv()
+	if err != nil {
+		return "", err
+	}
+	return string(rw.Buf), nil
+}
+
+func Test_ServerPool_policy(t *testing.T) {
+	t.Parallel()
+
+	a, stopA := startProxyServer(t, &namedProxyServer{name: "a"})
+	defer stopA()
+	b, stopB := startProxyServer(t, &namedProxyServer{name: "b"})
+	defer stopB()
+	down := stoppedAddr(t)
+
+	tests := map[string]struct {
+		endpoints []string
+		policy    ServerPolicy
+		want      []string
+	}{
+		"priority": {
+			endpoints: []string{a, b},
+			policy:    PriorityPolicy,
+			want:      []string{"a", "a", "a"},
+		},
+		"priority failover": {
+			endpoints: []string{down, b, a},
+			policy:    PriorityPolicy,
+			want:      []string{"b", "b"},
+		},
+		"round robin": {
+			endpoints: []string{a, b},
+			policy:    RoundRobinPolicy,
+			want:      []string{"a", "b", "a"},
+		},
+		"latency": {
+			endpoints: []string{down, a},
+			policy:    LatencyPolicy,
+			want:      []string{"a", "a"},
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			pool := NewServerPool(tc.endpoints, insecureDial, WithServerPolicy(tc.policy))
+			defer pool.Close()
+
+			for i, want := range tc.want {
+				got, err := connectName(t, pool)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != want {
+					t.Errorf("unexpected server %d got:%s want:%s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_ServerPool_circuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	a, stopA := startProxyServer(t, &namedProxyServer{name: "a"})
+	defer stopA()
+	down := stoppedAddr(t)
+
+	pool := NewServerPool([]string{down, a}, insecureDial, WithCircuitBreaker(2, 500*time.Millisecond))
+	defer pool.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := connectName(t, pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := pool.candidates(); len(got) != 1 || got[0].endpoint != a {
+		t.Fatalf("unexpected candidates: %v", got)
+	}
+	if err := pool.Ready(context.TODO()); err != nil {
+		t.Errorf("unexpected readiness: %v", err)
+	}
+
+	// After the cooldown one tunnel probes the broken server again. Listing
+	// the candidates alone doesn't start a probe.
+	time.Sleep(600 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if got := pool.candidates(); len(got) != 2 {
+			t.Fatalf("unexpected candidates: %v", got)
+		}
+	}
+	broken := pool.candidates()[0]
+	if !pool.probe(broken) {
+		t.Fatal("unexpected probe refused")
+	}
+	if got := pool.candidates(); len(got) != 1 {
+		t.Fatalf("unexpected candidates while probing: %v", got)
+	}
+	if pool.probe(broken) {
+		t.Error("unexpected second probe")
+	}
+	pool.report(broken, 0, errors.New("error"))
+
+	// The failed probe opens the circuit again.
+	if got, err := connectName(t, pool); err != nil || got != "a" {
+		t.Fatalf("unexpected result: %s %v", got, err)
+	}
+	if got := pool.candidates(); len(got) != 1 || got[0].endpoint != a {
+		t.Fatalf("unexpected candidates: %v", got)
+	}
+}
+
+func Test_ServerPool_reject(t *testing.T) {
+	t.Parallel()
+
+	a, stopA := startProxyServer(t, &namedProxyServer{name: "a"})
+	defer stopA()
+	draining, stopDraining := startProxyServer(t, &namedProxyServer{reject: status.Error(codes.Unavailable, "draining")})
+	defer stopDraining()
+	denied, stopDenied := startProxyServer(t, &namedProxyServer{reject: status.Error(codes.PermissionDenied, "denied")})
+	defer stopDenied()
+	closed, stopClosed := startProxyServer(t, &namedProxyServer{reject: status.Error(codes.Unavailable, "closed")})
+	stopClosed()
+
+	tests := map[string]struct {
+		endpoints  []string
+		want       string
+		wantCode   codes.Code
+		candidates int
+	}{
+		"first rejects": {
+			endpoints:  []string{draining, a},
+			want:       "a",
+			candidates: 1,
+		},
+		"first closed": {
+			endpoints:  []string{closed, a},
+			want:       "a",
+			candidates: 1,
+		},
+		"rejected by a healthy server": {
+			endpoints:  []string{denied, a},
+			want:       "a",
+			candidates: 2,
+		},
+		"all reject": {
+			endpoints:  []string{draining, denied},
+			wantCode:   codes.PermissionDenied,
+			candidates: 1,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			pool := NewServerPool(tc.endpoints, insecureDial, WithCircuitBreaker(1, time.Minute))
+			defer pool.Close()
+
+			ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+			defer cancel()
+			stream, err := pool.Connect(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := stream.Send(&ReadWrite{Control: &ReadWrite_Hello{Hello: &Hello{Target: "db"}}}); err != nil {
+				t.Fatal(err)
+			}
+			rw, err := stream.Recv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reject := rw.GetReject(); codes.Code(reject.GetCode()) != tc.wantCode || string(rw.Buf) != tc.want {
+				t.Errorf("unexpected result: %v", rw)
+			}
+			if got := pool.candidates(); len(got) != tc.candidates {
+				t.Errorf("unexpected candidates: %v", got)
+			}
+		})
+	}
+}
+
+func Test_ServerPool_allDown(t *testing.T) {
+	t.Parallel()
+
+	pool := NewServerPool([]string{stoppedAddr(t)}, insecureDial, WithCircuitBreaker(1, time.Minute))
+	defer pool.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := connectName(t, pool); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if err := pool.Ready(context.TODO()); err == nil {
+		t.Error("unexpected readiness")
+	}
+}
+
+func Test_ProxyClientServer_serviceClient(t *testing.T) {
+	t.Parallel()
+
+	a, stopA := startProxyServer(t, &namedProxyServer{name: "a"})
+	defer stopA()
+	pool := NewServerPool([]string{stoppedAddr(t), a}, insecureDial)
+	defer pool.Close()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	srv := NewProxyClientServer(NewProxyClientService(nil), WithServiceClient(pool))
+	go srv.Serve(lis)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := make([]byte, 1)
+	if _, err := conn.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a" {
+		t.Errorf("unexpected result: %s", b)
+	}
+}
@@ -2,36 +2,518 @@ package grproxy
 
 import (
 	"context"
+	"io"
 	"net"
+	"sync"
 
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// IdentityFunc returns the client identity of a stream. It is usually backed
+// by whatever an authentication interceptor stored in the context.
+type IdentityFunc func(ctx context.Context) string
+
+type identityKey struct{}
+
+// IdentityFromContext returns the identity the server authenticated the
+// client of a Connect stream as. Dialers passed to NewProxyServerService can
+// use it.
+func IdentityFromContext(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(string)
+	return identity, ok
+}
+
+type ServerServiceOption func(*ProxyServerService)
+
+// WithIdentity sets the function used to identify clients.
+func WithIdentity(f IdentityFunc) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.identity = f
+	}
+}
+
+// WithRateLimiter limits the bandwidth of every tunnel.
+func WithRateLimiter(l *RateLimiter) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.limiter = l
+	}
+}
+
+// WithAdmission caps the number of concurrent tunnels. Rejected streams fail
+// with codes.ResourceExhausted.
+func WithAdmission(a *AdmissionController) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.admission = a
+	}
+}
+
+// WithCompression offers payload compression to clients that ask for it in
+// the handshake.
+func WithCompression(c Compression) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.compression = &c
+	}
+}
+
+// WithBatching coalesces small backend reads into larger frames.
+func WithBatching(b Batching) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.batching = &b
+	}
+}
+
+// WithKeepalive pings clients whose tunnels are idle and closes the tunnels
+// of clients that stop answering.
+func WithKeepalive(k Keepalive) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.keepalive = &k
+	}
+}
+
+// WithRecorder records the tunnels selected by the recorder.
+func WithRecorder(r *Recorder) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.recorder = r
+	}
+}
+
+// WithInspector inspects every tunnel with the given inspectors. They are
+// applied as filters after those of WithFilters.
+func WithInspector(inspectors ...Inspector) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		for _, i := range inspectors {
+			svc.filters = append(svc.filters, InspectorFilter(i))
+		}
+	}
+}
+
+// WithFilters applies the filters to every tunnel.
+func WithFilters(filters ...StreamFilter) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.filters = append(svc.filters, filters...)
+	}
+}
+
+// WithFilterRegistry applies the filters enabled in r for the route of each
+// tunnel, after those of WithFilters.
+func WithFilterRegistry(r *FilterRegistry) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.registry = r
+	}
+}
+
+// WithResumption keeps the tunnels of clients that ask for it open for a while
+// after their stream fails, so that they can reattach. Batching does not
+// apply to resumable tunnels.
+func WithResumption(r Resumption) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.resumption = &r
+	}
+}
+
+// WithProxyProtocol writes a PROXY protocol header on every backend
+// connection.
+func WithProxyProtocol(p ProxyProtocol) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.proxyProtocol = &p
+	}
+}
+
+// WithTrustedSourceAddr takes the addresses of the PROXY protocol header from
+// the Hello of the clients whose identity trusted accepts, such as grproxy
+// clients run by the operator. Other clients could claim any address.
+func WithTrustedSourceAddr(trusted func(identity string) bool) ServerServiceOption {
+	return func(svc *ProxyServerService) {
+		svc.trustedSourceAddr = trusted
+	}
+}
+
 type ProxyServerService struct {
-	dialer func(ctx context.Context) (net.Conn, error)
+	dialer      func(ctx context.Context) (net.Conn, error)
+	identity    IdentityFunc
+	limiter     *RateLimiter
+	admission   *AdmissionController
+	compression *Compression
+	batching    *Batching
+	resumption  *Resumption
+	keepalive   *Keepalive
+	recorder    *Recorder
+	filters     []StreamFilter
+	registry    *FilterRegistry
+
+	proxyProtocol     *ProxyProtocol
+	trustedSourceAddr func(identity string) bool
+
+	mu       sync.Mutex
+	sessions map[string]*session
+	drained  map[string]bool
+
+	tunnels *tunnelTable
 }
 
-func NewProxyServerService(dialer func(ctx context.Context) (net.Conn, error)) *ProxyServerService {
-	return &ProxyServerService{
-		dialer: dialer,
+func NewProxyServerService(dialer func(ctx context.Context) (net.Conn, error), opts ...ServerServiceOption) *ProxyServerService {
+	svc := &ProxyServerService{
+		dialer:   dialer,
+		identity: func(context.Context) string { return "" },
+		sessions: make(map[string]*session),
+		drained:  make(map[string]bool),
+		tunnels:  newTunnelTable("server"),
+	}
+	for _, opt := range opts {
+		opt(svc)
 	}
+	return svc
 }
 
 func (svc *ProxyServerService) Connect(srv ProxyService_ConnectServer) error {
 	ctx := srv.Context()
-	conn, err := svc.dialer(ctx)
+	hello, err := recvHello(srv)
+	if err != nil {
+		return err
+	}
+	if hello != nil {
+		ctx = withHello(ctx, hello)
+	}
+
+	identity := svc.identity(ctx)
+	ctx = context.WithValue(ctx, identityKey{}, identity)
+	conn, release, err := svc.open(ctx, identity)
+	if err != nil {
+		if hello != nil {
+			sendReject(srv, err)
+		}
+		return err
+	}
+	var sess *session
+	defer func() {
+		if sess == nil {
+			conn.Close()
+			release()
+		}
+	}()
+
+	var (
+		version  uint32
+		sendrw   = srv.Send
+		recv     = srv.Recv
+		encoding Encoding
+		hb       *heartbeat
+	)
+	if hello != nil {
+		version = negotiateVersion(hello.Version)
+		supported := []string{keepaliveCapability}
+		supported = append(supported, svc.compression.capabilities()...)
+		supported = append(supported, svc.resumption.capabilities()...)
+		caps := negotiateCapabilities(hello.Capabilities, supported)
+		accept := &Accept{
+			Version:      version,
+			Capabilities: caps,
+			RemoteAddr:   remoteAddr(conn),
+		}
+		if hasCapability(caps, resumeCapability) {
+			accept.SessionId = newSessionID()
+		}
+		if err := sendAccept(srv, accept); err != nil {
+			return err
+		}
+		if hasCapability(caps, keepaliveCapability) {
+			hb, sendrw = newHeartbeat(svc.keepalive, sendrw)
+			recv = hb.recv(recv)
+		}
+		if encoding = negotiatedEncoding(caps); encoding != Encoding_IDENTITY {
+			comp := newCompressor(svc.compression, encoding)
+			sendrw = comp.sender(sendrw)
+			if svc.compression.Stats != nil {
+				defer func() { svc.compression.Stats(comp.Stats()) }()
+			}
+		}
+		if accept.SessionId != "" {
+			s, err := svc.newSession(ctx, accept.SessionId, identity, conn, release)
+			if err != nil {
+				return err
+			}
+			sess = s
+			sess.encoding = encoding
+			return svc.serveSession(ctx, sess, 0, 0, sendrw, newDecompressor(recv), hb)
+		}
+	}
+
+	ctx, kill := context.WithCancel(ctx)
+	defer kill()
+	t := svc.addTunnel(ctx, tunnelInfo(ctx, identity, conn), false, kill)
+	defer svc.tunnels.remove(t)
+	info := t.info
+	rt := svc.recorder.start(info)
+	defer rt.close()
+	fc, err := openFilters(ctx, info, routeFilters(svc.filters, svc.registry, info.Target))
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
 
+	ctx, stop := hb.start(ctx)
 	eg, ctx := errgroup.WithContext(ctx)
+	var (
+		w          io.Writer = conn
+		src        io.Reader = conn
+		recvr                = receiverFor(version, newDecompressor(recv))
+		send       io.Writer = newSender(sendrw)
+		flush                = func() error { return nil }
+		closeBatch           = func() {}
+	)
+	if svc.batching != nil {
+		bs := newBatchSender(sendrw, *svc.batching)
+		send, src, flush, closeBatch = bs, bs.reader(conn), bs.Flush, bs.Close
+	}
+	if svc.limiter != nil {
+		target := remoteAddr(conn)
+		w = svc.limiter.writer(ctx, w, Upstream, identity, target)
+		send = svc.limiter.writer(ctx, send, Downstream, identity, target)
+	}
+	w, send = rt.writer(w, Upstream), rt.writer(send, Downstream)
+	w, send = t.counter(w, Upstream), t.counter(send, Downstream)
+	w, send = fc.writer(Upstream, w), fc.writer(Downstream, send)
+	recvr, src = fc.reader(Upstream, recvr), fc.reader(Downstream, src)
+
 	eg.Go(func() error {
-		return proxy(ctx, conn, newReceiver(srv.Recv), make([]byte, 4096))
+		err := proxy(ctx, conn, w, recvr, make([]byte, 4096))
+		if err == nil {
+			closeWrite(conn)
+		}
+		return err
 	})
 	eg.Go(func() error {
-		return proxy(ctx, newSender(srv.Send), conn, make([]byte, 4096))
+		defer closeBatch()
+		err := proxy(ctx, conn, send, src, make([]byte, 4096))
+		if ctx.Err() != nil {
+			return err
+		}
+		if ferr := flush(); err == nil {
+			err = ferr
+		}
+		if version >= 2 {
+			if cerr := sendClose(sendrw, err); err == nil {
+				err = cerr
+			}
+		}
+		return err
 	})
 
-	return eg.Wait()
+	err = stop(eg.Wait())
+	if t.isKilled() {
+		err = errTunnelKilled
+	}
+	fc.close(err)
+	return err
+}
+
+// Reattach continues a resumable tunnel on a new stream.
+func (svc *ProxyServerService) Reattach(srv ProxyService_ReattachServer) error {
+	ctx := srv.Context()
+	rw, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+	resume := rw.GetResume()
+	if resume == nil {
+		return status.Error(codes.InvalidArgument, "grproxy: expected resume")
+	}
+
+	sess := svc.session(resume.SessionId, svc.identity(ctx))
+	if sess == nil {
+		err := status.Error(codes.NotFound, "grproxy: unknown session")
+		sendReject(srv, err)
+		return err
+	}
+	gen, ack, ok := sess.attach()
+	if !ok {
+		err := status.Error(codes.NotFound, "grproxy: session ended")
+		sendReject(srv, err)
+		return err
+	}
+	if err := srv.Send(&ReadWrite{Control: &ReadWrite_Resume{Resume: &Resume{SessionId: sess.id, Ack: ack}}}); err != nil {
+		sess.detach(gen, svc.resumption.timeout())
+		return err
+	}
+
+	hb, send := newHeartbeat(svc.keepalive, srv.Send)
+	if sess.encoding != Encoding_IDENTITY {
+		send = newCompressor(svc.compression, sess.encoding).sender(send)
+	}
+	return svc.serveSession(ctx, sess, gen, resume.Ack, send, newDecompressor(hb.recv(srv.Recv)), hb)
+}
+
+// newSession registers a resumable tunnel and starts reading conn.
+func (svc *ProxyServerService) newSession(ctx context.Context, id, identity string, conn net.Conn, release func()) (*session, error) {
+	sess := newSession(id, conn, svc.resumption.bufferSize())
+	sess.identity = identity
+	t := svc.addTunnel(ctx, tunnelInfo(ctx, identity, conn), true, sess.close)
+	info := t.info
+	fc, err := openFilters(sess.ctx, info, routeFilters(svc.filters, svc.registry, info.Target))
+	if err != nil {
+		svc.tunnels.remove(t)
+		return nil, err
+	}
+	rt := svc.recorder.start(info)
+	sess.release = func() {
+		svc.mu.Lock()
+		delete(svc.sessions, id)
+		svc.mu.Unlock()
+		svc.tunnels.remove(t)
+		fc.close(nil)
+		rt.close()
+		release()
+	}
+
+	var w io.Writer = sess
+	if svc.limiter != nil {
+		target := remoteAddr(conn)
+		sess.w = svc.limiter.writer(sess.ctx, conn, Upstream, identity, target)
+		w = svc.limiter.writer(sess.ctx, sess, Downstream, identity, target)
+	}
+	sess.w, w = rt.writer(sess.w, Upstream), rt.writer(w, Downstream)
+	sess.w, w = t.counter(sess.w, Upstream), t.counter(w, Downstream)
+	sess.w, w = fc.writer(Upstream, sess.w), fc.writer(Downstream, w)
+
+	svc.mu.Lock()
+	svc.sessions[id] = sess
+	svc.mu.Unlock()
+
+	go sess.pump(fc.reader(Downstream, conn), w)
+	return sess, nil
+}
+
+func (svc *ProxyServerService) session(id, identity string) *session {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	sess, ok := svc.sessions[id]
+	if !ok || sess.identity != identity {
+		return nil
+	}
+	return sess
+}
+
+// serveSession carries sess over a stream. When the stream fails, the session
+// is kept for the resumption timeout.
+func (svc *ProxyServerService) serveSession(ctx context.Context, sess *session, gen int, peerAck uint64, send func(*ReadWrite) error, recv func() (*ReadWrite, error), hb *heartbeat) error {
+	ctx, stop := hb.start(ctx)
+	err := stop(sess.run(ctx, gen, peerAck, send, recv))
+	if err == ErrKeepaliveTimeout {
+		err = &streamError{err: err}
+	}
+	switch {
+	case err == errSuperseded:
+		return status.Error(codes.Aborted, err.Error())
+	case isStreamError(err):
+		sess.detach(gen, svc.resumption.timeout())
+		return err
+	default:
+		sess.close()
+		return err
+	}
+}
+
+// open admits the tunnel, unless its target is drained, dials the backend and
+// writes the PROXY protocol header, if any. Tunnels with hops left must be
+// forwarded by the dialer, see HopDialer. The returned function releases
+// the admission slots.
+func (svc *ProxyServerService) open(ctx context.Context, identity string) (net.Conn, func(), error) {
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	target, hasTarget := TargetFromContext(ctx)
+	if hasTarget {
+		if err := svc.checkDrained(target); err != nil {
+			return nil, nil, err
+		}
+	}
+	if svc.admission != nil {
+		r, err := svc.admission.Acquire(ctx, identity)
+		if err != nil {
+			return nil, nil, admissionError(err)
+		}
+		releases = append(releases, r)
+	}
+	// A named target is admitted before dialing, so that the cap also limits
+	// the connections to the backend.
+	if svc.admission != nil && hasTarget {
+		r, err := svc.admission.AcquireTarget(ctx, target)
+		if err != nil {
+			release()
+			return nil, nil, admissionError(err)
+		}
+		releases = append(releases, r)
+	}
+
+	conn, err := svc.dialer(ctx)
+	if err != nil {
+		release()
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, nil, err
+	}
+	_, forwarded := conn.(*hopConn)
+	if hello, ok := HelloFromContext(ctx); ok && len(hello.Hops) > 0 && !forwarded {
+		conn.Close()
+		release()
+		return nil, nil, status.Error(codes.Unimplemented, "grproxy: server does not forward to hops")
+	}
+	if !hasTarget {
+		if err := svc.checkDrained(remoteAddr(conn)); err != nil {
+			conn.Close()
+			release()
+			return nil, nil, err
+		}
+	}
+
+	if svc.admission != nil && !hasTarget {
+		r, err := svc.admission.AcquireTarget(ctx, remoteAddr(conn))
+		if err != nil {
+			conn.Close()
+			release()
+			return nil, nil, admissionError(err)
+		}
+		releases = append(releases, r)
+	}
+
+	// The last hop writes the header of forwarded tunnels.
+	if svc.proxyProtocol != nil && !forwarded {
+		trusted := svc.trustedSourceAddr != nil && svc.trustedSourceAddr(identity)
+		src, dst := proxyAddrs(ctx, conn, trusted)
+		if _, err := conn.Write(svc.proxyProtocol.header(src, dst, identity)); err != nil {
+			conn.Close()
+			release()
+			return nil, nil, status.Error(codes.Unavailable, err.Error())
+		}
+	}
+
+	return conn, release, nil
+}
+
+func remoteAddr(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func localAddr(conn net.Conn) string {
+	if addr := conn.LocalAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+func admissionError(err error) error {
+	if err == ErrTooManyTunnels {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return err
 }
@@ -6,7 +6,12 @@ import (
 	"errors"
 	"net"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type mockServer struct {
@@ -55,6 +60,18 @@ func (m *mockConn) Close() error {
 	return m.mockClose()
 }
 
+func (m *mockConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func (m *mockConn) LocalAddr() net.Addr {
+	return nil
+}
+
+func (m *mockConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
 func Test_ProxyService(t *testing.T) {
 	t.Parallel()
 
@@ -336,3 +353,78 @@ func Test_ProxyService(t *testing.T) {
 		})
 	}
 }
+
+func Test_ProxyService_admission(t *testing.T) {
+	t.Parallel()
+
+	a := NewAdmissionController(ConcurrencyLimits{Total: 1})
+	release, err := a.Acquire(context.TODO(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	svc := NewProxyServerService(
+		func(ctx context.Context) (net.Conn, error) {
+			t.Fatal("unexpected dial")
+			return nil, nil
+		},
+		WithAdmission(a),
+	)
+	err = svc.Connect(&mockServer{
+		mockContext: func() context.Context {
+			return context.TODO()
+		},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func Test_ProxyService_admissionTarget(t *testing.T) {
+	t.Parallel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	var accepts int32
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepts, 1)
+			conn.Close()
+		}
+	}()
+
+	a := NewAdmissionController(ConcurrencyLimits{Target: 1})
+	release, err := a.AcquireTarget(context.TODO(), "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", lis.Addr().String())
+	}, WithAdmission(a))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		remote, errc := bindPipe(NewProxyClientService(nil, WithHello(&Hello{Target: "db"})), proxycli)
+		if err := <-errc; status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("unexpected error: %v", err)
+		}
+		remote.Close()
+	}
+	if n := atomic.LoadInt32(&accepts); n != 0 {
+		t.Errorf("unexpected backend accepts: %d", n)
+	}
+	if counts := a.Counts(); counts.Targets["db"] != 1 {
+		t.Errorf("unexpected counts: %+v", counts)
+	}
+}
@@ -0,0 +1,91 @@
+package grproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func Test_ProxyServer_debugListener(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcsrv := grpc.NewServer()
+	go NewProxyServer(grpcsrv, svc, WithDebugListener(debugLis, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(svc.Tunnels())
+	}))).Serve(lis)
+	defer grpcsrv.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cli := NewProxyClientService(nil, WithHello(&Hello{Target: "echo"}))
+	lister := cli.(TunnelLister)
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- cli.Bind(context.TODO(), NewProxyServiceClient(conn), local)
+	}()
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	remote.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(remote, b); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.Get("http://" + debugLis.Addr().String() + "/tunnels")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []TunnelStatus
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	client := lister.Tunnels()
+	if len(got) != 1 || len(client) != 1 || got[0].ID != client[0].ID || got[0].Target != "echo" || got[0].UpstreamBytes != 4 || got[0].DownstreamBytes != 4 {
+		t.Errorf("unexpected tunnels: %+v %+v", got, client)
+	}
+	if c := client[0]; c.UpstreamBytes != 4 || c.DownstreamBytes != 4 || c.Peer == "" {
+		t.Errorf("unexpected client tunnel: %+v", c)
+	}
+	if counters := TunnelCounters(); counters["server.tunnels_open"] < 1 || counters["client.bytes_upstream"] < 4 {
+		t.Errorf("unexpected counters: %v", counters)
+	}
+
+	remote.(*net.TCPConn).CloseWrite()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if got := lister.Tunnels(); len(got) != 0 {
+		t.Errorf("unexpected tunnels: %+v", got)
+	}
+}
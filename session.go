@@ -0,0 +1,494 @@
+package grproxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// resumeCapability is negotiated in the handshake to make a tunnel resumable.
+const resumeCapability = "resume"
+
+// Resumption configures resumable tunnels. The data read from a connection is
+// kept until the peer acknowledges it, so that a tunnel whose stream failed
+// can continue on a new stream without losing data.
+type Resumption struct {
+	// BufferSize is the number of unacknowledged bytes kept. Reading from the
+	// connection pauses while the buffer is full. It defaults to 1 MiB.
+	BufferSize int
+	// Timeout is how long the server keeps a detached tunnel, and how long the
+	// client tries to reattach it. It defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+func (r *Resumption) bufferSize() int {
+	if r.BufferSize > 0 {
+		return r.BufferSize
+	}
+	return 1 << 20
+}
+
+func (r *Resumption) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return 30 * time.Second
+}
+
+func (r *Resumption) capabilities() []string {
+	if r == nil {
+		return nil
+	}
+	return []string{resumeCapability}
+}
+
+func hasCapability(caps []string, c string) bool {
+	for _, x := range caps {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// maxSessionFrame is the largest payload sent in one frame.
+	maxSessionFrame = 32 << 10
+	// Received data is acknowledged once ackBytes are pending, or ackDelay
+	// after the first pending byte.
+	ackBytes = 32 << 10
+	ackDelay = 10 * time.Millisecond
+)
+
+var (
+	errSuperseded   = errors.New("grproxy: session reattached on another stream")
+	errSessionGap   = errors.New("grproxy: frame beyond the expected offset")
+	errInvalidAck   = errors.New("grproxy: acknowledgement beyond the sent data")
+	errSessionEnded = errors.New("grproxy: session ended")
+)
+
+// streamError is a failure of the stream carrying a session. The session can
+// be resumed on a new stream.
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+func isStreamError(err error) bool {
+	_, ok := err.(*streamError)
+	return ok
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// session is one end of a resumable tunnel. It outlives the streams carrying
+// it: the data read from conn is kept until the peer acknowledges it, and
+// frames are numbered by byte offset so that replayed data is written to conn
+// only once.
+type session struct {
+	id       string
+	identity string
+	conn     net.Conn
+	// w writes to conn. It may be wrapped, e.g. to limit the bandwidth.
+	w        io.Writer
+	size     int
+	encoding Encoding
+	release  func()
+	// client is set on the client end, which waits for the server to end the
+	// stream of a complete tunnel.
+	client bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wmu serializes receiving, so that a superseded stream cannot write to
+	// conn after the session was reattached.
+	wmu sync.Mutex
+
+	mu         sync.Mutex
+	changed    chan struct{}
+	gen        int // guarded by wmu and mu
+	stop       context.CancelFunc
+	timer      *time.Timer
+	closed     bool
+	buf        []byte // read from conn and not acknowledged
+	base       uint64 // offset of buf[0]
+	readErr    error  // why reading conn ended
+	closeAcked bool
+	recvd      uint64 // offset of the next byte expected from the peer
+	peerClosed bool
+}
+
+func newSession(id string, conn net.Conn, size int) *session {
+	s := &session{
+		id:      id,
+		conn:    conn,
+		w:       conn,
+		size:    size,
+		changed: make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// signal wakes up everyone waiting for a change. It must be called with mu
+// held.
+func (s *session) signal() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Write appends b to the replay buffer, waiting while the buffer is full.
+func (s *session) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		s.mu.Lock()
+		if free := s.size - len(s.buf); free > 0 {
+			if free > len(b) {
+				free = len(b)
+			}
+			s.buf = append(s.buf, b[:free]...)
+			b = b[free:]
+			s.signal()
+			s.mu.Unlock()
+			continue
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-s.ctx.Done():
+			return n - len(b), s.ctx.Err()
+		}
+	}
+	return n, nil
+}
+
+// pump reads r, which is conn or wraps it, into the replay buffer through w,
+// which is s or wraps it.
+func (s *session) pump(r io.Reader, w io.Writer) {
+	_, err := io.CopyBuffer(w, r, make([]byte, 4096))
+	if err == nil {
+		err = io.EOF
+	}
+
+	s.mu.Lock()
+	s.readErr = err
+	s.signal()
+	s.mu.Unlock()
+}
+
+// attach supersedes the stream carrying the session. It returns the
+// generation of the new stream and the offset of the next byte expected from
+// the peer.
+func (s *session) attach() (int, uint64, bool) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, 0, false
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.stop != nil {
+		s.stop()
+	}
+	s.gen++
+	return s.gen, s.recvd, true
+}
+
+// detach closes the session unless the stream of generation gen is replaced
+// within timeout.
+func (s *session) detach(gen int, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.gen != gen {
+		return
+	}
+	s.timer = time.AfterFunc(timeout, s.close)
+}
+
+func (s *session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.cancel()
+	if s.stop != nil {
+		s.stop()
+	}
+	s.mu.Unlock()
+
+	s.conn.Close()
+	if s.release != nil {
+		s.release()
+	}
+}
+
+// run carries the session over the stream of generation gen until the tunnel
+// is complete, the stream fails or ctx is done. peerAck is the offset of the
+// next byte the peer expects. A failed stream is reported as a *streamError.
+func (s *session) run(ctx context.Context, gen int, peerAck uint64, send func(*ReadWrite) error, recv func() (*ReadWrite, error)) error {
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errSessionEnded
+	}
+	if s.gen != gen {
+		s.mu.Unlock()
+		return errSuperseded
+	}
+	s.stop = cancel
+	err := s.ackLocked(peerAck)
+	next := s.base
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	recvc, sendc := make(chan error, 1), make(chan error, 1)
+	go func() {
+		recvc <- s.recvLoop(gen, recv)
+	}()
+	go func() {
+		sendc <- s.sendLoop(runCtx, next, send)
+	}()
+
+	select {
+	case err = <-recvc:
+	case err = <-sendc:
+		if err == nil && s.client {
+			// Ending the stream first would make the server keep the session
+			// for resumption.
+			select {
+			case err = <-recvc:
+			case <-runCtx.Done():
+			}
+		}
+	case <-runCtx.Done():
+	}
+	if runCtx.Err() == nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return &streamError{err: err}
+	}
+	if s.ctx.Err() != nil {
+		return errSessionEnded
+	}
+	return errSuperseded
+}
+
+func (s *session) sendLoop(ctx context.Context, next uint64, send func(*ReadWrite) error) error {
+	var (
+		ackSent   uint64
+		closeSent bool
+		ackDue    <-chan time.Time
+		force     bool
+	)
+	for {
+		rw := &ReadWrite{}
+
+		s.mu.Lock()
+		end := s.base + uint64(len(s.buf))
+		switch {
+		case next < end:
+			b := s.buf[next-s.base:]
+			if len(b) > maxSessionFrame {
+				b = b[:maxSessionFrame]
+			}
+			rw.Buf, rw.Len, rw.Seq = b, int32(len(b)), next
+			next += uint64(len(b))
+		case s.readErr != nil && !closeSent && !s.closeAcked:
+			err := s.readErr
+			if err == io.EOF {
+				err = nil
+			}
+			rw = closeFrame(err)
+			rw.Seq = end
+			closeSent = true
+		case s.recvd > ackSent && (force || s.peerClosed || s.recvd-ackSent >= ackBytes):
+			// Only an acknowledgement.
+		case s.closeAcked && s.peerClosed:
+			s.mu.Unlock()
+			return nil
+		default:
+			if s.recvd > ackSent && ackDue == nil {
+				ackDue = time.After(ackDelay)
+			}
+			changed := s.changed
+			s.mu.Unlock()
+
+			select {
+			case <-changed:
+			case <-ackDue:
+				ackDue, force = nil, true
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		rw.Ack = s.recvd
+		ackSent = s.recvd
+		s.mu.Unlock()
+
+		// The payload aliases the replay buffer, which is only appended to
+		// and resliced, so it stays valid without holding the lock.
+		if err := send(rw); err != nil {
+			return &streamError{err: err}
+		}
+		ackDue, force = nil, false
+	}
+}
+
+func (s *session) recvLoop(gen int, recv func() (*ReadWrite, error)) error {
+	for {
+		rw, err := recv()
+		if err == io.EOF {
+			// The peer ends the stream once the tunnel is complete.
+			return nil
+		}
+		if err != nil {
+			return &streamError{err: err}
+		}
+
+		s.wmu.Lock()
+		if s.gen != gen {
+			s.wmu.Unlock()
+			return errSuperseded
+		}
+		err = s.receive(rw)
+		s.wmu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receive handles a frame from the peer. It must be called with wmu held.
+func (s *session) receive(rw *ReadWrite) error {
+	s.mu.Lock()
+	recvd := s.recvd
+	err := s.ackLocked(rw.Ack)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	switch control := rw.Control.(type) {
+	case nil:
+		if len(rw.Buf) == 0 {
+			return nil
+		}
+		if rw.Seq > recvd {
+			return errSessionGap
+		}
+		skip := recvd - rw.Seq
+		if skip >= uint64(len(rw.Buf)) {
+			return nil
+		}
+		b := rw.Buf[skip:]
+		if _, err := s.w.Write(b); err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.recvd += uint64(len(b))
+		s.signal()
+		s.mu.Unlock()
+	case *ReadWrite_Close:
+		if rw.Seq < recvd {
+			return nil
+		}
+		if rw.Seq > recvd {
+			return errSessionGap
+		}
+
+		s.mu.Lock()
+		s.recvd++
+		s.peerClosed = true
+		s.signal()
+		s.mu.Unlock()
+
+		if control.Close.Reason != Close_EOF {
+			return &CloseError{Reason: control.Close.Reason, Message: control.Close.Message}
+		}
+		closeWrite(s.conn)
+	default:
+		return errUnexpectedControl
+	}
+	return nil
+}
+
+// ackLocked drops the data the peer acknowledged. It must be called with mu
+// held.
+func (s *session) ackLocked(ack uint64) error {
+	end := s.base + uint64(len(s.buf))
+	switch {
+	case ack <= s.base:
+		return nil
+	case ack <= end:
+		s.buf = s.buf[ack-s.base:]
+		s.base = ack
+	case ack == end+1 && s.readErr != nil:
+		s.buf = s.buf[len(s.buf):]
+		s.base = end
+		s.closeAcked = true
+	default:
+		return errInvalidAck
+	}
+	s.signal()
+	return nil
+}
+
+// resume asks the server to continue the session on stream. ack is the offset
+// of the next byte expected from the server; the server's is returned.
+func resume(stream ProxyService_ReattachClient, id string, ack uint64) (uint64, error) {
+	if err := stream.Send(&ReadWrite{Control: &ReadWrite_Resume{Resume: &Resume{SessionId: id, Ack: ack}}}); err != nil {
+		return 0, err
+	}
+
+	rw, err := stream.Recv()
+	if err != nil {
+		return 0, err
+	}
+	switch control := rw.Control.(type) {
+	case *ReadWrite_Resume:
+		return control.Resume.Ack, nil
+	case *ReadWrite_Reject:
+		return 0, status.Error(codes.Code(control.Reject.Code), control.Reject.Message)
+	default:
+		return 0, status.Error(codes.Internal, "grproxy: expected resume or reject")
+	}
+}
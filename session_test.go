@@ -0,0 +1,325 @@
+package grproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_session_receive(t *testing.T) {
+	t.Parallel()
+
+	closeEOF := &ReadWrite{Control: &ReadWrite_Close{Close: &Close{}}}
+	tests := map[string]struct {
+		frames     []*ReadWrite
+		want       string
+		wantErr    error
+		peerClosed bool
+	}{
+		"in order": {
+			frames: []*ReadWrite{{Buf: []byte("abc")}, {Buf: []byte("de"), Seq: 3}},
+			want:   "abcde",
+		},
+		"replayed": {
+			frames: []*ReadWrite{{Buf: []byte("abc")}, {Buf: []byte("ab")}, {Buf: []byte("bcde"), Seq: 1}},
+			want:   "abcde",
+		},
+		"gap": {
+			frames:  []*ReadWrite{{Buf: []byte("abc")}, {Buf: []byte("e"), Seq: 4}},
+			want:    "abc",
+			wantErr: errSessionGap,
+		},
+		"close": {
+			frames:     []*ReadWrite{{Buf: []byte("abc")}, {Control: closeEOF.Control, Seq: 3}, {Control: closeEOF.Control, Seq: 3}},
+			want:       "abc",
+			peerClosed: true,
+		},
+		"invalid ack": {
+			frames:  []*ReadWrite{{Ack: 1}},
+			wantErr: errInvalidAck,
+		},
+		"unexpected control": {
+			frames:  []*ReadWrite{{Control: &ReadWrite_Hello{Hello: &Hello{}}}},
+			wantErr: errUnexpectedControl,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			conn, _ := net.Pipe()
+			s := newSession("test", conn, 1024)
+			var buf bytes.Buffer
+			s.w = &buf
+
+			var err error
+			for _, rw := range tc.frames {
+				if err = s.receive(rw); err != nil {
+					break
+				}
+			}
+			if err != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if buf.String() != tc.want {
+				t.Errorf("unexpected result: %s", buf.String())
+			}
+			if s.peerClosed != tc.peerClosed {
+				t.Errorf("unexpected peer closed: %v", s.peerClosed)
+			}
+		})
+	}
+}
+
+func Test_session_ack(t *testing.T) {
+	t.Parallel()
+
+	conn, _ := net.Pipe()
+	s := newSession("test", conn, 4)
+	s.Write([]byte("abcd"))
+
+	// The buffer is full until the peer acknowledges data.
+	written := make(chan struct{})
+	go func() {
+		s.Write([]byte("ef"))
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("expected write to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.mu.Lock()
+	err := s.ackLocked(2)
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-written
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.base != 2 || string(s.buf) != "cdef" {
+		t.Errorf("unexpected buffer: %d %s", s.base, s.buf)
+	}
+}
+
+// startForwarder forwards TCP connections to addr. The returned function
+// breaks all connections forwarded so far.
+func startForwarder(t *testing.T, addr string) (string, func()) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu    sync.Mutex
+		conns []net.Conn
+	)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", addr)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			mu.Lock()
+			conns = append(conns, conn, backend)
+			mu.Unlock()
+			go io.Copy(conn, backend)
+			go io.Copy(backend, conn)
+		}
+	}()
+
+	return lis.Addr().String(), func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		conns = nil
+	}
+}
+
+func Test_resumption(t *testing.T) {
+	t.Parallel()
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", echo.Addr().String())
+	}, WithResumption(Resumption{BufferSize: 64 << 10, Timeout: 10 * time.Second}))
+	srvAddr, stop := startProxyServer(t, svc)
+	defer stop()
+
+	addr, breakConns := startForwarder(t, srvAddr)
+	grpcconn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer grpcconn.Close()
+
+	client := NewProxyClientService(nil, WithHello(&Hello{}), WithClientResumption(Resumption{
+		BufferSize: 64 << 10,
+		Timeout:    10 * time.Second,
+	}))
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- client.Bind(context.TODO(), NewProxyServiceClient(grpcconn), local)
+	}()
+
+	want := make([]byte, 1<<20)
+	if _, err := rand.Read(want); err != nil {
+		t.Fatal(err)
+	}
+	remote.SetDeadline(time.Now().Add(10 * time.Second))
+	go func() {
+		for b := want; len(b) > 0; b = b[1024:] {
+			if _, err := remote.Write(b[:1024]); err != nil {
+				return
+			}
+		}
+		remote.(*net.TCPConn).CloseWrite()
+	}()
+
+	// Break the stream while data is in flight in both directions.
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(remote, got[:256<<10]); err != nil {
+		t.Fatal(err)
+	}
+	breakConns()
+	if _, err := io.ReadFull(remote, got[256<<10:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Error("unexpected result")
+	}
+
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_resumption_timeout(t *testing.T) {
+	t.Parallel()
+
+	backends := make(chan net.Conn, 1)
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		backend, server := net.Pipe()
+		backends <- backend
+		return server, nil
+	}, WithResumption(Resumption{Timeout: 100 * time.Millisecond}))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(handshakeContext(context.TODO()))
+	stream, err := proxycli.Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accept, err := handshake(stream, &Hello{Capabilities: []string{resumeCapability}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept.SessionId == "" {
+		t.Fatal("expected session id")
+	}
+	backend := <-backends
+
+	// The backend stays open while the session may be reattached.
+	cancel()
+	backend.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := backend.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("unexpected close")
+	}
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := backend.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, id := range []string{accept.SessionId, "unknown"} {
+		stream, err := proxycli.Reattach(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resume(stream, id, 0); status.Code(err) != codes.NotFound {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+}
+
+func Test_resumption_halfClose(t *testing.T) {
+	t.Parallel()
+
+	// The backend answers once the client is done sending.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		backend, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer backend.Close()
+		if _, err := ioutil.ReadAll(backend); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+		backend.Write([]byte("pong"))
+	}()
+
+	svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+		return net.Dial("tcp", lis.Addr().String())
+	}, WithResumption(Resumption{Timeout: 10 * time.Second}))
+	proxycli, stop := startGRPCServer(t, svc)
+	defer stop()
+
+	client := NewProxyClientService(nil, WithHello(&Hello{}), WithClientResumption(Resumption{Timeout: 10 * time.Second}))
+	local, remote := tcpPipe(t)
+	defer remote.Close()
+	errc := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		errc <- client.Bind(context.TODO(), proxycli, local)
+	}()
+
+	remote.SetDeadline(time.Now().Add(5 * time.Second))
+	remote.Write([]byte("ping"))
+	remote.(*net.TCPConn).CloseWrite()
+	got, err := ioutil.ReadAll(remote)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("unexpected result: %s %v", got, err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	// The server ends the session instead of keeping it for resumption.
+	for deadline := time.Now().Add(5 * time.Second); len(svc.Tunnels()) > 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected tunnels: %+v", svc.Tunnels())
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package grproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Besides gRPC, the streams of ProxyService can be carried by other
+// transports: WebSocket, and byte streams such as QUIC streams or TCP
+// connections. On the client a transport is a ProxyServiceClient, passed to
+// Bind or WithServiceClient; on the server it serves a ProxyServiceServer,
+// usually a ProxyServerService.
+
+// proxyServiceStream returns the description of the ProxyService stream with
+// the given name, e.g. "Connect".
+func proxyServiceStream(name string) (grpc.StreamDesc, bool) {
+	for _, desc := range _ProxyService_serviceDesc.Streams {
+		if desc.StreamName == name {
+			return desc, true
+		}
+	}
+	return grpc.StreamDesc{}, false
+}
+
+// handleStream runs the handler of desc on ss, through interceptor if any.
+func handleStream(srv ProxyServiceServer, interceptor grpc.StreamServerInterceptor, desc grpc.StreamDesc, ss grpc.ServerStream) error {
+	if interceptor == nil {
+		return desc.Handler(srv, ss)
+	}
+	info := &grpc.StreamServerInfo{
+		FullMethod:     "/" + _ProxyService_serviceDesc.ServiceName + "/" + desc.StreamName,
+		IsClientStream: desc.ClientStreams,
+		IsServerStream: desc.ServerStreams,
+	}
+	return interceptor(srv, ss, info, desc.Handler)
+}
+
+// transportPeer returns the peer of a stream from addr and, when conn has it,
+// the TLS state of the connection.
+func transportPeer(addr net.Addr, conn interface{}) *peer.Peer {
+	p := &peer.Peer{Addr: addr}
+	if c, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		p.AuthInfo = credentials.TLSInfo{State: c.ConnectionState()}
+	}
+	return p
+}
+
+// outgoingMetadata returns the metadata sent when opening a stream to uri: the
+// outgoing metadata of ctx and that of the PerRPCCredentials in opts.
+func outgoingMetadata(ctx context.Context, uri string, opts []grpc.CallOption) (metadata.MD, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = md.Copy()
+	for _, opt := range opts {
+		if creds, ok := opt.(grpc.PerRPCCredsCallOption); ok {
+			m, err := creds.Creds.GetRequestMetadata(ctx, uri)
+			if err != nil {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			for k, v := range m {
+				md.Set(k, v)
+			}
+		}
+	}
+	return md, nil
+}
+
+// On the stream transport every frame is a type byte, the varint length of
+// the payload and the payload. The client sends a StreamHeader and then
+// ReadWrite messages, and ends its side with CloseWrite. The server sends
+// ReadWrite messages and a final StreamStatus.
+const (
+	streamFrameHeader = iota
+	streamFrameMessage
+	streamFrameStatus
+)
+
+// maxStreamFrameSize is the largest message accepted on the stream and
+// WebSocket transports, like the default receive limit of gRPC.
+const maxStreamFrameSize = 4 << 20
+
+// streamHeaderTimeout bounds the time clients have to send the StreamHeader.
+const streamHeaderTimeout = 10 * time.Second
+
+// streamCloseTimeout bounds the time servers wait for clients to close their
+// side once a stream ended.
+const streamCloseTimeout = time.Second
+
+var errStreamFrame = errors.New("grproxy: invalid stream frame")
+
+func writeStreamFrame(w io.Writer, typ byte, m proto.Message) error {
+	b, err := proto.Marshal(m)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(b))
+	buf[0] = typ
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(b)))
+	_, err = w.Write(append(buf[:n], b...))
+	return err
+}
+
+func readStreamFrame(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if n > maxStreamFrameSize {
+		return 0, nil, errStreamFrame
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return typ, b, nil
+}
+
+// StreamDialer opens a byte stream to a server of ServeStreams. The stream
+// should implement CloseWrite, which ends the client side of a ProxyService
+// stream; without it the client side only ends with the stream.
+type StreamDialer func(ctx context.Context) (net.Conn, error)
+
+type streamClient struct {
+	dial StreamDialer
+}
+
+// NewStreamClient returns a ProxyServiceClient that carries every stream of
+// ProxyService on its own byte stream opened with dial. Over a transport that
+// delivers its streams independently, such as QUIC, a lost packet then only
+// stalls the tunnel it belongs to, while it stalls all tunnels sharing an
+// HTTP/2 connection. As with gRPC, the outgoing metadata of the context and the
+// PerRPCCredentials of the call options are sent with each stream.
+func NewStreamClient(dial StreamDialer) ProxyServiceClient {
+	return &streamClient{dial: dial}
+}
+
+func (c *streamClient) Connect(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ConnectClient, error) {
+	cs, err := c.open(ctx, "Connect", opts)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyServiceConnectClient{cs}, nil
+}
+
+func (c *streamClient) Reattach(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ReattachClient, error) {
+	cs, err := c.open(ctx, "Reattach", opts)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyServiceReattachClient{cs}, nil
+}
+
+func (c *streamClient) open(ctx context.Context, method string, opts []grpc.CallOption) (grpc.ClientStream, error) {
+	fullMethod := "/" + _ProxyService_serviceDesc.ServiceName + "/" + method
+	md, err := outgoingMetadata(ctx, fullMethod, opts)
+	if err != nil {
+		return nil, err
+	}
+	header := &StreamHeader{Method: fullMethod}
+	for k, v := range md {
+		header.Metadata = append(header.Metadata, &MetadataEntry{Key: k, Values: v})
+	}
+
+	conn, err := c.dial(ctx)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, err
+	}
+	if err := writeStreamFrame(conn, streamFrameHeader, header); err != nil {
+		conn.Close()
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return newStreamClientStream(ctx, conn), nil
+}
+
+// streamClientStream is a grpc.ClientStream over a byte stream. Canceling its
+// context closes the stream.
+type streamClientStream struct {
+	ctx  context.Context
+	conn net.Conn
+	r    *bufio.Reader
+
+	wmu sync.Mutex
+
+	done chan struct{}
+	once sync.Once
+	err  error // ended the stream, set when done is closed
+}
+
+func newStreamClientStream(ctx context.Context, conn net.Conn) *streamClientStream {
+	s := &streamClientStream{ctx: ctx, conn: conn, r: bufio.NewReader(conn), done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.finish(s.recvError(ctx.Err()))
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+func (s *streamClientStream) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *streamClientStream) Header() (metadata.MD, error) { return nil, nil }
+func (s *streamClientStream) Trailer() metadata.MD         { return nil }
+
+func (s *streamClientStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *streamClientStream) CloseSend() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	closeWrite(s.conn)
+	return nil
+}
+
+// SendMsg fails once the stream is broken with the error that ended it, which
+// is io.EOF for streams that ended normally.
+func (s *streamClientStream) SendMsg(m interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := writeStreamFrame(s.conn, streamFrameMessage, m.(proto.Message)); err != nil {
+		s.finish(s.recvError(err))
+		return s.err
+	}
+	return nil
+}
+
+func (s *streamClientStream) RecvMsg(m interface{}) error {
+	typ, b, err := readStreamFrame(s.r)
+	if err != nil {
+		err = s.recvError(err)
+		s.finish(err)
+		return err
+	}
+	switch typ {
+	case streamFrameMessage:
+		if err := proto.Unmarshal(b, m.(proto.Message)); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
+	case streamFrameStatus:
+		var st StreamStatus
+		err = io.EOF
+		if uerr := proto.Unmarshal(b, &st); uerr != nil {
+			err = status.Error(codes.Internal, uerr.Error())
+		} else if codes.Code(st.Code) != codes.OK {
+			err = status.Error(codes.Code(st.Code), st.Message)
+		}
+		s.finish(err)
+		return err
+	default:
+		err = status.Error(codes.Internal, errStreamFrame.Error())
+		s.finish(err)
+		return err
+	}
+}
+
+func (s *streamClientStream) recvError(err error) error {
+	switch s.ctx.Err() {
+	case context.Canceled:
+		return status.Error(codes.Canceled, s.ctx.Err().Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, s.ctx.Err().Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+type StreamServerOption func(*streamServer)
+
+// WithStreamInterceptor runs the streams of ServeStreams through the given
+// interceptor, such as the stream interceptor that authenticates gRPC clients.
+func WithStreamInterceptor(i grpc.StreamServerInterceptor) StreamServerOption {
+	return func(s *streamServer) {
+		s.interceptor = i
+	}
+}
+
+type streamServer struct {
+	srv         ProxyServiceServer
+	interceptor grpc.StreamServerInterceptor
+}
+
+// ServeStreams serves srv, usually a ProxyServerService, on every byte stream
+// accepted from lis, to clients of NewStreamClient. lis may accept QUIC
+// streams, or TCP connections for one connection per tunnel. Identity
+// functions see the metadata of the client as incoming metadata, and the peer
+// has the TLS state of streams with a ConnectionState method. ServeStreams
+// returns the error of Accept.
+func ServeStreams(lis net.Listener, srv ProxyServiceServer, opts ...StreamServerOption) error {
+	s := &streamServer{srv: srv}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *streamServer) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(streamHeaderTimeout))
+	typ, b, err := readStreamFrame(r)
+	var header StreamHeader
+	if err != nil || typ != streamFrameHeader || proto.Unmarshal(b, &header) != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	md := metadata.MD{}
+	for _, e := range header.Metadata {
+		md[strings.ToLower(e.Key)] = e.Values
+	}
+	ctx = metadata.NewIncomingContext(ctx, md)
+	ctx = peer.NewContext(ctx, transportPeer(conn.RemoteAddr(), conn))
+
+	ss := newStreamServerStream(ctx, cancel, conn, r)
+	prefix := "/" + _ProxyService_serviceDesc.ServiceName + "/"
+	desc, ok := proxyServiceStream(strings.TrimPrefix(header.Method, prefix))
+	if !strings.HasPrefix(header.Method, prefix) || !ok {
+		err = status.Errorf(codes.Unimplemented, "grproxy: unknown method %s", header.Method)
+	} else {
+		err = handleStream(s.srv, s.interceptor, desc, ss)
+	}
+	ss.close(err)
+}
+
+type streamMessage struct {
+	b   []byte
+	err error
+}
+
+// streamServerStream is a grpc.ServerStream over a byte stream. Frames are
+// read by a single goroutine, so that the stream notices clients going away
+// even when nobody receives.
+type streamServerStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	conn   net.Conn
+	r      *bufio.Reader
+
+	wmu sync.Mutex
+
+	msgs     chan streamMessage
+	closed   chan struct{}
+	readDone chan struct{}
+	eof      bool // only accessed by the receiving goroutine
+}
+
+func newStreamServerStream(ctx context.Context, cancel context.CancelFunc, conn net.Conn, r *bufio.Reader) *streamServerStream {
+	s := &streamServerStream{
+		ctx:      ctx,
+		cancel:   cancel,
+		conn:     conn,
+		r:        r,
+		msgs:     make(chan streamMessage),
+		closed:   make(chan struct{}),
+		readDone: make(chan struct{}),
+	}
+	go s.read()
+	return s
+}
+
+func (s *streamServerStream) read() {
+	defer close(s.readDone)
+	for {
+		typ, b, err := readStreamFrame(s.r)
+		if err == nil && typ != streamFrameMessage {
+			err = errStreamFrame
+		}
+		if err != nil && err != io.EOF {
+			s.cancel()
+		}
+		select {
+		case s.msgs <- streamMessage{b: b, err: err}:
+		case <-s.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *streamServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *streamServerStream) SendHeader(metadata.MD) error { return nil }
+func (s *streamServerStream) SetTrailer(metadata.MD)       {}
+
+func (s *streamServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *streamServerStream) SendMsg(m interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := writeStreamFrame(s.conn, streamFrameMessage, m.(proto.Message)); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+func (s *streamServerStream) RecvMsg(m interface{}) error {
+	if s.eof {
+		return io.EOF
+	}
+	var msg streamMessage
+	select {
+	case msg = <-s.msgs:
+	case <-s.closed:
+		return status.Error(codes.Canceled, "grproxy: stream closed")
+	}
+	switch {
+	case msg.err == io.EOF:
+		s.eof = true
+		return io.EOF
+	case msg.err != nil:
+		return status.Error(codes.Canceled, msg.err.Error())
+	}
+	if err := proto.Unmarshal(msg.b, m.(proto.Message)); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// close ends the stream with the status of err, and waits a little for the
+// client to close its side so that the status is not lost to a reset.
+func (s *streamServerStream) close(err error) {
+	st := status.Convert(err)
+	// The deadline also unblocks a SendMsg stuck on a client that stopped
+	// reading.
+	s.conn.SetWriteDeadline(time.Now().Add(streamCloseTimeout))
+	s.wmu.Lock()
+	writeStreamFrame(s.conn, streamFrameStatus, &StreamStatus{Code: uint32(st.Code()), Message: st.Message()})
+	closeWrite(s.conn)
+	s.wmu.Unlock()
+
+	close(s.closed)
+	s.conn.SetReadDeadline(time.Now().Add(streamCloseTimeout))
+	<-s.readDone
+	io.Copy(ioutil.Discard, s.r)
+	s.conn.Close()
+}
@@ -0,0 +1,214 @@
+package grproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startStreamServer serves svc with ServeStreams on TCP connections.
+func startStreamServer(t *testing.T, svc ProxyServiceServer, opts ...StreamServerOption) (ProxyServiceClient, func()) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeStreams(lis, svc, opts...)
+	return NewStreamClient(func(ctx context.Context) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", lis.Addr().String())
+	}), func() { lis.Close() }
+}
+
+func Test_ServeStreams(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		hello       *Hello
+		user        string
+		interceptor grpc.StreamServerInterceptor
+		resumption  bool
+		wantCode    codes.Code
+	}{
+		"tunnel": {
+			hello: &Hello{Target: "echo"},
+		},
+		"legacy": {},
+		"session": {
+			hello:      &Hello{Target: "echo"},
+			resumption: true,
+		},
+		"authorized": {
+			hello:       &Hello{Target: "echo"},
+			user:        "alice",
+			interceptor: denyAnonymous,
+		},
+		"denied": {
+			hello:       &Hello{Target: "echo"},
+			interceptor: denyAnonymous,
+			wantCode:    codes.PermissionDenied,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			echo := startEchoServer(t)
+			defer echo.Close()
+
+			srvOpts := []ServerServiceOption{WithIdentity(userIdentity)}
+			var cliOpts []ClientServiceOption
+			if tc.resumption {
+				srvOpts = append(srvOpts, WithResumption(Resumption{}))
+				cliOpts = append(cliOpts, WithClientResumption(Resumption{}))
+			}
+			if tc.hello != nil {
+				cliOpts = append(cliOpts, WithHello(tc.hello))
+			}
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				return net.Dial("tcp", echo.Addr().String())
+			}, srvOpts...)
+			var opts []StreamServerOption
+			if tc.interceptor != nil {
+				opts = append(opts, WithStreamInterceptor(tc.interceptor))
+			}
+			proxycli, stop := startStreamServer(t, svc, opts...)
+			defer stop()
+
+			ctx := context.TODO()
+			if tc.user != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "x-user", tc.user)
+			}
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				errc <- NewProxyClientService(nil, cliOpts...).Bind(ctx, proxycli, local)
+			}()
+
+			if tc.wantCode != codes.OK {
+				if err := <-errc; status.Code(err) != tc.wantCode {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			remote.Write([]byte("ping"))
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(remote, b); err != nil || string(b) != "ping" {
+				t.Fatalf("unexpected result: %s %v", b, err)
+			}
+			if got := svc.Tunnels(); len(got) != 1 || got[0].Resumable != tc.resumption || got[0].Identity != tc.user || got[0].Peer == "" {
+				t.Errorf("unexpected tunnels: %+v", got)
+			}
+			remote.(*net.TCPConn).CloseWrite()
+			if err := <-errc; err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := remote.Read(b); err != io.EOF {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_ServeStreams_unknownMethod(t *testing.T) {
+	t.Parallel()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go ServeStreams(lis, NewProxyServerService(nil))
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := writeStreamFrame(conn, streamFrameHeader, &StreamHeader{Method: "/main.ProxyService/Unknown"}); err != nil {
+		t.Fatal(err)
+	}
+
+	typ, b, err := readStreamFrame(bufio.NewReader(conn))
+	var st StreamStatus
+	if err != nil || typ != streamFrameStatus || proto.Unmarshal(b, &st) != nil || codes.Code(st.Code) != codes.Unimplemented {
+		t.Errorf("unexpected frame: %d %v %v", typ, &st, err)
+	}
+}
+
+func Test_streamClientStream_closedBeforeHello(t *testing.T) {
+	t.Parallel()
+
+	// The server reads the StreamHeader and closes the stream.
+	proxycli := NewStreamClient(func(ctx context.Context) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			readStreamFrame(bufio.NewReader(server))
+		}()
+		return client, nil
+	})
+	stream, err := proxycli.Connect(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := handshake(stream, &Hello{Target: "db"})
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handshake hangs")
+	}
+}
+
+func Test_streamServerStream_closeWithoutReader(t *testing.T) {
+	t.Parallel()
+
+	// The client never reads, so writes to server block.
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := newStreamServerStream(ctx, cancel, server, bufio.NewReader(server))
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.SendMsg(&ReadWrite{Buf: []byte("ping")})
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		s.close(nil)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close hangs")
+	}
+	if err := <-sent; status.Code(err) != codes.Unavailable {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
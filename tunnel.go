@@ -0,0 +1,211 @@
+package grproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxTunnelIDLength bounds the tunnel IDs clients may choose.
+const maxTunnelIDLength = 64
+
+// tunnelCounters are the counters of all tunnels of the process. Keys are
+// prefixed with "client." or "server.".
+var tunnelCounters counters
+
+type counters struct {
+	m sync.Map // string -> *int64
+}
+
+func (c *counters) add(key string, delta int64) {
+	n, ok := c.m.Load(key)
+	if !ok {
+		n, _ = c.m.LoadOrStore(key, new(int64))
+	}
+	atomic.AddInt64(n.(*int64), delta)
+}
+
+// TunnelCounters returns the counters of all tunnels of the process, such as
+// "server.tunnels_open" or "client.bytes_upstream".
+func TunnelCounters() map[string]int64 {
+	m := make(map[string]int64)
+	tunnelCounters.m.Range(func(key, n interface{}) bool {
+		m[key.(string)] = atomic.LoadInt64(n.(*int64))
+		return true
+	})
+	return m
+}
+
+func newTunnelID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// TunnelStatus describes an open tunnel. Upstream bytes were written towards
+// the backend and downstream bytes towards the client.
+type TunnelStatus struct {
+	ID              string    `json:"id"`
+	Identity        string    `json:"identity,omitempty"`
+	Target          string    `json:"target,omitempty"`
+	Peer            string    `json:"peer,omitempty"`
+	Backend         string    `json:"backend,omitempty"`
+	Start           time.Time `json:"start_time"`
+	UpstreamBytes   uint64    `json:"upstream_bytes"`
+	DownstreamBytes uint64    `json:"downstream_bytes"`
+	Resumable       bool      `json:"resumable"`
+}
+
+// TunnelLister is implemented by ProxyServerService and by the
+// ProxyClientService of NewProxyClientService.
+type TunnelLister interface {
+	// Tunnels returns the open tunnels, oldest first.
+	Tunnels() []TunnelStatus
+}
+
+// tunnel is an open tunnel of a tunnelTable.
+type tunnel struct {
+	info   TunnelInfo
+	start  time.Time
+	kill   func()
+	prefix string
+
+	resumable bool // guarded by tunnelTable.mu
+
+	upstream   uint64 // atomic
+	downstream uint64 // atomic
+	killed     int32  // atomic
+}
+
+// counter counts the bytes written to w in the direction dir.
+func (t *tunnel) counter(w io.Writer, dir Direction) io.Writer {
+	n, key := &t.upstream, t.prefix+"bytes_upstream"
+	if dir == Downstream {
+		n, key = &t.downstream, t.prefix+"bytes_downstream"
+	}
+	return writer(func(b []byte) (int, error) {
+		m, err := w.Write(b)
+		atomic.AddUint64(n, uint64(m))
+		tunnelCounters.add(key, int64(m))
+		return m, err
+	})
+}
+
+func (t *tunnel) isKilled() bool {
+	return atomic.LoadInt32(&t.killed) != 0
+}
+
+// tunnelTable tracks the open tunnels of a client or server service.
+type tunnelTable struct {
+	prefix string
+
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+}
+
+func newTunnelTable(side string) *tunnelTable {
+	return &tunnelTable{
+		prefix:  side + ".",
+		tunnels: make(map[string]*tunnel),
+	}
+}
+
+// add registers an open tunnel. Its ID is id unless that is empty, too long
+// or taken. kill is called when the tunnel is killed.
+func (tt *tunnelTable) add(id string, info TunnelInfo, resumable bool, kill func()) *tunnel {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if len(id) > maxTunnelIDLength {
+		id = ""
+	}
+	for _, ok := tt.tunnels[id]; id == "" || ok; _, ok = tt.tunnels[id] {
+		id = newTunnelID()
+	}
+	info.ID = id
+	t := &tunnel{info: info, start: time.Now(), resumable: resumable, kill: kill, prefix: tt.prefix}
+	tt.tunnels[id] = t
+	tunnelCounters.add(tt.prefix+"tunnels_opened", 1)
+	tunnelCounters.add(tt.prefix+"tunnels_open", 1)
+	return t
+}
+
+func (tt *tunnelTable) remove(t *tunnel) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	if tt.tunnels[t.info.ID] == t {
+		delete(tt.tunnels, t.info.ID)
+		tunnelCounters.add(tt.prefix+"tunnels_open", -1)
+	}
+}
+
+func (tt *tunnelTable) setResumable(t *tunnel) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	t.resumable = true
+}
+
+// list returns the open tunnels matching identity and target, oldest first.
+// Empty values match every tunnel.
+func (tt *tunnelTable) list(identity, target string) []TunnelStatus {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tunnels := make([]TunnelStatus, 0, len(tt.tunnels))
+	for _, t := range tt.tunnels {
+		if (identity == "" || t.info.Identity == identity) && (target == "" || t.info.Target == target) {
+			tunnels = append(tunnels, t.status())
+		}
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		if !tunnels[i].Start.Equal(tunnels[j].Start) {
+			return tunnels[i].Start.Before(tunnels[j].Start)
+		}
+		return tunnels[i].ID < tunnels[j].ID
+	})
+	return tunnels
+}
+
+// status must be called with tunnelTable.mu held.
+func (t *tunnel) status() TunnelStatus {
+	s := TunnelStatus{
+		ID:              t.info.ID,
+		Identity:        t.info.Identity,
+		Target:          t.info.Target,
+		Start:           t.start,
+		UpstreamBytes:   atomic.LoadUint64(&t.upstream),
+		DownstreamBytes: atomic.LoadUint64(&t.downstream),
+		Resumable:       t.resumable,
+	}
+	if t.info.Client != nil {
+		s.Peer = t.info.Client.String()
+	}
+	if t.info.Backend != nil {
+		s.Backend = t.info.Backend.String()
+	}
+	return s
+}
+
+// kill kills the tunnel with the given ID. It reports whether the tunnel was
+// open.
+func (tt *tunnelTable) kill(id string) bool {
+	tt.mu.Lock()
+	t, ok := tt.tunnels[id]
+	tt.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&t.killed, 0, 1) {
+		tunnelCounters.add(tt.prefix+"tunnels_killed", 1)
+		t.kill()
+	}
+	return true
+}
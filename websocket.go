@@ -0,0 +1,417 @@
+package grproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The WebSocket transport carries each stream of ProxyService over its own
+// WebSocket connection, for networks whose proxies only pass HTTP/1.1. The
+// stream method is the last element of the URL path, metadata travels as
+// request headers and every binary message is one ReadWrite. Clients end their
+// side of the stream with an empty text message, and servers end the stream
+// with a close frame whose code is webSocketStatusBase plus the gRPC status
+// code, or a normal closure for OK.
+const webSocketStatusBase = 4000
+
+// webSocketCloseTimeout bounds the closing handshake.
+const webSocketCloseTimeout = time.Second
+
+type WebSocketHandlerOption func(*webSocketHandler)
+
+// WithWebSocketInterceptor runs the streams of the handler through the given
+// interceptor, such as the stream interceptor that authenticates gRPC clients.
+func WithWebSocketInterceptor(i grpc.StreamServerInterceptor) WebSocketHandlerOption {
+	return func(h *webSocketHandler) {
+		h.interceptor = i
+	}
+}
+
+type webSocketHandler struct {
+	srv         ProxyServiceServer
+	upgrader    websocket.Upgrader
+	interceptor grpc.StreamServerInterceptor
+}
+
+// NewWebSocketHandler returns a handler that serves srv, usually a
+// ProxyServerService, over WebSocket to clients of NewWebSocketClient. It can
+// be mounted under any path of an HTTP server next to gRPC. Identity functions
+// see the request headers as incoming metadata and the TLS state of the
+// request in the peer, as they would for gRPC.
+func NewWebSocketHandler(srv ProxyServiceServer, opts ...WebSocketHandlerOption) http.Handler {
+	h := &webSocketHandler{srv: srv}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *webSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	desc, ok := proxyServiceStream(path.Base(r.URL.Path))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(maxStreamFrameSize)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	md := metadata.MD{}
+	for k, v := range r.Header {
+		md[strings.ToLower(k)] = v
+	}
+	ctx = metadata.NewIncomingContext(ctx, md)
+	p := &peer.Peer{}
+	if addr := parseTCPAddr(r.RemoteAddr); addr != nil {
+		p.Addr = addr
+	}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx = peer.NewContext(ctx, p)
+
+	ss := newWebSocketServerStream(ctx, cancel, conn)
+	ss.close(handleStream(h.srv, h.interceptor, desc, ss))
+}
+
+type webSocketMessage struct {
+	typ int
+	b   []byte
+	err error
+}
+
+// webSocketServerStream is a grpc.ServerStream over a WebSocket connection.
+// Messages are read by a single goroutine, so that the connection notices
+// clients going away even when nobody receives.
+type webSocketServerStream struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	conn   *websocket.Conn
+
+	wmu sync.Mutex
+
+	msgs     chan webSocketMessage
+	closed   chan struct{}
+	readDone chan struct{}
+	eof      bool // only accessed by the receiving goroutine
+}
+
+func newWebSocketServerStream(ctx context.Context, cancel context.CancelFunc, conn *websocket.Conn) *webSocketServerStream {
+	s := &webSocketServerStream{
+		ctx:      ctx,
+		cancel:   cancel,
+		conn:     conn,
+		msgs:     make(chan webSocketMessage),
+		closed:   make(chan struct{}),
+		readDone: make(chan struct{}),
+	}
+	go s.read()
+	return s
+}
+
+func (s *webSocketServerStream) read() {
+	defer close(s.readDone)
+	for {
+		typ, b, err := s.conn.ReadMessage()
+		if err != nil {
+			s.cancel()
+		}
+		select {
+		case s.msgs <- webSocketMessage{typ: typ, b: b, err: err}:
+		case <-s.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *webSocketServerStream) SetHeader(metadata.MD) error  { return nil }
+func (s *webSocketServerStream) SendHeader(metadata.MD) error { return nil }
+func (s *webSocketServerStream) SetTrailer(metadata.MD)       {}
+
+func (s *webSocketServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *webSocketServerStream) SendMsg(m interface{}) error {
+	b, err := proto.Marshal(m.(proto.Message))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return nil
+}
+
+func (s *webSocketServerStream) RecvMsg(m interface{}) error {
+	if s.eof {
+		return io.EOF
+	}
+	var msg webSocketMessage
+	select {
+	case msg = <-s.msgs:
+	case <-s.closed:
+		return status.Error(codes.Canceled, "grproxy: stream closed")
+	}
+	switch {
+	case msg.err != nil:
+		return status.Error(codes.Canceled, msg.err.Error())
+	case msg.typ == websocket.TextMessage:
+		s.eof = true
+		return io.EOF
+	}
+	if err := proto.Unmarshal(msg.b, m.(proto.Message)); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// close ends the stream with the status of err and waits a little for the
+// client to answer the close frame.
+func (s *webSocketServerStream) close(err error) {
+	code, text := websocket.CloseNormalClosure, ""
+	if st := status.Convert(err); err != nil {
+		code, text = webSocketStatusBase+int(st.Code()), st.Message()
+	}
+	if len(text) > 123 {
+		text = text[:123]
+	}
+	deadline := time.Now().Add(webSocketCloseTimeout)
+	s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), deadline)
+
+	close(s.closed)
+	s.conn.SetReadDeadline(deadline)
+	<-s.readDone
+	for {
+		if _, _, err := s.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+type WebSocketClientOption func(*webSocketClient)
+
+// WithWebSocketHeader adds header to the requests opening streams, e.g. for
+// the authentication of an HTTP proxy in front of the server.
+func WithWebSocketHeader(header http.Header) WebSocketClientOption {
+	return func(c *webSocketClient) {
+		for k, v := range header {
+			c.header[k] = append(c.header[k], v...)
+		}
+	}
+}
+
+// WithWebSocketTLS sets the TLS configuration of wss URLs.
+func WithWebSocketTLS(config *tls.Config) WebSocketClientOption {
+	return func(c *webSocketClient) {
+		c.dialer.TLSClientConfig = config
+	}
+}
+
+// WithWebSocketProxy sets the function returning the HTTP proxy of a request.
+// The default is http.ProxyFromEnvironment.
+func WithWebSocketProxy(proxy func(*http.Request) (*url.URL, error)) WebSocketClientOption {
+	return func(c *webSocketClient) {
+		c.dialer.Proxy = proxy
+	}
+}
+
+type webSocketClient struct {
+	url    string
+	header http.Header
+	dialer websocket.Dialer
+}
+
+// NewWebSocketClient returns a ProxyServiceClient that opens every stream as a
+// WebSocket connection to rawurl, a ws or wss URL served by
+// NewWebSocketHandler. Pass it to Bind, or to WithServiceClient. As with gRPC,
+// the outgoing metadata of the context and the PerRPCCredentials of the call
+// options are sent with each stream.
+func NewWebSocketClient(rawurl string, opts ...WebSocketClientOption) ProxyServiceClient {
+	c := &webSocketClient{
+		url:    strings.TrimSuffix(rawurl, "/"),
+		header: http.Header{},
+		dialer: *websocket.DefaultDialer,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+func (c *webSocketClient) Connect(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ConnectClient, error) {
+	cs, err := c.open(ctx, "Connect", opts)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyServiceConnectClient{cs}, nil
+}
+
+func (c *webSocketClient) Reattach(ctx context.Context, opts ...grpc.CallOption) (ProxyService_ReattachClient, error) {
+	cs, err := c.open(ctx, "Reattach", opts)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyServiceReattachClient{cs}, nil
+}
+
+func (c *webSocketClient) open(ctx context.Context, method string, opts []grpc.CallOption) (grpc.ClientStream, error) {
+	md, err := outgoingMetadata(ctx, c.url, opts)
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	for k, v := range c.header {
+		header[k] = v
+	}
+	for k, v := range md {
+		header[http.CanonicalHeaderKey(k)] = append(header[http.CanonicalHeaderKey(k)], v...)
+	}
+
+	conn, resp, err := c.dialer.DialContext(ctx, c.url+"/"+method, header)
+	if err != nil {
+		return nil, webSocketDialError(resp, err)
+	}
+	conn.SetReadLimit(maxStreamFrameSize)
+	return newWebSocketClientStream(ctx, conn), nil
+}
+
+func webSocketDialError(resp *http.Response, err error) error {
+	if resp == nil {
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	code := codes.Unavailable
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusProxyAuthRequired:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.Unimplemented
+	}
+	return status.Errorf(code, "grproxy: websocket handshake: %s", resp.Status)
+}
+
+// webSocketClientStream is a grpc.ClientStream over a WebSocket connection.
+// Canceling its context closes the connection.
+type webSocketClientStream struct {
+	ctx  context.Context
+	conn *websocket.Conn
+
+	wmu sync.Mutex
+
+	done chan struct{}
+	once sync.Once
+	err  error // ended the stream, set when done is closed
+}
+
+func newWebSocketClientStream(ctx context.Context, conn *websocket.Conn) *webSocketClientStream {
+	s := &webSocketClientStream{ctx: ctx, conn: conn, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.finish(s.recvError(ctx.Err()))
+		case <-s.done:
+		}
+	}()
+	return s
+}
+
+func (s *webSocketClientStream) finish(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+		s.conn.Close()
+	})
+}
+
+func (s *webSocketClientStream) Header() (metadata.MD, error) { return nil, nil }
+func (s *webSocketClientStream) Trailer() metadata.MD         { return nil }
+
+func (s *webSocketClientStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *webSocketClientStream) CloseSend() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, nil)
+}
+
+// SendMsg fails once the stream is broken with the error that ended it, which
+// is io.EOF for streams that ended normally.
+func (s *webSocketClientStream) SendMsg(m interface{}) error {
+	b, err := proto.Marshal(m.(proto.Message))
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		s.finish(s.recvError(err))
+		return s.err
+	}
+	return nil
+}
+
+func (s *webSocketClientStream) RecvMsg(m interface{}) error {
+	typ, b, err := s.conn.ReadMessage()
+	if err != nil {
+		err = s.recvError(err)
+		s.finish(err)
+		return err
+	}
+	if typ != websocket.BinaryMessage {
+		err := status.Error(codes.Internal, "grproxy: unexpected websocket message")
+		s.finish(err)
+		return err
+	}
+	if err := proto.Unmarshal(b, m.(proto.Message)); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+func (s *webSocketClientStream) recvError(err error) error {
+	switch s.ctx.Err() {
+	case context.Canceled:
+		return status.Error(codes.Canceled, s.ctx.Err().Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, s.ctx.Err().Error())
+	}
+	if ce, ok := err.(*websocket.CloseError); ok {
+		switch {
+		case ce.Code == websocket.CloseNormalClosure:
+			return io.EOF
+		case ce.Code > webSocketStatusBase && ce.Code <= webSocketStatusBase+int(codes.Unauthenticated):
+			return status.Error(codes.Code(ce.Code-webSocketStatusBase), ce.Text)
+		}
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
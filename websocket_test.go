@@ -0,0 +1,213 @@
+package grproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_WebSocket(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		hello       *Hello
+		header      http.Header
+		interceptor grpc.StreamServerInterceptor
+		resumption  bool
+		wantCode    codes.Code
+	}{
+		"tunnel": {
+			hello: &Hello{Target: "echo"},
+		},
+		"legacy": {},
+		"session": {
+			hello:      &Hello{Target: "echo"},
+			resumption: true,
+		},
+		"authorized": {
+			hello:       &Hello{Target: "echo"},
+			header:      http.Header{"X-User": {"alice"}},
+			interceptor: denyAnonymous,
+		},
+		"denied": {
+			hello:       &Hello{Target: "echo"},
+			interceptor: denyAnonymous,
+			wantCode:    codes.PermissionDenied,
+		},
+		"denied legacy": {
+			interceptor: denyAnonymous,
+			wantCode:    codes.PermissionDenied,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			echo := startEchoServer(t)
+			defer echo.Close()
+
+			srvOpts := []ServerServiceOption{WithIdentity(userIdentity)}
+			var cliOpts []ClientServiceOption
+			if tc.resumption {
+				srvOpts = append(srvOpts, WithResumption(Resumption{}))
+				cliOpts = append(cliOpts, WithClientResumption(Resumption{}))
+			}
+			svc := NewProxyServerService(func(ctx context.Context) (net.Conn, error) {
+				return net.Dial("tcp", echo.Addr().String())
+			}, srvOpts...)
+			var opts []WebSocketHandlerOption
+			if tc.interceptor != nil {
+				opts = append(opts, WithWebSocketInterceptor(tc.interceptor))
+			}
+			hs := httptest.NewServer(NewWebSocketHandler(svc, opts...))
+			defer hs.Close()
+
+			if tc.hello != nil {
+				cliOpts = append(cliOpts, WithHello(tc.hello))
+			}
+			proxycli := NewWebSocketClient("ws"+strings.TrimPrefix(hs.URL, "http")+"/grproxy/", WithWebSocketHeader(tc.header))
+			local, remote := tcpPipe(t)
+			defer remote.Close()
+			errc := make(chan error, 1)
+			go func() {
+				defer local.Close()
+				errc <- NewProxyClientService(nil, cliOpts...).Bind(context.TODO(), proxycli, local)
+			}()
+
+			if tc.wantCode != codes.OK {
+				if err := <-errc; status.Code(err) != tc.wantCode {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+
+			remote.SetDeadline(time.Now().Add(5 * time.Second))
+			remote.Write([]byte("ping"))
+			b := make([]byte, 4)
+			if _, err := io.ReadFull(remote, b); err != nil || string(b) != "ping" {
+				t.Fatalf("unexpected result: %s %v", b, err)
+			}
+			if got := svc.Tunnels(); len(got) != 1 || got[0].Resumable != tc.resumption || got[0].Identity != strings.Join(tc.header["X-User"], ",") || got[0].Peer == "" {
+				t.Errorf("unexpected tunnels: %+v", got)
+			}
+			remote.(*net.TCPConn).CloseWrite()
+			if err := <-errc; err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := remote.Read(b); err != io.EOF {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_webSocketDialError(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		handler  http.HandlerFunc
+		wantCode codes.Code
+	}{
+		"unauthorized": {
+			handler:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusUnauthorized) },
+			wantCode: codes.Unauthenticated,
+		},
+		"not found": {
+			handler:  http.NotFound,
+			wantCode: codes.Unimplemented,
+		},
+		"not websocket": {
+			handler:  func(w http.ResponseWriter, r *http.Request) {},
+			wantCode: codes.Unavailable,
+		},
+	}
+
+	for tn, tc := range tests {
+		t.Run(tn, func(t *testing.T) {
+			hs := httptest.NewServer(tc.handler)
+			defer hs.Close()
+
+			proxycli := NewWebSocketClient("ws" + strings.TrimPrefix(hs.URL, "http"))
+			if _, err := proxycli.Connect(context.TODO()); status.Code(err) != tc.wantCode {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_webSocketClientStream_broken(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		serve    func(conn *websocket.Conn)
+		recv     bool
+		wantCode codes.Code
+	}{
+		"message too large": {
+			serve: func(conn *websocket.Conn) {
+				conn.WriteMessage(websocket.BinaryMessage, make([]byte, maxStreamFrameSize+1))
+				conn.ReadMessage()
+			},
+			recv:     true,
+			wantCode: codes.Unavailable,
+		},
+		"closed before hello": {
+			serve:    func(conn *websocket.Conn) {},
+			wantCode: codes.Unavailable,
+		},
+	}
+
+	for tn, tc := range tests {
+		tc := tc
+		t.Run(tn, func(t *testing.T) {
+			var upgrader websocket.Upgrader
+			hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				tc.serve(conn)
+			}))
+			defer hs.Close()
+
+			stream, err := NewWebSocketClient("ws" + strings.TrimPrefix(hs.URL, "http")).Connect(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.recv {
+				if _, err := stream.Recv(); status.Code(err) != tc.wantCode {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+
+			// Nobody receives, so sending must fail on its own.
+			errc := make(chan error, 1)
+			go func() {
+				for {
+					if err := stream.Send(&ReadWrite{Buf: make([]byte, 1024)}); err != nil {
+						errc <- err
+						return
+					}
+				}
+			}()
+			select {
+			case err := <-errc:
+				if status.Code(err) != tc.wantCode {
+					t.Errorf("unexpected error: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("send hangs")
+			}
+		})
+	}
+}